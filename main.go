@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"nosql-engine/packages/utils/compaction"
 	"nosql-engine/packages/utils/database"
 	"strings"
 )
@@ -51,7 +52,11 @@ func Menu() {
 	fmt.Println("16 - LIST(PREFIX) SCAN")
 	fmt.Println("")
 
-	fmt.Println("17 - EXIT")
+	fmt.Println("17 - COMPACT RANGE")
+	fmt.Println("18 - COMPACT ALL")
+	fmt.Println("")
+
+	fmt.Println("19 - EXIT")
 	fmt.Println("")
 }
 
@@ -362,6 +367,30 @@ func RangeScanOperation(db *database.Database) {
 	fmt.Println(res)
 }
 
+func CompactRangeOperation(db *database.Database) {
+	var start, stop string
+
+	fmt.Print("Start: ")
+	fmt.Scanf("%s", &start)
+	fmt.Scanln()
+
+	fmt.Print("Stop: ")
+	fmt.Scanf("%s", &stop)
+	fmt.Scanln()
+
+	db.CompactRange(start, stop, PrintProgress)
+	fmt.Println("OK")
+}
+
+func CompactAllOperation(db *database.Database) {
+	db.CompactAll(PrintProgress)
+	fmt.Println("OK")
+}
+
+func PrintProgress(p compaction.Progress) {
+	fmt.Printf("Step %d/%d: level %d, %d tables merged into %d\n", p.Step, p.Steps, p.Level, p.Inputs, p.Outputs)
+}
+
 func Pagination() (uint64, uint64) {
 	fmt.Print("Page Size: ")
 	ps := GetUint64()
@@ -381,7 +410,7 @@ func main() {
 		}
 
 		Menu()
-		op := GetOp(17)
+		op := GetOp(19)
 
 		switch op {
 		case 1:
@@ -417,9 +446,14 @@ func main() {
 		case 16:
 			ListScanOperation(db)
 		case 17:
+			CompactRangeOperation(db)
+		case 18:
+			CompactAllOperation(db)
+		case 19:
 			br = true
 		}
 	}
 
+	db.Close()
 	fmt.Println("BYE BYE")
 }
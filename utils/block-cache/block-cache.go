@@ -0,0 +1,155 @@
+package blockcache
+
+import (
+	"container/list"
+	"nosql-engine/packages/utils/config"
+	"sync"
+)
+
+const (
+	DEFAULT_SHARDS = 16
+	ENTRY_OVERHEAD = 64 // bytes every entry costs besides its block, the key and the list element
+)
+
+// Key is a block of a table file: the id of the file and the offset the block starts at
+type Key struct {
+	Table  uint64
+	Offset uint64
+}
+
+type Stats struct {
+	Hits      uint64
+	Misses    uint64
+	Inserts   uint64
+	Evictions uint64 // blocks dropped to make room, blocks of deleted tables aren't counted
+	Size      uint64 // bytes held right now
+	Capacity  uint64
+}
+
+type entry struct {
+	key   Key
+	block []byte
+}
+
+// every shard is a LRU of its own with a part of the budget, so lookups of different blocks rarely wait for each other
+type shard struct {
+	lock     sync.Mutex
+	capacity uint64
+	size     uint64
+	lru      *list.List
+	entries  map[Key]*list.Element
+	stats    Stats
+}
+
+// Cache holds blocks of table files up to a number of bytes, shared by everything that reads tables
+type Cache struct {
+	shards []*shard
+}
+
+var (
+	shared     *Cache
+	sharedOnce sync.Once
+)
+
+// capacity in bytes, 0 turns the cache off
+func New(capacity uint64, shards int) *Cache {
+	if shards <= 0 {
+		shards = DEFAULT_SHARDS
+	}
+	c := &Cache{shards: make([]*shard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &shard{capacity: capacity / uint64(shards), lru: list.New(), entries: make(map[Key]*list.Element)}
+	}
+	return c
+}
+
+// cache every table reader uses, sized by the config
+func Shared() *Cache {
+	sharedOnce.Do(func() {
+		cfg := config.GetConfig()
+		shared = New(cfg.BlockCacheSize, int(cfg.BlockCacheShards))
+	})
+	return shared
+}
+
+func (c *Cache) shard(key Key) *shard {
+	h := key.Table*0x9E3779B97F4A7C15 ^ key.Offset*0xC2B2AE3D27D4EB4F
+	return c.shards[(h>>32)%uint64(len(c.shards))]
+}
+
+// the block must not be changed by the caller
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		s.stats.Misses++
+		return nil, false
+	}
+	s.stats.Hits++
+	s.lru.MoveToFront(element)
+	return element.Value.(*entry).block, true
+}
+
+// the block must not be changed after it is inserted. Blocks bigger than a whole shard aren't kept
+func (c *Cache) Insert(key Key, block []byte) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	charge := uint64(len(block)) + ENTRY_OVERHEAD
+	if charge > s.capacity {
+		return
+	}
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&entry{key: key, block: block})
+	s.size += charge
+	s.stats.Inserts++
+	for s.size > s.capacity {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// drops all blocks of the table, called when its files are deleted
+func (c *Cache) EvictTable(table uint64) {
+	for _, s := range c.shards {
+		s.lock.Lock()
+		for key, element := range s.entries {
+			if key.Table == table {
+				s.remove(element)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// lock has to be held
+func (s *shard) remove(element *list.Element) {
+	e := element.Value.(*entry)
+	s.lru.Remove(element)
+	delete(s.entries, e.key)
+	s.size -= uint64(len(e.block)) + ENTRY_OVERHEAD
+}
+
+// summed over all shards
+func (c *Cache) Stats() Stats {
+	var stats Stats
+	for _, s := range c.shards {
+		s.lock.Lock()
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Inserts += s.stats.Inserts
+		stats.Evictions += s.stats.Evictions
+		stats.Size += s.size
+		stats.Capacity += s.capacity
+		s.lock.Unlock()
+	}
+	return stats
+}
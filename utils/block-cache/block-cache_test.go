@@ -0,0 +1,53 @@
+package blockcache
+
+import "testing"
+
+func TestCache(t *testing.T) {
+	// one shard so the whole budget is in one LRU
+	cache := New(3*(100+ENTRY_OVERHEAD), 1)
+	for i := uint64(0); i < 3; i++ {
+		cache.Insert(Key{Table: 1, Offset: i * 100}, make([]byte, 100))
+	}
+	if _, ok := cache.Get(Key{Table: 1, Offset: 0}); !ok {
+		t.Fatalf("inserted block is missing")
+	}
+
+	// block at 100 is the least recently used one now
+	cache.Insert(Key{Table: 2, Offset: 0}, make([]byte, 100))
+	if _, ok := cache.Get(Key{Table: 1, Offset: 100}); ok {
+		t.Fatalf("least recently used block wasn't evicted")
+	}
+	if _, ok := cache.Get(Key{Table: 1, Offset: 0}); !ok {
+		t.Fatalf("recently used block was evicted")
+	}
+
+	cache.EvictTable(1)
+	if _, ok := cache.Get(Key{Table: 1, Offset: 200}); ok {
+		t.Fatalf("block of an evicted table is still cached")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Inserts != 4 || stats.Evictions != 1 || stats.Size != 100+ENTRY_OVERHEAD {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+}
+
+func TestShards(t *testing.T) {
+	cache := New(16*(100+ENTRY_OVERHEAD)*4, 16)
+	for i := uint64(0); i < 1000; i++ {
+		cache.Insert(Key{Table: i % 7, Offset: i * 4096}, make([]byte, 100))
+	}
+	stats := cache.Stats()
+	if stats.Size > stats.Capacity {
+		t.Fatalf("cache holds %d bytes over its capacity of %d", stats.Size, stats.Capacity)
+	}
+	if stats.Inserts != 1000 || stats.Evictions == 0 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+
+	// blocks bigger than a shard aren't kept
+	cache.Insert(Key{Table: 9, Offset: 0}, make([]byte, 1000))
+	if _, ok := cache.Get(Key{Table: 9, Offset: 0}); ok {
+		t.Fatalf("block bigger than its shard was cached")
+	}
+}
@@ -1,17 +1,39 @@
 package bloomfilter
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
 	"nosql-engine/packages/utils/hash"
 	"os"
+	"time"
+)
+
+const (
+	VERSION_1 = 1 // a byte per bit and k MD5 hashes with their own seeds, still read and written for old filters
+	VERSION_2 = 2 // bits packed into words, the k probes come from one 64-bit hash
+	VERSION_3 = 3 // VERSION_2 with all probes of a key in one block of BLOCK_BITS, a lookup touches one cache line
+	VERSION_4 = 4 // VERSION_2 with a probe step that can't be a multiple of m
+
+	BLOCK_BITS = 512
+	MAX_K      = 30
+
+	// VERSION_1 starts with m, newer versions start with this instead of it followed by the version
+	FORMAT_MARKER = 0xFFFFFFFF
 )
 
 type BloomFilter struct {
-	m             uint // bitarray size
-	k             uint // number of hash functions
-	bits          []byte
+	version uint32
+	m       uint // bitarray size
+	k       uint // number of hash functions
+
+	bits          []byte // VERSION_1
 	hashFunctions []hash.HashWithSeed
+
+	words []uint64 // VERSION_2 and newer, bit i is bit i%64 of word i/64
+	seed  uint64
 }
 
 func New(expectedElements int, falsePositiveRate float64) *BloomFilter {
@@ -19,35 +41,125 @@ func New(expectedElements int, falsePositiveRate float64) *BloomFilter {
 	tempK := CalculateK(expectedElements, tempM)
 
 	return &BloomFilter{
-		m:             tempM,
-		k:             tempK,
-		bits:          make([]byte, tempM),
-		hashFunctions: hash.CreateHashFunctions(tempK),
+		version: VERSION_4,
+		m:       tempM,
+		k:       tempK,
+		words:   make([]uint64, (tempM+63)/64),
+		seed:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// blocked filter with about bitsPerKey bits for every element
+func NewBlocked(expectedElements int, bitsPerKey float64) *BloomFilter {
+	if expectedElements < 1 {
+		expectedElements = 1
+	}
+	blocks := uint(math.Ceil(float64(expectedElements) * bitsPerKey / BLOCK_BITS))
+	if blocks < 1 {
+		blocks = 1
+	}
+	k := uint(math.Round(bitsPerKey * math.Ln2))
+	if k < 1 {
+		k = 1
 	}
+	if k > MAX_K {
+		k = MAX_K
+	}
+
+	return &BloomFilter{
+		version: VERSION_3,
+		m:       blocks * BLOCK_BITS,
+		k:       k,
+		words:   make([]uint64, blocks*BLOCK_BITS/64),
+		seed:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// the upper half of the hash picks the block, the lower half is split into the start and the step of the probes in it
+func (bf *BloomFilter) blockProbes(key string, fn func(index uint64) bool) bool {
+	h := hash.Hash64([]byte(key), bf.seed)
+	block := (h >> 32) % uint64(bf.m/BLOCK_BITS) * BLOCK_BITS
+	x := uint32(h)
+	step := (x>>17 | x<<15) | 1
+	for i := uint(0); i < bf.k; i++ {
+		if !fn(block + uint64(x%BLOCK_BITS)) {
+			return false
+		}
+		x += step
+	}
+	return true
+}
+
+// Kirsch-Mitzenmacher: probe i is h1 + i*h2, both halves of one hash. As good as k independent hashes
+// as long as h2 isn't a multiple of m, all probes would hit one bit then. VERSION_2 filters were written
+// without that guard, they are still read the way they were written
+func (bf *BloomFilter) probes(key string, fn func(index uint64) bool) bool {
+	return bf.hashProbes(hash.Hash64([]byte(key), bf.seed), fn)
+}
+
+func (bf *BloomFilter) hashProbes(h uint64, fn func(index uint64) bool) bool {
+	m := uint64(bf.m)
+	h1, h2 := h&0xFFFFFFFF, h>>32
+	if bf.version != VERSION_2 {
+		// odd steps are never a multiple of an even m, an odd m can still divide one
+		h2 = (h2 | 1) % m
+		if h2 == 0 {
+			h2 = 1
+		}
+	}
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return false
+		}
+	}
+	return true
 }
 
 func (bf *BloomFilter) Add(key string) {
-	for _, hashFunction := range bf.hashFunctions {
-		index := hashFunction.Hash([]byte(key)) % uint64(bf.m)
+	if bf.version == VERSION_1 {
+		for _, hashFunction := range bf.hashFunctions {
+			index := hashFunction.Hash([]byte(key)) % uint64(bf.m)
 
-		bf.bits[index] = 1
+			bf.bits[index] = 1
+		}
+		return
+	}
+
+	set := func(index uint64) bool {
+		bf.words[index/64] |= 1 << (index % 64)
+		return true
 	}
+	if bf.version == VERSION_3 {
+		bf.blockProbes(key, set)
+		return
+	}
+	bf.probes(key, set)
 }
 
 func (bf *BloomFilter) Find(key string) bool {
-	for _, hashFunction := range bf.hashFunctions {
-		index := hashFunction.Hash([]byte(key)) % uint64(bf.m)
+	if bf.version == VERSION_1 {
+		for _, hashFunction := range bf.hashFunctions {
+			index := hashFunction.Hash([]byte(key)) % uint64(bf.m)
 
-		bit := bf.bits[index]
-		if bit == 0 {
-			return false
+			bit := bf.bits[index]
+			if bit == 0 {
+				return false
+			}
 		}
+		return true
 	}
 
-	return true
+	isSet := func(index uint64) bool {
+		return bf.words[index/64]&(1<<(index%64)) != 0
+	}
+	if bf.version == VERSION_3 {
+		return bf.blockProbes(key, isSet)
+	}
+	return bf.probes(key, isSet)
 }
 
-// File structure will be 4 bytes for m and k respectively, m bytes for bits and k slices of 32 bytes for seeds
+// File structure of VERSION_1 is 4 bytes for m and k respectively, m bytes for bits and k slices of 32 bytes for seeds.
+// Newer versions are FORMAT_MARKER, the version, 8 bytes for m, 4 for k, 8 for the seed and the words, 8 bytes each
 func (bf *BloomFilter) MakeFile(path string, filename string, mode string) uint64 {
 	_, err := os.ReadDir(path)
 	if os.IsNotExist(err) {
@@ -61,106 +173,107 @@ func (bf *BloomFilter) MakeFile(path string, filename string, mode string) uint6
 		file, err = os.Create(path + filename)
 	} else {
 		file, err = os.OpenFile(path+filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		start, _ = file.Seek(0, os.SEEK_END)
+		start, _ = file.Seek(0, io.SeekEnd)
 	}
 	if err != nil {
 		panic(err)
 	}
-	buff := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buff, uint32(bf.m))
-	file.Write(buff)
-
-	binary.LittleEndian.PutUint32(buff, uint32(bf.k))
-	file.Write(buff)
-
-	binary.Write(file, binary.LittleEndian, bf.bits)
-
-	for _, fn := range bf.hashFunctions {
-		buff = fn.Seed
-		binary.Write(file, binary.LittleEndian, buff)
-	}
 
+	file.Write(bf.encode(binary.LittleEndian))
 	file.Close()
 	return uint64(start)
 }
 
-func NewFromFile(name string, fileOffset uint64) *BloomFilter {
-	file, err := os.Open(name)
-	if err != nil {
-		panic(err)
-	}
-	file.Seek(int64(fileOffset), io.SeekStart)
-	buff := make([]byte, 4)
-	binary.Read(file, binary.LittleEndian, buff)
-	m := binary.LittleEndian.Uint32(buff)
-
-	binary.Read(file, binary.LittleEndian, buff)
-	k := binary.LittleEndian.Uint32(buff)
-
-	bits := make([]byte, m)
-	binary.Read(file, binary.LittleEndian, bits)
-
-	hashFunctions := make([]hash.HashWithSeed, k)
-	buff = make([]byte, 32)
+func (bf *BloomFilter) encode(order binary.AppendByteOrder) []byte {
+	ret := make([]byte, 0)
 
-	for i := 0; i < int(k); i++ {
-		binary.Read(file, binary.LittleEndian, buff)
-		hashFunctions[i].Seed = buff
+	if bf.version == VERSION_1 {
+		ret = order.AppendUint32(ret, uint32(bf.m))
+		ret = order.AppendUint32(ret, uint32(bf.k))
+		ret = append(ret, bf.bits...)
+		for _, hashFn := range bf.hashFunctions {
+			ret = append(ret, hashFn.Seed...)
+		}
+		return ret
 	}
 
-	file.Close()
-
-	return &BloomFilter{
-		m:             uint(m),
-		k:             uint(k),
-		bits:          bits,
-		hashFunctions: hashFunctions,
+	ret = order.AppendUint32(ret, FORMAT_MARKER)
+	ret = order.AppendUint32(ret, bf.version)
+	ret = order.AppendUint64(ret, uint64(bf.m))
+	ret = order.AppendUint32(ret, uint32(bf.k))
+	ret = order.AppendUint64(ret, bf.seed)
+	for _, word := range bf.words {
+		ret = order.AppendUint64(ret, word)
 	}
+	return ret
 }
 
-func (bf *BloomFilter) Serialize() []byte {
-	ret := make([]byte, 0)
+func decode(reader io.Reader, order binary.ByteOrder) *BloomFilter {
+	read := func(size int) []byte {
+		buff := make([]byte, size)
+		if _, err := io.ReadFull(reader, buff); err != nil {
+			panic(err)
+		}
+		return buff
+	}
 
-	// put m
-	ret = binary.BigEndian.AppendUint32(ret, uint32(bf.m))
-	// put k
-	ret = binary.BigEndian.AppendUint32(ret, uint32(bf.k))
-	// put bits
-	ret = append(ret, bf.bits...)
-	// put hashFunctions
-	for _, hashFn := range bf.hashFunctions {
-		ret = append(ret, hashFn.Seed...)
+	first := order.Uint32(read(4))
+	if first != FORMAT_MARKER {
+		m := first
+		k := order.Uint32(read(4))
+		bits := read(int(m))
+		hashFunctions := make([]hash.HashWithSeed, k)
+		for i := range hashFunctions {
+			hashFunctions[i].Seed = read(32)
+		}
+		return &BloomFilter{version: VERSION_1, m: uint(m), k: uint(k), bits: bits, hashFunctions: hashFunctions}
 	}
 
-	return ret
+	bf := &BloomFilter{version: order.Uint32(read(4))}
+	bf.m = uint(order.Uint64(read(8)))
+	bf.k = uint(order.Uint32(read(4)))
+	bf.seed = order.Uint64(read(8))
+	bf.words = make([]uint64, (bf.m+63)/64)
+	for i := range bf.words {
+		bf.words[i] = order.Uint64(read(8))
+	}
+	return bf
 }
 
-func Deserialize(byteArr []byte) *BloomFilter {
-	//get m
-	m := binary.BigEndian.Uint32(byteArr[0:4])
-	// get k
-	k := binary.BigEndian.Uint32(byteArr[4:8])
+// reads a filter of any version
+func NewFromFile(name string, fileOffset uint64) *BloomFilter {
+	file, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
 
-	byteArr = byteArr[8:]
+	file.Seek(int64(fileOffset), io.SeekStart)
+	return decode(bufio.NewReader(file), binary.LittleEndian)
+}
 
-	// get bits
-	bits := make([]byte, m)
-	copy(bits, byteArr[0:m])
+func (bf *BloomFilter) Serialize() []byte {
+	return bf.encode(binary.BigEndian)
+}
 
-	byteArr = byteArr[m:]
+// reads a serialized filter of any version
+func Deserialize(byteArr []byte) *BloomFilter {
+	return decode(bytes.NewReader(byteArr), binary.BigEndian)
+}
 
-	// get hashFunctions (seeds)
-	hashFunctions := make([]hash.HashWithSeed, k)
-	for i := uint32(0); i < k; i++ {
-		seed := byteArr[0:32]
-		hashFunctions[i].Seed = seed
-		byteArr = byteArr[32:]
+// bytes the filter takes on disk
+func (bf *BloomFilter) Size() uint64 {
+	if bf.version == VERSION_1 {
+		return 8 + uint64(bf.m) + 32*uint64(bf.k)
 	}
+	return 4 + 4 + 8 + 4 + 8 + 8*uint64(len(bf.words))
+}
 
-	return &BloomFilter{
-		m:             uint(m),
-		k:             uint(k),
-		bits:          bits,
-		hashFunctions: hashFunctions,
-	}
+// false positive rate expected once the filter holds that many elements. Blocked filters do a bit worse
+func (bf *BloomFilter) FalsePositiveRate(elements int) float64 {
+	return CalculateFalsePositiveRate(elements, bf.m, bf.k)
+}
+
+func (bf *BloomFilter) Version() uint32 {
+	return bf.version
 }
@@ -2,7 +2,9 @@ package bloomfilter
 
 import (
 	"math/rand"
+	"nosql-engine/packages/utils/hash"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -57,3 +59,116 @@ func TestBloomFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestFormatVersions(t *testing.T) {
+	elementsCnt := 1000
+	packed := New(elementsCnt, 0.01)
+	m := CalculateM(elementsCnt, 0.01)
+	k := CalculateK(elementsCnt, m)
+	legacy := &BloomFilter{version: VERSION_1, m: m, k: k, bits: make([]byte, m), hashFunctions: hash.CreateHashFunctions(k)}
+
+	for i := 0; i < elementsCnt; i++ {
+		packed.Add("key" + strconv.Itoa(i))
+		legacy.Add("key" + strconv.Itoa(i))
+	}
+	if packed.Size()*7 > legacy.Size() {
+		t.Fatalf("packed filter takes %d bytes, the byte per bit one %d", packed.Size(), legacy.Size())
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10*elementsCnt; i++ {
+		if packed.Find("missing" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(10*elementsCnt); rate > 0.02 {
+		t.Fatalf("false positive rate %.4f is over the target", rate)
+	}
+
+	// filters of both versions are read back from files and from serializations
+	path := "../../data/filterVersions/"
+	defer os.RemoveAll(path)
+	for _, filter := range []*BloomFilter{packed, legacy} {
+		filter.MakeFile(path, "filter.bin", "many")
+		for _, read := range []*BloomFilter{NewFromFile(path+"filter.bin", 0), Deserialize(filter.Serialize())} {
+			if read.Version() != filter.Version() || read.Size() != uint64(len(filter.Serialize())) {
+				t.Fatalf("filter of version %d came back as version %d", filter.Version(), read.Version())
+			}
+			for i := 0; i < elementsCnt; i++ {
+				if !read.Find("key" + strconv.Itoa(i)) {
+					t.Fatalf("version %d filter failed for key %d after reading it back", filter.Version(), i)
+				}
+			}
+		}
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	elementsCnt := 10000
+	bloomFilter := NewBlocked(elementsCnt, 10)
+	for i := 0; i < elementsCnt; i++ {
+		bloomFilter.Add("key" + strconv.Itoa(i))
+	}
+	for i := 0; i < elementsCnt; i++ {
+		if !bloomFilter.Find("key" + strconv.Itoa(i)) {
+			t.Fatalf("blocked filter failed for key %d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < elementsCnt; i++ {
+		if bloomFilter.Find("missing" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / float64(elementsCnt); rate > 0.03 {
+		t.Fatalf("false positive rate %.4f is too high for 10 bits per key", rate)
+	}
+
+	// all probes of a key hit one block
+	first := uint64(0)
+	bloomFilter.blockProbes("key", func(index uint64) bool {
+		if first == 0 {
+			first = index/BLOCK_BITS + 1
+		}
+		if index/BLOCK_BITS+1 != first {
+			t.Fatalf("probes of a key went to blocks %d and %d", first-1, index/BLOCK_BITS)
+		}
+		return true
+	})
+
+	read := Deserialize(bloomFilter.Serialize())
+	if read.Version() != VERSION_3 || !read.Find("key1") {
+		t.Fatalf("blocked filter didn't survive serialization")
+	}
+}
+
+func TestProbeStep(t *testing.T) {
+	for _, m := range []uint{1000, 999} {
+		bf := &BloomFilter{version: VERSION_4, m: m, k: 7, words: make([]uint64, (m+63)/64)}
+		// a hash with its upper half 0, and one with it equal to m
+		for _, h := range []uint64{0x12345678, uint64(m)<<32 | 0x12345678} {
+			indexes := make(map[uint64]bool)
+			bf.hashProbes(h, func(index uint64) bool {
+				indexes[index] = true
+				return true
+			})
+			if len(indexes) != int(bf.k) {
+				t.Fatalf("%d probes of hash %x in %d bits hit %d bits", bf.k, h, m, len(indexes))
+			}
+		}
+	}
+
+	// filters written before the guard are read the way they were written
+	bf := New(1000, 0.01)
+	bf.version = VERSION_2
+	for i := 0; i < 1000; i++ {
+		bf.Add("key" + strconv.Itoa(i))
+	}
+	read := Deserialize(bf.Serialize())
+	for i := 0; i < 1000; i++ {
+		if read.Version() != VERSION_2 || !read.Find("key"+strconv.Itoa(i)) {
+			t.Fatalf("version 2 filter failed for key %d after reading it back", i)
+		}
+	}
+}
@@ -9,3 +9,7 @@ func CalculateM(expectedElements int, falsePositiveRate float64) uint {
 func CalculateK(expectedElements int, m uint) uint {
 	return uint(math.Ceil((float64(m) / float64(expectedElements)) * math.Log(2)))
 }
+
+func CalculateFalsePositiveRate(expectedElements int, m uint, k uint) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(expectedElements)/float64(m)), float64(k))
+}
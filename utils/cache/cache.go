@@ -5,68 +5,274 @@ import (
 	"fmt"
 	database_elem "nosql-engine/packages/utils/database-elem"
 	generic_types "nosql-engine/packages/utils/generic-types"
+	"sync"
 )
 
-type Cache struct {
+const (
+	LRU_POLICY      = "lru"
+	TINY_LFU_POLICY = "w-tinylfu"
+
+	ENTRY_OVERHEAD = 64 // bytes a record costs besides its key and value
+)
+
+// Cache keeps recently read records in memory, the policy decides which ones.
+// A cached tombstone means the key is deleted or known to be absent
+type Cache interface {
+	Contains(key string) bool
+	// the cached record of the key, it counts as used
+	Get(key string) (database_elem.DatabaseElem, bool)
+	// the cached record becomes a tombstone, returns false if the key isn't cached
+	Delete(key string) bool
+	// returns the cached value if the key is there, otherwise caches the given one and returns it
+	Refer(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem
+	// replaces the cached record with a newer one, keys that aren't cached stay out
+	Update(key string, value database_elem.DatabaseElem) bool
+	// drops the key from the cache
+	Invalidate(key string) bool
+	// drops every key, returns how many of them were cached
+	InvalidateKeys(keys []string) int
+	// changes with every write and invalidation, a lookup takes it before it reads the tables
+	Epoch() uint64
+	// fills the key after a Get missed, like Refer but the access Get counted isn't counted again. If the
+	// cache changed since epoch the value isn't cached, it may be older than what a write or
+	// invalidation meanwhile put in place
+	ReferAt(key string, value database_elem.DatabaseElem, epoch uint64) database_elem.DatabaseElem
+	Display()
+}
+
+// limit on the records a cache or a part of it holds, a 0 field means no limit
+type budget struct {
+	entries int
+	bytes   uint64
+}
+
+func (b budget) fits(used budget) bool {
+	return (b.entries == 0 || used.entries <= b.entries) && (b.bytes == 0 || used.bytes <= b.bytes)
+}
+
+func (b *budget) add(key string, value database_elem.DatabaseElem) {
+	b.entries++
+	b.bytes += charge(key, value)
+}
+
+func (b *budget) remove(key string, value database_elem.DatabaseElem) {
+	b.entries--
+	b.bytes -= charge(key, value)
+}
+
+// what the record alone takes
+func single(key string, value database_elem.DatabaseElem) budget {
+	return budget{entries: 1, bytes: charge(key, value)}
+}
+
+func charge(key string, value database_elem.DatabaseElem) uint64 {
+	return uint64(len(key)+len(value.Value)) + ENTRY_OVERHEAD
+}
+
+// LRU drops the least recently used record when it is full
+type LRU struct {
 	lista   list.List
-	size    int
+	limit   budget
+	used    budget
 	hashMap map[string]*list.Element
-	last    *list.Element
+	epoch   uint64
 }
 
-func (cache *Cache) Contains(key string) bool {
+func (cache *LRU) Contains(key string) bool {
 	_, ok := cache.hashMap[key]
 	return ok
 }
 
-// if an element that is being deleted is found in cache, we have to delete it from cache
-func (cache *Cache) Delete(key string) bool {
-	if cache.Contains(key) {
-		listElem := cache.hashMap[key]
-		prevValue := listElem.Value.(generic_types.KeyVal[string, database_elem.DatabaseElem])
-		prevValue.Value.Tombstone = 1
-		listElem.Value = prevValue
+func (cache *LRU) Delete(key string) bool {
+	cache.epoch++
+	if !cache.Contains(key) {
+		return false
+	}
+	value := cache.hashMap[key].Value.(generic_types.KeyVal[string, database_elem.DatabaseElem]).Value
+	return cache.Update(key, database_elem.DatabaseElem{Tombstone: 1, Timestamp: value.Timestamp})
+}
 
+func (cache *LRU) Update(key string, value database_elem.DatabaseElem) bool {
+	cache.epoch++
+	listElem, ok := cache.hashMap[key]
+	if !ok {
+		return false
+	}
+	if !cache.limit.fits(single(key, value)) {
+		cache.remove(listElem)
 		return true
 	}
+	prevValue := listElem.Value.(generic_types.KeyVal[string, database_elem.DatabaseElem])
+	cache.used.remove(key, prevValue.Value)
+	cache.used.add(key, value)
+	listElem.Value = generic_types.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: value}
 
-	return false
+	cache.evict()
+	return true
 }
 
-func (cache *Cache) Refer(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem {
-	if !cache.Contains(key) {
-		if cache.size == cache.lista.Len() {
-			data := cache.last.Value.(generic_types.KeyVal[string, database_elem.DatabaseElem])
-			delete(cache.hashMap, data.Key)
+func (cache *LRU) Invalidate(key string) bool {
+	cache.epoch++
+	listElem, ok := cache.hashMap[key]
+	if !ok {
+		return false
+	}
+	cache.remove(listElem)
+	return true
+}
 
-			tmp_last := cache.last.Prev()
+func (cache *LRU) InvalidateKeys(keys []string) int {
+	return invalidateKeys(cache, keys)
+}
 
-			cache.lista.Remove(cache.last)
-			cache.last = tmp_last
-		}
-	} else {
-		if cache.hashMap[key] == cache.last {
-			cache.last = cache.last.Prev()
+func (cache *LRU) Epoch() uint64 {
+	return cache.epoch
+}
+
+func (cache *LRU) ReferAt(key string, value database_elem.DatabaseElem, epoch uint64) database_elem.DatabaseElem {
+	if epoch != cache.epoch {
+		return value
+	}
+	return cache.Refer(key, value)
+}
+
+func invalidateKeys(cache Cache, keys []string) int {
+	dropped := 0
+	for _, key := range keys {
+		if cache.Invalidate(key) {
+			dropped++
 		}
-		value = cache.hashMap[key].Value.(generic_types.KeyVal[string, database_elem.DatabaseElem]).Value
-		cache.lista.Remove(cache.hashMap[key])
 	}
-	cache.lista.PushFront(generic_types.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: value})
-	if cache.lista.Len() == 1 {
-		cache.last = cache.lista.Front()
+	return dropped
+}
+
+func (cache *LRU) Get(key string) (database_elem.DatabaseElem, bool) {
+	listElem, ok := cache.hashMap[key]
+	if !ok {
+		return database_elem.DatabaseElem{}, false
+	}
+	cache.lista.MoveToFront(listElem)
+	return listElem.Value.(generic_types.KeyVal[string, database_elem.DatabaseElem]).Value, true
+}
+
+func (cache *LRU) Refer(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem {
+	if cached, ok := cache.Get(key); ok {
+		return cached
+	}
+	if !cache.limit.fits(single(key, value)) {
+		return value
 	}
 
-	cache.hashMap[key] = cache.lista.Front()
+	cache.hashMap[key] = cache.lista.PushFront(generic_types.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: value})
+	cache.used.add(key, value)
+	cache.evict()
+	return value
+}
 
-	return cache.lista.Front().Value.(generic_types.KeyVal[string, database_elem.DatabaseElem]).Value
+// drops least recently used records until the cache is within its limit
+func (cache *LRU) evict() {
+	for !cache.limit.fits(cache.used) && cache.lista.Len() > 0 {
+		cache.remove(cache.lista.Back())
+	}
 }
 
-func (cache *Cache) Display() {
+func (cache *LRU) remove(listElem *list.Element) {
+	data := cache.lista.Remove(listElem).(generic_types.KeyVal[string, database_elem.DatabaseElem])
+	delete(cache.hashMap, data.Key)
+	cache.used.remove(data.Key, data.Value)
+}
+
+func (cache *LRU) Display() {
 	for i := cache.lista.Front(); i != nil; i = i.Next() {
 		fmt.Println(i.Value)
 	}
 }
 
+// holds at most size records
 func New(size int) Cache {
-	return Cache{lista: *list.New(), size: size, hashMap: make(map[string]*list.Element), last: nil}
+	return NewLRU(size, 0)
+}
+
+// holds at most size records taking at most bytes, 0 turns either limit off
+func NewLRU(size int, bytes uint64) *LRU {
+	return &LRU{limit: budget{entries: size, bytes: bytes}, hashMap: make(map[string]*list.Element)}
+}
+
+// policy is LRU_POLICY or TINY_LFU_POLICY, anything else is LRU_POLICY
+func NewWithPolicy(policy string, size int, bytes uint64) Cache {
+	if policy == TINY_LFU_POLICY {
+		return NewTinyLFU(size, bytes)
+	}
+	return NewLRU(size, bytes)
+}
+
+type locked struct {
+	lock  sync.Mutex
+	cache Cache
+}
+
+// cache that can be used from several goroutines
+func Locked(cache Cache) Cache {
+	return &locked{cache: cache}
+}
+
+func (l *locked) Contains(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Contains(key)
+}
+
+func (l *locked) Get(key string) (database_elem.DatabaseElem, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Get(key)
+}
+
+func (l *locked) Delete(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Delete(key)
+}
+
+func (l *locked) Refer(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Refer(key, value)
+}
+
+func (l *locked) Update(key string, value database_elem.DatabaseElem) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Update(key, value)
+}
+
+func (l *locked) Invalidate(key string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Invalidate(key)
+}
+
+// the keys are dropped under one lock, a lookup can't fill any of them back in between
+func (l *locked) InvalidateKeys(keys []string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.InvalidateKeys(keys)
+}
+
+func (l *locked) Epoch() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.Epoch()
+}
+
+func (l *locked) ReferAt(key string, value database_elem.DatabaseElem, epoch uint64) database_elem.DatabaseElem {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cache.ReferAt(key, value, epoch)
+}
+
+func (l *locked) Display() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.cache.Display()
 }
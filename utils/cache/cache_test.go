@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"math/rand"
 	databaseelem "nosql-engine/packages/utils/database-elem"
 	"strconv"
 	"testing"
@@ -82,3 +83,156 @@ func TestCache(t *testing.T) {
 		t.Fatalf("Cache deleting failed")
 	}
 }
+
+func TestTinyLFU(t *testing.T) {
+	cache := NewTinyLFU(100, 0)
+	elem := databaseelem.DatabaseElem{Value: []byte("value"), Timestamp: uint64(time.Now().Unix())}
+
+	// the hot keys are read many times, then a scan reads a lot of keys once
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			cache.Refer("hot"+strconv.Itoa(i), elem)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Refer("scan"+strconv.Itoa(i), elem)
+	}
+
+	// the last hot key may still be in the window when the scan starts, and there it is just LRU
+	for i := 0; i < 49; i++ {
+		if !cache.Contains("hot" + strconv.Itoa(i)) {
+			t.Fatalf("scan evicted hot key " + strconv.Itoa(i))
+		}
+	}
+	if len(cache.entries) > 100 {
+		t.Fatalf("cache holds %d records over its size", len(cache.entries))
+	}
+
+	cache.Delete("hot0")
+	if cache.Refer("hot0", elem).Tombstone != 1 {
+		t.Fatalf("TinyLFU deleting failed")
+	}
+
+	// every read counts once in the sketch, a miss that fills the key too
+	counted := NewTinyLFU(100, 0)
+	for i, read := range []func(){
+		func() { counted.Refer("key", elem) },
+		func() { counted.Refer("key", elem) },
+		func() { counted.Get("key") },
+	} {
+		read()
+		if count := counted.sketch.CountMin("key"); count != uint64(i+1) {
+			t.Fatalf("%d reads were counted %d times", i+1, count)
+		}
+	}
+}
+
+// keys are read with a Zipfian distribution mixed with scans of keys read once
+func hitRate(cache Cache, seed int64, accesses int) float64 {
+	random := rand.New(rand.NewSource(seed))
+	zipf := rand.NewZipf(random, 1.1, 1, 100000)
+	elem := databaseelem.DatabaseElem{Value: []byte("value")}
+
+	hits := 0
+	for i := 0; i < accesses; i++ {
+		key := "key" + strconv.FormatUint(zipf.Uint64(), 10)
+		if i%10 == 0 {
+			key = "scan" + strconv.Itoa(i)
+		}
+		if cache.Contains(key) {
+			hits++
+		}
+		cache.Refer(key, elem)
+	}
+	return float64(hits) / float64(accesses)
+}
+
+func TestHitRate(t *testing.T) {
+	lru := hitRate(NewWithPolicy(LRU_POLICY, 500, 0), 1, 50000)
+	tinyLFU := hitRate(NewWithPolicy(TINY_LFU_POLICY, 500, 0), 1, 50000)
+	if tinyLFU <= lru {
+		t.Fatalf("W-TinyLFU hit rate %.3f isn't better than LRU %.3f", tinyLFU, lru)
+	}
+}
+
+func BenchmarkHitRate(b *testing.B) {
+	for _, policy := range []string{LRU_POLICY, TINY_LFU_POLICY} {
+		b.Run(policy, func(b *testing.B) {
+			rate := hitRate(NewWithPolicy(policy, 1000, 0), 1, b.N)
+			b.ReportMetric(rate*100, "%hits")
+		})
+	}
+}
+
+func TestCoherence(t *testing.T) {
+	for _, policy := range []string{LRU_POLICY, TINY_LFU_POLICY} {
+		// room for about ten records of 100 bytes
+		cache := NewWithPolicy(policy, 0, 10*(100+ENTRY_OVERHEAD))
+		for i := 0; i < 100; i++ {
+			cache.Refer(fmt.Sprintf("key%02d", i), databaseelem.DatabaseElem{Value: make([]byte, 100-5)})
+		}
+		cached := 0
+		for i := 0; i < 100; i++ {
+			if cache.Contains(fmt.Sprintf("key%02d", i)) {
+				cached++
+			}
+		}
+		if cached == 0 || cached > 10 {
+			t.Fatalf("%s cache holds %d records over its bytes", policy, cached)
+		}
+
+		// writes replace cached records, keys that aren't cached stay out
+		cache.Refer("key", databaseelem.DatabaseElem{Value: []byte("old")})
+		if !cache.Update("key", databaseelem.DatabaseElem{Value: []byte("new")}) {
+			t.Fatalf("%s cache didn't update a cached key", policy)
+		}
+		if elem, ok := cache.Get("key"); !ok || string(elem.Value) != "new" {
+			t.Fatalf("%s cache returned a stale value", policy)
+		}
+		if cache.Update("missing", databaseelem.DatabaseElem{Value: []byte("new")}) || cache.Contains("missing") {
+			t.Fatalf("%s cache cached a key on update", policy)
+		}
+
+		// a negative lookup is a cached tombstone until the key is written
+		cache.Refer("absent", databaseelem.DatabaseElem{Tombstone: 1})
+		cache.Update("absent", databaseelem.DatabaseElem{Value: []byte("there")})
+		if elem, _ := cache.Get("absent"); elem.Tombstone == 1 {
+			t.Fatalf("%s cache kept a negative lookup after a write", policy)
+		}
+
+		// records bigger than the whole cache aren't kept
+		cache.Update("key", databaseelem.DatabaseElem{Value: make([]byte, 10000)})
+		if cache.Contains("key") {
+			t.Fatalf("%s cache holds a record bigger than itself", policy)
+		}
+
+		cache.Invalidate("absent")
+		if cache.Contains("absent") {
+			t.Fatalf("%s cache didn't invalidate a key", policy)
+		}
+
+		// a lookup that started before an invalidation doesn't fill the key back in
+		epoch := cache.Epoch()
+		cache.Refer("a", databaseelem.DatabaseElem{Value: []byte("a")})
+		cache.Refer("b", databaseelem.DatabaseElem{Value: []byte("b")})
+		if dropped := cache.InvalidateKeys([]string{"a", "b", "missing"}); dropped != 2 || cache.Contains("a") || cache.Contains("b") {
+			t.Fatalf("%s cache dropped %d of the invalidated keys", policy, dropped)
+		}
+		cache.ReferAt("a", databaseelem.DatabaseElem{Value: []byte("stale")}, epoch)
+		if cache.Contains("a") {
+			t.Fatalf("%s cache took a value read before an invalidation", policy)
+		}
+		cache.ReferAt("a", databaseelem.DatabaseElem{Value: []byte("a")}, cache.Epoch())
+		if !cache.Contains("a") {
+			t.Fatalf("%s cache didn't take a value read after the last invalidation", policy)
+		}
+
+		// same for a write of a key that isn't cached
+		epoch = cache.Epoch()
+		cache.Update("c", databaseelem.DatabaseElem{Value: []byte("new")})
+		cache.ReferAt("c", databaseelem.DatabaseElem{Value: []byte("old")}, epoch)
+		if cache.Contains("c") {
+			t.Fatalf("%s cache took a value read before a write", policy)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"nosql-engine/packages/utils/cms"
+	database_elem "nosql-engine/packages/utils/database-elem"
+)
+
+const (
+	WINDOW_PERCENT    = 1  // part of the capacity new records wait in before they ask to be admitted
+	PROTECTED_PERCENT = 80 // part of the main region records that were hit again are kept in
+	SAMPLE_FACTOR     = 10 // the sketch is halved after this many accesses per cached record
+	SKETCH_WIDTH      = 4  // counters per cached record in every row of the sketch
+	SKETCH_DELTA      = 0.05
+
+	EXPECTED_ENTRY_BYTES     = 256 // records a byte limit is guessed to hold are counted with this size
+	DEFAULT_EXPECTED_ENTRIES = 1024
+
+	WINDOW    = 0
+	PROBATION = 1
+	PROTECTED = 2
+)
+
+type tinyLFUEntry struct {
+	key     string
+	value   database_elem.DatabaseElem
+	segment int
+}
+
+// TinyLFU is a W-TinyLFU cache. New records go into a small LRU window. A record pushed out of
+// the window only gets into the main region if the sketch saw it more often than the record it
+// would push out, so a scan of keys that are read once can't evict the ones read all the time.
+// The main region is a segmented LRU: records hit there again move from probation to protected
+type TinyLFU struct {
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	entries   map[string]*list.Element
+
+	windowLimit    budget
+	mainLimit      budget // probation and protected together
+	protectedLimit budget
+	windowUsed     budget
+	mainUsed       budget
+	protectedUsed  budget
+
+	sketch     *cms.CountMinSketch
+	accesses   int
+	sampleSize int
+
+	epoch uint64
+}
+
+// holds at most size records taking at most bytes, 0 turns either limit off
+func NewTinyLFU(size int, bytes uint64) *TinyLFU {
+	limit := budget{entries: size, bytes: bytes}
+	window := limit.percent(WINDOW_PERCENT)
+	main := budget{entries: size - window.entries, bytes: bytes - window.bytes}.atLeastOne(limit)
+
+	// the sketch needs a counter or so per record, with only a byte limit the records are guessed
+	expected := size
+	if expected == 0 {
+		expected = int(bytes / EXPECTED_ENTRY_BYTES)
+	}
+	if expected == 0 {
+		expected = DEFAULT_EXPECTED_ENTRIES
+	}
+
+	return &TinyLFU{
+		window:         list.New(),
+		probation:      list.New(),
+		protected:      list.New(),
+		entries:        make(map[string]*list.Element),
+		windowLimit:    window,
+		mainLimit:      main,
+		protectedLimit: main.percent(PROTECTED_PERCENT),
+		sketch:         cms.New(math.E/float64(SKETCH_WIDTH*expected), SKETCH_DELTA),
+		sampleSize:     SAMPLE_FACTOR * expected,
+	}
+}
+
+// p percent of the limit, limited fields stay at least one
+func (b budget) percent(p int) budget {
+	return budget{entries: b.entries * p / 100, bytes: b.bytes * uint64(p) / 100}.atLeastOne(b)
+}
+
+// fields limited in of stay limited, 0 would mean no limit
+func (b budget) atLeastOne(of budget) budget {
+	if of.entries > 0 && b.entries < 1 {
+		b.entries = 1
+	}
+	if of.bytes > 0 && b.bytes < 1 {
+		b.bytes = 1
+	}
+	return b
+}
+
+func (b budget) plus(other budget) budget {
+	return budget{entries: b.entries + other.entries, bytes: b.bytes + other.bytes}
+}
+
+func (cache *TinyLFU) Contains(key string) bool {
+	_, ok := cache.entries[key]
+	return ok
+}
+
+func (cache *TinyLFU) Get(key string) (database_elem.DatabaseElem, bool) {
+	cache.record(key)
+	return cache.touch(key)
+}
+
+// the cached record of the key, it moves up in its segment. The access isn't counted here
+func (cache *TinyLFU) touch(key string) (database_elem.DatabaseElem, bool) {
+	element, ok := cache.entries[key]
+	if !ok {
+		return database_elem.DatabaseElem{}, false
+	}
+
+	entry := element.Value.(*tinyLFUEntry)
+	switch entry.segment {
+	case WINDOW:
+		cache.window.MoveToFront(element)
+	case PROBATION:
+		cache.probation.Remove(element)
+		entry.segment = PROTECTED
+		cache.entries[key] = cache.protected.PushFront(entry)
+		cache.protectedUsed.add(key, entry.value)
+		cache.demote()
+	case PROTECTED:
+		cache.protected.MoveToFront(element)
+	}
+	return entry.value, true
+}
+
+// one access, whether the key was cached or not
+func (cache *TinyLFU) Refer(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem {
+	cache.record(key)
+	return cache.fill(key, value)
+}
+
+// caches the value if the key isn't there, the access isn't counted here
+func (cache *TinyLFU) fill(key string, value database_elem.DatabaseElem) database_elem.DatabaseElem {
+	if cached, ok := cache.touch(key); ok {
+		return cached
+	}
+
+	cache.entries[key] = cache.window.PushFront(&tinyLFUEntry{key: key, value: value, segment: WINDOW})
+	cache.windowUsed.add(key, value)
+	for !cache.windowLimit.fits(cache.windowUsed) {
+		cache.admit(cache.window.Back())
+	}
+	return value
+}
+
+func (cache *TinyLFU) Delete(key string) bool {
+	cache.epoch++
+	element, ok := cache.entries[key]
+	if !ok {
+		return false
+	}
+	timestamp := element.Value.(*tinyLFUEntry).value.Timestamp
+	return cache.Update(key, database_elem.DatabaseElem{Tombstone: 1, Timestamp: timestamp})
+}
+
+func (cache *TinyLFU) Update(key string, value database_elem.DatabaseElem) bool {
+	cache.epoch++
+	element, ok := cache.entries[key]
+	if !ok {
+		return false
+	}
+	if !cache.mainLimit.fits(single(key, value)) {
+		cache.remove(element)
+		return true
+	}
+
+	entry := element.Value.(*tinyLFUEntry)
+	cache.used(entry.segment, func(used *budget) {
+		used.remove(key, entry.value)
+		used.add(key, value)
+	})
+	entry.value = value
+
+	// the record may have grown past what its segment holds
+	switch entry.segment {
+	case WINDOW:
+		for !cache.windowLimit.fits(cache.windowUsed) {
+			cache.admit(cache.window.Back())
+		}
+	case PROTECTED:
+		cache.demote()
+	}
+	for !cache.mainLimit.fits(cache.mainUsed) {
+		cache.remove(cache.mainVictims().Back())
+	}
+	return true
+}
+
+func (cache *TinyLFU) Invalidate(key string) bool {
+	cache.epoch++
+	element, ok := cache.entries[key]
+	if !ok {
+		return false
+	}
+	cache.remove(element)
+	return true
+}
+
+func (cache *TinyLFU) InvalidateKeys(keys []string) int {
+	return invalidateKeys(cache, keys)
+}
+
+func (cache *TinyLFU) Epoch() uint64 {
+	return cache.epoch
+}
+
+func (cache *TinyLFU) ReferAt(key string, value database_elem.DatabaseElem, epoch uint64) database_elem.DatabaseElem {
+	if epoch != cache.epoch {
+		return value
+	}
+	// the Get that missed already counted the access
+	return cache.fill(key, value)
+}
+
+// how often the sketch saw the key lately
+func (cache *TinyLFU) Frequency(key string) uint64 {
+	return cache.sketch.CountMin(key)
+}
+
+// calls fn with every budget the segment counts towards
+func (cache *TinyLFU) used(segment int, fn func(used *budget)) {
+	switch segment {
+	case WINDOW:
+		fn(&cache.windowUsed)
+	case PROBATION:
+		fn(&cache.mainUsed)
+	case PROTECTED:
+		fn(&cache.mainUsed)
+		fn(&cache.protectedUsed)
+	}
+}
+
+func (cache *TinyLFU) segment(segment int) *list.List {
+	switch segment {
+	case WINDOW:
+		return cache.window
+	case PROBATION:
+		return cache.probation
+	}
+	return cache.protected
+}
+
+func (cache *TinyLFU) remove(element *list.Element) {
+	entry := cache.segment(element.Value.(*tinyLFUEntry).segment).Remove(element).(*tinyLFUEntry)
+	delete(cache.entries, entry.key)
+	cache.used(entry.segment, func(used *budget) {
+		used.remove(entry.key, entry.value)
+	})
+}
+
+// the least recently used protected records get another chance on probation
+func (cache *TinyLFU) demote() {
+	for !cache.protectedLimit.fits(cache.protectedUsed) {
+		demoted := cache.protected.Remove(cache.protected.Back()).(*tinyLFUEntry)
+		cache.protectedUsed.remove(demoted.key, demoted.value)
+		demoted.segment = PROBATION
+		cache.entries[demoted.key] = cache.probation.PushFront(demoted)
+	}
+}
+
+// records of the main region are evicted from probation first
+func (cache *TinyLFU) mainVictims() *list.List {
+	if cache.probation.Len() == 0 {
+		return cache.protected
+	}
+	return cache.probation
+}
+
+// counts the access, all counts are halved once in a while so the sketch follows what is hot now
+func (cache *TinyLFU) record(key string) {
+	cache.sketch.Add(key)
+	cache.accesses++
+	if cache.accesses >= cache.sampleSize {
+		cache.sketch.Halve()
+		cache.accesses /= 2
+	}
+}
+
+// the record leaves the window, it goes on probation if the main region has room or if it is
+// used more often than the records that would be evicted for it
+func (cache *TinyLFU) admit(element *list.Element) {
+	candidate := cache.window.Remove(element).(*tinyLFUEntry)
+	cache.windowUsed.remove(candidate.key, candidate.value)
+
+	size := single(candidate.key, candidate.value)
+	if !cache.mainLimit.fits(size) {
+		delete(cache.entries, candidate.key)
+		return
+	}
+	for !cache.mainLimit.fits(cache.mainUsed.plus(size)) {
+		victim := cache.mainVictims().Back()
+		if cache.sketch.CountMin(candidate.key) <= cache.sketch.CountMin(victim.Value.(*tinyLFUEntry).key) {
+			delete(cache.entries, candidate.key)
+			return
+		}
+		cache.remove(victim)
+	}
+
+	candidate.segment = PROBATION
+	cache.entries[candidate.key] = cache.probation.PushFront(candidate)
+	cache.mainUsed.add(candidate.key, candidate.value)
+}
+
+func (cache *TinyLFU) Display() {
+	for _, segment := range []*list.List{cache.window, cache.probation, cache.protected} {
+		for i := segment.Front(); i != nil; i = i.Next() {
+			entry := i.Value.(*tinyLFUEntry)
+			fmt.Println(entry.key, entry.value)
+		}
+	}
+}
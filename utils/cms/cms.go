@@ -54,6 +54,15 @@ func (cms *CountMinSketch) CountMin(key string) uint64 {
 	return min
 }
 
+// halves every counter, so counts from long ago weigh less than recent ones
+func (cms *CountMinSketch) Halve() {
+	for i := range cms.valueMatrix {
+		for j := range cms.valueMatrix[i] {
+			cms.valueMatrix[i][j] /= 2
+		}
+	}
+}
+
 func (cms *CountMinSketch) Serialize() []byte {
 	ret := make([]byte, 0)
 
@@ -35,3 +35,19 @@ func TestCountMinSketch(t *testing.T) {
 	// 	t.Fatalf("CountMinSketch failed for key 'teodor' after deserialization")
 	// }
 }
+
+func TestHalve(t *testing.T) {
+	countMinSketch := New(0.1, 0.01)
+	for i := 0; i < 8; i++ {
+		countMinSketch.Add("vlada")
+	}
+	countMinSketch.Add("balsa")
+
+	countMinSketch.Halve()
+	if count := countMinSketch.CountMin("vlada"); count < 4 || count > 5 {
+		t.Fatalf("CountMinSketch halving failed for key 'vlada', count %d", count)
+	}
+	if countMinSketch.CountMin("balsa") > 1 {
+		t.Fatalf("CountMinSketch halving failed for key 'balsa'")
+	}
+}
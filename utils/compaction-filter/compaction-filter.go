@@ -0,0 +1,114 @@
+package compactionfilter
+
+import (
+	database_elem "nosql-engine/packages/utils/database-elem"
+	"strings"
+	"sync"
+)
+
+type Decision int
+
+const (
+	KEEP Decision = iota
+	DROP
+	CHANGE_VALUE
+)
+
+// Context tells a filter where the record is being written
+type Context struct {
+	Level      int  // level of the output table
+	Bottommost bool // no older table can hold the key, nothing is hidden behind what gets written
+	Flush      bool // the record comes from the memtable, not from a compaction
+}
+
+// CompactionFilter sees every live record written by flushes and compactions in its keyspace.
+// Filter returns the new value together with CHANGE_VALUE, it is ignored otherwise
+type CompactionFilter interface {
+	Filter(ctx Context, key string, value []byte) (Decision, []byte)
+}
+
+// Listener hears about keys whose records a filter dropped or changed, once the new records are
+// what reads see. Caches holding the old records throw them away
+type Listener func(keys []string)
+
+var (
+	filters     = make(map[string]CompactionFilter)
+	filtersLock sync.RWMutex
+
+	listeners     = make(map[int]Listener)
+	nextListener  int
+	listenersLock sync.Mutex
+)
+
+// filter for all keys starting with prefix, "" for all keys. Of several matching prefixes the longest one is used
+func Register(prefix string, filter CompactionFilter) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	filters[prefix] = filter
+}
+
+func Unregister(prefix string) {
+	filtersLock.Lock()
+	defer filtersLock.Unlock()
+	delete(filters, prefix)
+}
+
+func lookup(key string) CompactionFilter {
+	filtersLock.RLock()
+	defer filtersLock.RUnlock()
+
+	var found CompactionFilter
+	longest := -1
+	for prefix, filter := range filters {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			found, longest = filter, len(prefix)
+		}
+	}
+	return found
+}
+
+// runs the filter of the key on the record. A dropped record becomes a tombstone, so older versions
+// of the key stay hidden, compaction drops the tombstone itself once nothing older is left.
+// Tombstones are passed through as they are
+func Apply(ctx Context, key string, elem database_elem.DatabaseElem) (Decision, database_elem.DatabaseElem) {
+	if elem.Tombstone == 1 {
+		return KEEP, elem
+	}
+	filter := lookup(key)
+	if filter == nil {
+		return KEEP, elem
+	}
+
+	decision, value := filter.Filter(ctx, key, elem.Value)
+	switch decision {
+	case DROP:
+		return DROP, database_elem.DatabaseElem{Value: []byte(""), Tombstone: 1, Timestamp: elem.Timestamp}
+	case CHANGE_VALUE:
+		return CHANGE_VALUE, database_elem.DatabaseElem{Value: value, Tombstone: 0, Timestamp: elem.Timestamp}
+	}
+	return KEEP, elem
+}
+
+// returns the id RemoveListener takes
+func AddListener(listener Listener) int {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	nextListener++
+	listeners[nextListener] = listener
+	return nextListener
+}
+
+func RemoveListener(id int) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	delete(listeners, id)
+}
+
+// called by flushes and compactions with the keys they filtered, after their tables are installed
+func Notify(keys []string) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	for _, listener := range listeners {
+		listener(keys)
+	}
+}
@@ -0,0 +1,49 @@
+package compactionfilter
+
+import (
+	database_elem "nosql-engine/packages/utils/database-elem"
+	"strings"
+	"testing"
+)
+
+type funcFilter func(ctx Context, key string, value []byte) (Decision, []byte)
+
+func (f funcFilter) Filter(ctx Context, key string, value []byte) (Decision, []byte) {
+	return f(ctx, key, value)
+}
+
+func TestApply(t *testing.T) {
+	Register("tenant/", funcFilter(func(ctx Context, key string, value []byte) (Decision, []byte) {
+		return DROP, nil
+	}))
+	Register("tenant/live/", funcFilter(func(ctx Context, key string, value []byte) (Decision, []byte) {
+		if strings.HasPrefix(string(value), "v1:") {
+			return CHANGE_VALUE, []byte("v2:" + string(value[3:]))
+		}
+		return KEEP, nil
+	}))
+	defer Unregister("tenant/")
+	defer Unregister("tenant/live/")
+
+	elem := database_elem.DatabaseElem{Value: []byte("v1:data"), Timestamp: 7}
+
+	decision, res := Apply(Context{}, "tenant/gone/a", elem)
+	if decision != DROP || res.Tombstone != 1 || res.Timestamp != 7 {
+		t.Fatalf("dropped record didn't become a tombstone: %+v", res)
+	}
+
+	// the longest prefix wins
+	decision, res = Apply(Context{}, "tenant/live/a", elem)
+	if decision != CHANGE_VALUE || string(res.Value) != "v2:data" || res.Timestamp != 7 {
+		t.Fatalf("value wasn't rewritten: %+v", res)
+	}
+
+	if decision, _ = Apply(Context{}, "other", elem); decision != KEEP {
+		t.Fatalf("key outside of every keyspace was filtered")
+	}
+
+	elem.Tombstone = 1
+	if decision, _ = Apply(Context{}, "tenant/gone/a", elem); decision != KEEP {
+		t.Fatalf("tombstone was passed to a filter")
+	}
+}
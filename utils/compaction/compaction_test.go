@@ -1,11 +1,16 @@
 package compaction
 
 import (
+	compactionfilter "nosql-engine/packages/utils/compaction-filter"
+	config2 "nosql-engine/packages/utils/config"
 	database_elem "nosql-engine/packages/utils/database-elem"
 	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
 	SSTable "nosql-engine/packages/utils/sstable"
+	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -47,3 +52,485 @@ func TestLeveledCompaction(t *testing.T) {
 
 	LeveledCompaction(0, "data/testTables")
 }
+
+func TestSizeTieredCompactionBlock(t *testing.T) {
+	prefix := "data/blockTables/"
+
+	SSTable.CreateSStable(createElements1(0, 100), count, prefix, 0, "one")
+	SSTable.CreateSStable(createElements1(50, 150), count, prefix, 0, "block")
+	SSTable.CreateSStable(createElements1(20, 70), count, prefix, 0, "many")
+	SSTable.CreateSStable(createElements1(140, 400), count, prefix, 0, "block")
+
+	// one bucket of all four tables, merged into a "block" table
+	config := *config2.GetConfig()
+	config.SSTableFiles = "block"
+	config.BucketLow, config.BucketHigh = 0.01, 100
+	config.MinThreshold = 4
+	m := SSTable.OpenManifest(prefix)
+	sizeTieredCompaction(m, &config)
+
+	tables := m.Current().Tables
+	if len(tables) != 1 || tables[0].Level != TIERED_LEVEL {
+		t.Fatalf("the tables were not merged into one: %+v", tables)
+	}
+	if format := SSTable.TableFormat(SSTable.DataFile(prefix, tables[0])); format != "block" {
+		t.Fatalf("merged table is a %s table", format)
+	}
+
+	for i := 0; i < 400; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, _ := SSTable.Find(key, prefix, 2, "block"); !found {
+			t.Fatalf("key " + key + " lost in compaction")
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestMergeIterator(t *testing.T) {
+	prefix := "data/mergeTables"
+	newer := createElements1(0, 50)
+	newKeys := make(map[string]bool)
+	for i := range newer {
+		newer[i].Value.Value = []byte("new")
+		newKeys[newer[i].Key] = true
+	}
+	SSTable.CreateSStable(createElements1(0, 100), count, prefix, 0, "one")
+	SSTable.CreateSStable(newer, count, prefix, 0, "block")
+
+	// same timestamps, so the newer table has to win by its position
+	tables := SSTable.OpenManifest(prefix).Current().Level(0)
+	iterators := make([]*SSTable.Iterator, len(tables))
+	for i, table := range tables {
+		iterators[i] = SSTable.NewIterator(SSTable.DataFile(prefix, table))
+	}
+	merged := newMergeIterator(iterators)
+	defer merged.Close()
+
+	expected := createElements1(0, 100)
+	for i := 0; ; i++ {
+		key, value := merged.Next()
+		if value == nil {
+			if i != len(expected) {
+				t.Fatalf("merge returned %d records instead of %d", i, len(expected))
+			}
+			break
+		}
+		if key != expected[i].Key {
+			t.Fatalf("expected %s got %s", expected[i].Key, key)
+		}
+		if (string(value.Value) == "new") != newKeys[key] {
+			t.Fatalf("wrong version for " + key)
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestLeveledCompactionStreaming(t *testing.T) {
+	prefix := "data/leveledTables"
+	config := config2.GetConfig()
+
+	for i := 0; i < 5; i++ {
+		SSTable.CreateSStable(createElements1(i*40, i*40+100), count, prefix, 0, "block")
+	}
+	LeveledCompaction(0, prefix)
+
+	version := SSTable.OpenManifest(prefix).Current()
+	if len(version.Level(0)) != 0 {
+		t.Fatalf("level 0 was not compacted")
+	}
+	for _, table := range version.Tables {
+		props, err := SSTable.ReadProperties(SSTable.DataFile(prefix, table))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if props.EntryCount > config.SSTableSize {
+			t.Fatalf("table %s has %d records", table.Name, props.EntryCount)
+		}
+	}
+
+	for i := 0; i < 260; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, _ := SSTable.Find(key, prefix, 3, "block"); !found {
+			t.Fatalf("key " + key + " lost in compaction")
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestSubcompactions(t *testing.T) {
+	prefix := "data/subcompactionTables"
+	config := config2.GetConfig()
+	config.MaxSubcompactions = 4
+
+	for i := 0; i < 5; i++ {
+		SSTable.CreateSStable(createElements1(i*40, i*40+100), count, prefix, 0, "block")
+	}
+	m := SSTable.OpenManifest(prefix)
+	inputs := m.Current().Level(0)
+	if splits := splitPoints(inputs, 4); len(splits) != 3 || !sort.StringsAreSorted(splits) {
+		t.Fatalf("wrong split points %v", splits)
+	}
+
+	outputs := compactTables(m, inputs, 1, config)
+	if len(m.Current().Level(0)) != 0 || len(m.Current().Level(1)) != len(outputs) {
+		t.Fatalf("outputs weren't installed together")
+	}
+	for i := 1; i < len(outputs); i++ {
+		if outputs[i].MinKey <= outputs[i-1].MaxKey {
+			t.Fatalf("outputs %s and %s overlap", outputs[i-1].Name, outputs[i].Name)
+		}
+	}
+
+	records := 0
+	for _, table := range outputs {
+		props, _ := SSTable.ReadProperties(SSTable.DataFile(prefix, table))
+		records += int(props.EntryCount)
+	}
+	if records != 260 {
+		t.Fatalf("subcompactions wrote %d records instead of 260", records)
+	}
+	for i := 0; i < 260; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, _ := SSTable.Find(key, prefix, 2, "block"); !found {
+			t.Fatalf("key " + key + " lost in compaction")
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestTrivialMove(t *testing.T) {
+	prefix := "data/moveTables"
+	for i := 0; i < 4; i++ {
+		SSTable.CreateSStable(createElements1((i+1)*100, (i+1)*100+10), count, prefix, 0, "many")
+	}
+	m := SSTable.OpenManifest(prefix)
+	before := m.Current().Level(0)
+	infos := make(map[uint64]os.FileInfo)
+	for _, table := range before {
+		infos[table.Seq], _ = os.Stat(SSTable.DataFile(prefix, table))
+	}
+	stats := GetStats()
+
+	LeveledCompaction(0, prefix)
+
+	after := m.Current().Level(1)
+	if len(m.Current().Level(0)) != 0 || len(after) != len(before) {
+		t.Fatalf("tables weren't moved to level 1: %+v", m.Current().Tables)
+	}
+	for _, table := range after {
+		info, err := os.Stat(SSTable.DataFile(prefix, table))
+		if err != nil || !os.SameFile(info, infos[table.Seq]) {
+			t.Fatalf("%s was rewritten instead of moved", table.Name)
+		}
+	}
+	for _, table := range before {
+		if _, err := os.Stat(SSTable.DataFile(prefix, table)); !os.IsNotExist(err) {
+			t.Fatalf("old name of %s is still there", table.Name)
+		}
+	}
+
+	moved := GetStats()
+	if moved.TrivialMoves-stats.TrivialMoves != 4 || moved.BytesWritten != stats.BytesWritten || moved.BytesMoved == stats.BytesMoved {
+		t.Fatalf("moves weren't counted: %+v", moved)
+	}
+
+	for i := 0; i < 4; i++ {
+		key := "key A" + strconv.Itoa((i+1)*100+5)
+		if found, _ := SSTable.Find(key, prefix, 2, "many"); !found {
+			t.Fatalf("key " + key + " lost in the move")
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+type tenantFilter struct {
+	bottommost bool
+}
+
+func (f *tenantFilter) Filter(ctx compactionfilter.Context, key string, value []byte) (compactionfilter.Decision, []byte) {
+	f.bottommost = f.bottommost || ctx.Bottommost
+	if strings.HasPrefix(key, "key A1") {
+		return compactionfilter.DROP, nil
+	}
+	return compactionfilter.CHANGE_VALUE, append([]byte("v2 "), value...)
+}
+
+func TestCompactionFilter(t *testing.T) {
+	prefix := "data/filterTables"
+	for i := 0; i < 4; i++ {
+		SSTable.CreateSStable(createElements1(i*20, i*20+40), count, prefix, 0, "one")
+	}
+
+	filter := &tenantFilter{}
+	compactionfilter.Register("key A", filter)
+	defer compactionfilter.Unregister("key A")
+	stats := GetStats()
+
+	LeveledCompaction(0, prefix)
+
+	if !filter.bottommost {
+		t.Fatalf("compaction into the empty level 1 wasn't bottommost")
+	}
+	if GetStats().FilterDrops == stats.FilterDrops || GetStats().FilterChanges == stats.FilterChanges {
+		t.Fatalf("filter decisions weren't counted")
+	}
+	for i := 0; i < 100; i++ {
+		key := "key A" + strconv.Itoa(i)
+		found, elem := SSTable.Find(key, prefix, 2, "one")
+		if strings.HasPrefix(key, "key A1") {
+			if found {
+				t.Fatalf("dropped key %s is still there", key)
+			}
+		} else if !found || !strings.HasPrefix(string(elem.Value), "v2 ") {
+			t.Fatalf("value of %s wasn't rewritten", key)
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestLevelTargets(t *testing.T) {
+	m := manifest.Open("data/targets", nil)
+	config := &config2.Config{LsmLevels: 4, LsmLeveledComp: []uint64{4}, LevelTargetBase: 1000, LevelFanout: 10, CompactionPriority: "oldest"}
+
+	table := func(number uint64, level int, min, max string, size uint64) manifest.Table {
+		return manifest.Table{Number: number, Level: level, Name: "t" + strconv.Itoa(int(number)), MinKey: min, MaxKey: max, Size: size}
+	}
+	m.Apply(manifest.Edit{Add: []manifest.Table{
+		table(1, 0, "a", "z", 100),
+		table(2, 1, "a", "f", 600),
+		table(3, 1, "g", "p", 900),
+		table(4, 2, "a", "c", 5000),
+		table(5, 2, "h", "o", 8000),
+		table(6, 3, "a", "z", 500000),
+	}})
+	version := m.Current()
+
+	targets := levelTargets(version, config)
+	if targets[1] != 1000 || targets[2] != 10000 || targets[3] != 100000 {
+		t.Fatalf("wrong static targets %v", targets)
+	}
+	if level, score := pickLevel(version, config); level != 1 || score != 1.5 {
+		t.Fatalf("level %d with score %f was picked", level, score)
+	}
+
+	config.LevelDynamic = true
+	targets = levelTargets(version, config)
+	if targets[3] != 500000 || targets[2] != 50000 || targets[1] != 5000 {
+		t.Fatalf("wrong dynamic targets %v", targets)
+	}
+	if _, score := pickLevel(version, config); score >= 1 {
+		t.Fatalf("nothing should need compaction with dynamic targets")
+	}
+
+	if table := pickTable(m.Dir(), version, 1, config); table.Number != 2 {
+		t.Fatalf("oldest table was not picked")
+	}
+	config.CompactionPriority = "overlapping"
+	if table := pickTable(m.Dir(), version, 1, config); table.Number != 3 {
+		t.Fatalf("most overlapping table was not picked")
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestSizeTieredBuckets(t *testing.T) {
+	prefix := "data/tieredTables"
+	config := &config2.Config{SSTableFiles: "one", SummaryCount: 3, BucketLow: 0.5, BucketHigh: 1.5, MinThreshold: 3, MaxThreshold: 32}
+
+	withValue := func(elems []GTypes.KeyVal[string, database_elem.DatabaseElem], value string) []GTypes.KeyVal[string, database_elem.DatabaseElem] {
+		for i := range elems {
+			elems[i].Value.Value = []byte(value)
+		}
+		return elems
+	}
+
+	// small, big, small, small, small: the first small table is older than the big one,
+	// so only the last three may be merged or the big table would be shadowed by old data
+	SSTable.CreateSStable(withValue(createElements1(0, 20), "oldest"), count, prefix, 0, "one")
+	SSTable.CreateSStable(withValue(createElements1(0, 400), "big"), count, prefix, 0, "one")
+	SSTable.CreateSStable(withValue(createElements1(500, 520), "small"), count, prefix, 0, "one")
+	SSTable.CreateSStable(withValue(createElements1(520, 540), "small"), count, prefix, 0, "one")
+	SSTable.CreateSStable(withValue(createElements1(540, 560), "small"), count, prefix, 0, "one")
+
+	m := SSTable.OpenManifest(prefix)
+	sizeTieredCompaction(m, config)
+
+	tables := m.Current().Level(0)
+	if len(tables) != 3 {
+		t.Fatalf("expected 3 tables after compaction, got %d", len(tables))
+	}
+	if tables[0].Seq != 5 || tables[0].MinKey != "key A500" {
+		t.Fatalf("merged table is not the newest one: %+v", tables[0])
+	}
+
+	for i := 0; i < 20; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, elem := SSTable.Find(key, prefix, 1, "one"); !found || string(elem.Value) != "big" {
+			t.Fatalf("old value returned for " + key)
+		}
+	}
+	for i := 500; i < 560; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, _ := SSTable.Find(key, prefix, 1, "one"); !found {
+			t.Fatalf("key " + key + " lost in compaction")
+		}
+	}
+
+	// a bucket below the threshold is left alone
+	config.MinThreshold = 4
+	if pickBucket(m.Current().Level(0), config) != nil {
+		t.Fatalf("bucket below the threshold was picked")
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestTombstoneGC(t *testing.T) {
+	prefix := "data/gcTables"
+	config := config2.GetConfig()
+	m := SSTable.OpenManifest(prefix)
+
+	deleted := func(elems []GTypes.KeyVal[string, database_elem.DatabaseElem]) []GTypes.KeyVal[string, database_elem.DatabaseElem] {
+		for i := range elems {
+			elems[i].Value.Tombstone = 1
+		}
+		return elems
+	}
+
+	// bottom level holds key A50-A59, level 0 deletes A0-A4 (only found in level 0) and A50-A54
+	w := SSTable.NewWriter(prefix, 2, "one", count, "test")
+	for _, elem := range createElements1(50, 60) {
+		w.Add(elem.Key, elem.Value)
+	}
+	m.Apply(manifest.Edit{Add: []manifest.Table{*w.Finish()}})
+	SSTable.CreateSStable(createElements1(0, 10), count, prefix, 0, "one")
+	SSTable.CreateSStable(deleted(createElements1(0, 5)), count, prefix, 0, "block")
+	SSTable.CreateSStable(deleted(createElements1(50, 55)), count, prefix, 0, "many")
+
+	before := GetStats()
+	compactTables(m, m.Current().Level(0), 1, config)
+	after := GetStats()
+	if after.TombstonesPurged-before.TombstonesPurged != 5 || after.VersionsPurged-before.VersionsPurged != 5 {
+		t.Fatalf("wrong purge stats %+v -> %+v", before, after)
+	}
+
+	check := func() {
+		for i := 0; i < 60; i++ {
+			key := "key A" + strconv.Itoa(i)
+			found, _ := SSTable.Find(key, prefix, config.LsmLevels, "one")
+			if found != ((i >= 5 && i < 10) || i >= 55) {
+				t.Fatalf("find is wrong for " + key)
+			}
+		}
+	}
+	check()
+
+	// on the bottom level nothing older is left, so the remaining tombstones go too
+	before = GetStats()
+	inputs := m.Current().Level(1)
+	compactTables(m, append(inputs, m.Current().Level(2)...), 2, config)
+	after = GetStats()
+	if after.TombstonesPurged-before.TombstonesPurged != 5 {
+		t.Fatalf("tombstones were kept on the bottom level")
+	}
+	check()
+
+	os.RemoveAll("data/")
+}
+
+// compaction must not put tables below the levels reads search, whatever lsm_leveled_compaction_cfg holds
+func TestLevelCount(t *testing.T) {
+	prefix := "data/levelCountTables"
+	config := *config2.GetConfig()
+	config.LsmLevels = 3
+	config.LsmLeveledComp = []uint64{1, 10, 100, 1000, 10000, 100000}
+	config.LevelTargetBase = 1
+	config.LevelDynamic = false
+	m := SSTable.OpenManifest(prefix)
+
+	SSTable.CreateSStable(createElements1(0, 100), count, prefix, 0, "one")
+	SSTable.CreateSStable(createElements1(100, 200), count, prefix, 0, "one")
+	version := m.Current()
+	if targets := levelTargets(version, &config); len(targets) != 3 {
+		t.Fatalf("targets for %d levels instead of 3", len(targets))
+	}
+	if level, _ := pickLevel(version, &config); level > 1 {
+		t.Fatalf("level %d was picked, it has nowhere to go", level)
+	}
+
+	compactRangeLeveled(m, &config, "key A0", "key A99", nil)
+	for _, table := range m.Current().Tables {
+		if table.Level >= int(config.LsmLevels) {
+			t.Fatalf("%s went to level %d", table.Name, table.Level)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		key := "key A" + strconv.Itoa(i)
+		if found, _ := SSTable.Find(key, prefix, config.LsmLevels, "one"); !found {
+			t.Fatalf("%s can't be found after compaction", key)
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestCompactRange(t *testing.T) {
+	prefix := "data/rangeTables"
+	config := config2.GetConfig()
+	m := SSTable.OpenManifest(prefix)
+
+	deleted := createElements1(100, 150)
+	for i := range deleted {
+		deleted[i].Value.Tombstone = 1
+	}
+	SSTable.CreateSStable(createElements1(0, 200), count, prefix, 0, "one")
+	SSTable.CreateSStable(deleted, count, prefix, 0, "block")
+	SSTable.CreateSStable(createElements1(300, 400), count, prefix, 0, "one")
+
+	steps := make([]Progress, 0)
+	compactRangeLeveled(m, config, "key A120", "key A130", func(p Progress) {
+		steps = append(steps, p)
+	})
+
+	if len(steps) != int(config.LsmLevels)-1 || steps[0].Inputs != 3 || steps[len(steps)-1].Step != steps[0].Steps {
+		t.Fatalf("wrong progress %+v", steps)
+	}
+	version := m.Current()
+	if len(version.Level(0)) != 0 || len(version.Level(int(config.LsmLevels)-1)) == 0 {
+		t.Fatalf("range did not reach the bottom level")
+	}
+	for _, table := range version.Tables {
+		props, _ := SSTable.ReadProperties(SSTable.DataFile(prefix, table))
+		if table.MinKey <= "key A130" && table.MaxKey >= "key A120" && props.TombstoneCount != 0 {
+			t.Fatalf("tombstones left in %s", table.Name)
+		}
+	}
+	for i := 0; i < 400; i++ {
+		key := "key A" + strconv.Itoa(i)
+		found, _ := SSTable.Find(key, prefix, config.LsmLevels, "one")
+		if found != (i < 100 || (i >= 150 && i < 200) || i >= 300) {
+			t.Fatalf("find is wrong for " + key)
+		}
+	}
+	os.RemoveAll("data/")
+
+	// size-tiered merges everything in one step
+	m = SSTable.OpenManifest(prefix)
+	SSTable.CreateSStable(createElements1(0, 200), count, prefix, 0, "one")
+	SSTable.CreateSStable(deleted, count, prefix, 0, "block")
+	steps = steps[:0]
+	compactRangeTiered(m, config, "key A0", "key A99", func(p Progress) {
+		steps = append(steps, p)
+	})
+	if len(steps) != 1 || steps[0].Inputs != 2 || steps[0].Outputs != 1 || len(m.Current().Tables) != 1 {
+		t.Fatalf("wrong size-tiered range compaction %+v", steps)
+	}
+
+	os.RemoveAll("data/")
+}
@@ -1,258 +1,199 @@
 package compaction
 
 import (
-	"bufio"
-	"io"
-	"io/fs"
-	"io/ioutil"
-	"log"
 	config2 "nosql-engine/packages/utils/config"
-	database_elem "nosql-engine/packages/utils/database-elem"
-	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
 	"nosql-engine/packages/utils/sstable"
-	"os"
+	"sort"
 	"strconv"
-	"strings"
 )
 
+const (
+	DEFAULT_LEVEL_TARGET_BASE = 1 << 20
+	DEFAULT_LEVEL_FANOUT      = 10
+)
+
+// compacts the level with the highest score until no level is over its target.
+// level is where the caller knows new data arrived, every level is checked anyway
 func LeveledCompaction(level int, dirPath string) {
-	config := config2.GetConfig()
-	files, err := ioutil.ReadDir(dirPath)
-	if err != nil {
-		panic(err)
-	}
+	compactionLock.Lock()
+	defer compactionLock.Unlock()
 
-	if !NeedsCompactionLeveled(level, files) {
-		return
-	}
-	tables := levelFilter(files, strconv.Itoa(level))
-	nextTables := levelFilter(files, strconv.Itoa(level+1))
+	config := config2.GetConfig()
+	m := sstable.OpenManifest(dirPath)
 
-	if level == 0 {
-		merged := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
-		for i := 0; i < len(tables); i++ {
-			merged = mergeTwoTablesInMemory(merged, readWholeTable(dirPath+"/"+tables[i], config.SSTableFiles))
-			deleteOldFiles(dirPath, tables[i], level)
-		}
-		for i := 0; i < len(nextTables); i++ {
-			merged = mergeTwoTablesInMemory(merged, readWholeTable(dirPath+"/"+nextTables[i], config.SSTableFiles))
-			deleteOldFiles(dirPath, nextTables[i], level+1)
-		}
-		n := uint64(len(merged)) / config.SSTableSize
-		if uint64(len(merged))%config.SSTableSize > 0 {
-			n += 1
-		}
-		for i := uint64(0); i < n; i++ {
-			from := i * config.SSTableSize
-			to := (i + 1) * config.SSTableSize
-			if to > uint64(len(merged)) {
-				to = uint64(len(merged))
-				if from >= to {
-					break
-				}
-			}
-			sstable.CreateSStable(merged[from:to], int(config.SummaryCount), dirPath, level+1, config.SSTableFiles)
+	for {
+		version := m.Current()
+		level, score := pickLevel(version, config)
+		if score < 1 {
+			return
 		}
-	} else {
-		for i := 0; i < len(tables); i++ {
-			merged := readWholeTable(dirPath+"/"+tables[i], config.SSTableFiles)
-			deleteOldFiles(dirPath, tables[i], level)
-			files, err = ioutil.ReadDir(dirPath)
-			if err != nil {
-				panic(err)
-			}
-			nextTables = levelRangeFilter(dirPath, files, strconv.Itoa(level+1),
-				merged[0].Key, merged[len(merged)-1].Key, config.SSTableFiles)
 
-			for j := 0; j < len(nextTables); j++ {
-				merged = mergeTwoTablesInMemory(merged, readWholeTable(dirPath+"/"+nextTables[j], config.SSTableFiles))
-				deleteOldFiles(dirPath, nextTables[j], level+1)
-			}
-			n := uint64(len(merged)) / config.SSTableSize
-			if uint64(len(merged))%config.SSTableSize > 0 {
-				n += 1
+		if level == 0 {
+			// level 0 tables overlap, so all of them go down together with everything they cover on level 1
+			tables := version.Level(0)
+			min, max := keyRange(tables)
+			overlapping := version.Overlapping(1, min, max)
+			if len(overlapping) == 0 && !overlapEachOther(tables) {
+				moveTables(m, tables, 1)
+				continue
 			}
-			for j := uint64(0); j < n; j++ {
-				from := j * config.SSTableSize
-				to := (j + 1) * config.SSTableSize
-				if to > uint64(len(merged)) {
-					to = uint64(len(merged))
-					if from >= to {
-						break
-					}
-				}
-				sstable.CreateSStable(merged[from:to], int(config.SummaryCount), dirPath, level+1, config.SSTableFiles)
+			compactTables(m, append(tables, overlapping...), 1, config)
+		} else {
+			table := pickTable(m.Dir(), version, level, config)
+			overlapping := version.Overlapping(level+1, table.MinKey, table.MaxKey)
+			if len(overlapping) == 0 {
+				moveTables(m, []manifest.Table{table}, level+1)
+				continue
 			}
+			compactTables(m, append([]manifest.Table{table}, overlapping...), level+1, config)
 		}
 	}
-
-	if level+1 < len(config.LsmLeveledComp)-1 {
-		LeveledCompaction(level+1, dirPath)
-	}
 }
 
-func openFile(filepath string) *os.File {
-	file, err := os.OpenFile(filepath, os.O_RDONLY, 0700)
-	if err != nil {
-		panic(err)
-	}
-	return file
+// merges the inputs into new tables on the output level and swaps them in the manifest, inputs go newest first
+func compactTables(m *manifest.Manifest, inputs []manifest.Table, level int, config *config2.Config) []manifest.Table {
+	outputs := runSubcompactions(m, inputs, level, config, "leveled L"+strconv.Itoa(level-1)+"->L"+strconv.Itoa(level))
+	installEdit(m, manifest.Edit{Add: outputs}, inputs)
+	return outputs
 }
 
-func levelFilter(tables []fs.FileInfo, level string) []string {
-	var retList []string
+// trivial move, the tables go to the level as they are. They must not overlap each other or anything on it.
+// They keep their seq, so they stay in front of everything older
+func moveTables(m *manifest.Manifest, tables []manifest.Table, level int) {
+	edit := manifest.Edit{}
+	moved := uint64(0)
 	for _, table := range tables {
-		var s string = table.Name()
-		tableLvl := strings.Split(s, "-")[1]
-		if tableLvl != ("L"+level) || !strings.Contains(s, "Data.db") {
-			continue
-		}
-		retList = append(retList, table.Name())
-
+		edit.Add = append(edit.Add, sstable.MoveTable(m.Dir(), table, level, m.NewFileNumber()))
+		edit.Remove = append(edit.Remove, table.Number)
+		moved += table.Size
 	}
-	return retList
-}
+	m.Apply(edit)
+	addStats(Stats{TrivialMoves: uint64(len(tables)), BytesIn: moved, BytesMoved: moved})
 
-func levelRangeFilter(dir string, tables []fs.FileInfo, level string, min, max string, mode string) []string {
-	var retList []string
-	for _, table := range tables {
-		var s string = table.Name()
-		tableLvl := strings.Split(s, "-")[1]
-		if mode == "one" {
-			if tableLvl != ("L"+level) || !strings.Contains(s, "Data.db") {
-				continue
-			}
-		}
-		if mode == "many" {
-			if tableLvl != ("L"+level) || !strings.Contains(s, "Summary.db") {
-				continue
-			}
-		}
-		min1, max1 := sstable.GetKeyRange(dir+"/"+s, mode)
-		if min1 > max {
-			continue
-		}
-		if max1 < min {
-			continue
-		}
-		retList = append(retList, table.Name())
-	}
-	return retList
+	// readers may still be going through the old names
+	m.Retire(tables, func(table manifest.Table) {
+		sstable.RemoveTable(m.Dir(), table)
+	})
 }
 
-func getDataFileOrderNum(filename string) int {
-	orderNum, err := strconv.Atoi(strings.Split(filename, "-")[2])
-	if err != nil {
-		panic(err)
+func overlapEachOther(tables []manifest.Table) bool {
+	sorted := append([]manifest.Table{}, tables...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].MinKey < sorted[j].MinKey
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].MinKey <= sorted[i-1].MaxKey {
+			return true
+		}
 	}
-	return orderNum
-
+	return false
 }
 
-func NeedsCompactionLeveled(level int, files []fs.FileInfo) bool {
+func NeedsCompactionLeveled(level int, version *manifest.Version) bool {
 	config := config2.GetConfig()
-	maxPerLevel := config.LsmLeveledComp[level]
-	tables := levelFilter(files, strconv.Itoa(level))
-	return len(tables) > int(maxPerLevel)
+	return levelScore(level, version, config, levelTargets(version, config)) >= 1
 }
 
-func readWholeTable(path1 string, mode string) (logs []GTypes.KeyVal[string, database_elem.DatabaseElem]) {
-	var offset1 int64
-
-	table1 := openFile(path1)
-	defer table1.Close()
-
-	if mode == "many" {
-		offset1, _ = table1.Seek(0, io.SeekEnd)
-		table1.Seek(0, io.SeekStart)
-	} else {
-		offset1 = int64(sstable.ReadFileOffset(path1))
-	}
-
-	for {
-		key1, val1 := sstable.ReadRecord(table1, uint64(offset1))
-		if val1 == nil {
-			break
+// the last level has nowhere to go, so it is never picked
+func pickLevel(version *manifest.Version, config *config2.Config) (int, float64) {
+	targets := levelTargets(version, config)
+	best, bestScore := 0, 0.0
+	for level := 0; level < int(config.LsmLevels)-1; level++ {
+		if score := levelScore(level, version, config, targets); score > bestScore {
+			best, bestScore = level, score
 		}
-		logs = append(logs, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key1, Value: *val1})
 	}
-
-	return
+	return best, bestScore
 }
 
-func mergeTwoTablesInMemory(t1, t2 []GTypes.KeyVal[string, database_elem.DatabaseElem]) (logs []GTypes.KeyVal[string, database_elem.DatabaseElem]) {
-	i1 := 0
-	i2 := 0
-	k := 0
-
-	for i1 < len(t1) && i2 < len(t2) {
-		k, logs = compareLogs(t1[i1].Key, t2[i2].Key, &t1[i1].Value, &t2[i2].Value, logs)
-
-		//citamo naredne logove
-		if k == 1 {
-			i1++
-		} else if k == 2 {
-			i2++
-		} else if k == 0 {
-			i1++
-			i2++
-		}
-	}
-	for ; i1 < len(t1); i1++ {
-		logs = append(logs, t1[i1])
-	}
-	for ; i2 < len(t2); i2++ {
-		logs = append(logs, t2[i2])
+// how full the level is, 1 means it reached its target.
+// Level 0 is counted in tables since every one of them is searched on reads
+func levelScore(level int, version *manifest.Version, config *config2.Config, targets []uint64) float64 {
+	if level == 0 {
+		return float64(len(version.Level(0))) / float64(config.LsmLeveledComp[0])
 	}
-	return
+	return float64(version.LevelSize(level)) / float64(targets[level])
 }
 
-func compareLogs(key1, key2 string, val1, val2 *database_elem.DatabaseElem, logs []GTypes.KeyVal[string, database_elem.DatabaseElem]) (int, []GTypes.KeyVal[string, database_elem.DatabaseElem]) {
-
-	if key1 < key2 {
-		logs = append(logs, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key1, Value: *val1})
-		return 1, logs
+// target size in bytes of every level, level 0 has none. Reads search config.LsmLevels levels, so nothing
+// may go below them. Static targets grow by the fanout from level 1, dynamic ones shrink by it from the size of the last level
+func levelTargets(version *manifest.Version, config *config2.Config) []uint64 {
+	levels := int(config.LsmLevels)
+	targets := make([]uint64, levels)
 
-	} else if key1 > key2 {
-		logs = append(logs, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key2, Value: *val2})
-		return 2, logs
-
-	} else {
-		//ako su kljucevi jednaki,gledamo koji log je noviji
-		//ako je tombostone!=1 upisujemo ga u novu tabelu
-		if val1.Timestamp > val2.Timestamp {
+	// config files from before the byte targets existed don't set them
+	base, fanout := config.LevelTargetBase, config.LevelFanout
+	if base == 0 {
+		base = DEFAULT_LEVEL_TARGET_BASE
+	}
+	if fanout < 2 {
+		fanout = DEFAULT_LEVEL_FANOUT
+	}
 
-			logs = append(logs, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key1, Value: *val1})
-			return 0, logs
-		} else {
+	if levels < 2 {
+		return targets
+	}
+	targets[1] = base
+	for level := 2; level < levels; level++ {
+		targets[level] = targets[level-1] * fanout
+	}
 
-			logs = append(logs, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key2, Value: *val2})
-			return 0, logs
+	if config.LevelDynamic {
+		last := levels - 1
+		if size := version.LevelSize(last); size > targets[last] {
+			targets[last] = size
+		}
+		for level := last - 1; level >= 1; level-- {
+			targets[level] = targets[level+1] / fanout
+			if targets[level] < base {
+				targets[level] = base
+			}
 		}
 	}
+
+	return targets
 }
 
-func deleteOldFiles(prefix, table string, level int) {
-	orderNum := getDataFileOrderNum(table)
-	name := prefix + "/usertable-L" + strconv.Itoa(level) + "-" + strconv.Itoa(orderNum) + "-TOC.txt"
-	tocFile, err := os.Open(name)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fileScanner := bufio.NewScanner(tocFile)
-	fileScanner.Split(bufio.ScanLines)
+// the table of the level that goes down next, by config.CompactionPriority
+func pickTable(dirPath string, version *manifest.Version, level int, config *config2.Config) manifest.Table {
+	tables := version.Level(level)
+	best := tables[0]
+	bestValue := uint64(0)
+
+	for i, table := range tables {
+		var value uint64
+		switch config.CompactionPriority {
+		case "overlapping":
+			// bytes of the next level it would be merged with
+			for _, next := range version.Overlapping(level+1, table.MinKey, table.MaxKey) {
+				value += next.Size
+			}
+		case "tombstones":
+			if props, err := sstable.ReadProperties(sstable.DataFile(dirPath, table)); err == nil {
+				value = props.TombstoneCount
+			}
+		default:
+			// tables are sorted newest first, the oldest has the smallest number
+			value = ^table.Number
+		}
 
-	for fileScanner.Scan() {
-		err = os.Remove(fileScanner.Text())
-		if err != nil {
-			log.Fatal(err)
+		if i == 0 || value > bestValue {
+			best, bestValue = table, value
 		}
 	}
+	return best
+}
 
-	tocFile.Close()
-
-	err = os.Remove(name)
-	if err != nil {
-		log.Fatal(err)
+func keyRange(tables []manifest.Table) (string, string) {
+	min, max := tables[0].MinKey, tables[0].MaxKey
+	for _, table := range tables {
+		if table.MinKey < min {
+			min = table.MinKey
+		}
+		if table.MaxKey > max {
+			max = table.MaxKey
+		}
 	}
+	return min, max
 }
@@ -0,0 +1,104 @@
+package compaction
+
+import (
+	config2 "nosql-engine/packages/utils/config"
+	"nosql-engine/packages/utils/manifest"
+	"nosql-engine/packages/utils/sstable"
+)
+
+// Progress is reported after every step of a manual compaction
+type Progress struct {
+	Step    int // steps done so far
+	Steps   int // all steps, one per level for leveled compaction and a single one for size-tiered
+	Level   int // level the step wrote to
+	Inputs  int // tables merged by the step
+	Outputs int // tables written by the step
+}
+
+// compacts every table holding keys in [start, end] down to the bottom level, progress can be nil
+func CompactRange(dirPath string, start, end string, progress func(Progress)) {
+	compactionLock.Lock()
+	defer compactionLock.Unlock()
+
+	m := sstable.OpenManifest(dirPath)
+	config := config2.GetConfig()
+
+	if config.LSMType == "size-tired" {
+		compactRangeTiered(m, config, start, end, progress)
+	} else {
+		compactRangeLeveled(m, config, start, end, progress)
+	}
+}
+
+// compacts all tables down to the bottom level
+func CompactAll(dirPath string, progress func(Progress)) {
+	tables := sstable.OpenManifest(dirPath).Current().Tables
+	if len(tables) == 0 {
+		return
+	}
+	start, end := keyRange(tables)
+	CompactRange(dirPath, start, end, progress)
+}
+
+func compactRangeLeveled(m *manifest.Manifest, config *config2.Config, start, end string, progress func(Progress)) {
+	steps := int(config.LsmLevels) - 1
+	for level := 0; level < steps; level++ {
+		version := m.Current()
+
+		var inputs []manifest.Table
+		if level == 0 {
+			// level 0 tables overlap each other, leaving an older one behind could let it shadow what moved down
+			if len(version.Overlapping(0, start, end)) > 0 {
+				inputs = version.Level(0)
+			}
+		} else {
+			inputs = version.Overlapping(level, start, end)
+		}
+
+		outputs := make([]manifest.Table, 0)
+		if len(inputs) > 0 {
+			min, max := keyRange(inputs)
+			inputs = append(inputs, version.Overlapping(level+1, min, max)...)
+			outputs = compactTables(m, inputs, level+1, config)
+		}
+
+		if progress != nil {
+			progress(Progress{Step: level + 1, Steps: steps, Level: level + 1, Inputs: len(inputs), Outputs: len(outputs)})
+		}
+	}
+}
+
+// tables are merged from the oldest to the newest one overlapping the range, so the merged run stays contiguous by age
+func compactRangeTiered(m *manifest.Manifest, config *config2.Config, start, end string, progress func(Progress)) {
+	tables := m.Current().Level(TIERED_LEVEL)
+
+	first, last := -1, -1
+	for i, table := range tables {
+		if table.MinKey <= end && table.MaxKey >= start {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+
+	inputs := make([]manifest.Table, 0)
+	outputs := 0
+	if first != -1 {
+		inputs = tables[first : last+1]
+
+		writer := sstable.NewWriter(m.Dir(), TIERED_LEVEL, config.SSTableFiles, int(config.SummaryCount), TIERED_COMPACTION_NAME)
+		mergeTables(m, inputs, TIERED_LEVEL, writer.Add)
+
+		edit := manifest.Edit{}
+		if output := writer.Finish(); output != nil {
+			edit.Add = append(edit.Add, *output)
+			outputs++
+		}
+		installEdit(m, edit, inputs)
+	}
+
+	if progress != nil {
+		progress(Progress{Step: 1, Steps: 1, Level: TIERED_LEVEL, Inputs: len(inputs), Outputs: outputs})
+	}
+}
@@ -0,0 +1,186 @@
+package compaction
+
+import (
+	"container/heap"
+	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	config2 "nosql-engine/packages/utils/config"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	"nosql-engine/packages/utils/manifest"
+	"nosql-engine/packages/utils/sstable"
+)
+
+// one record waiting in the heap, source is the index of the iterator it came from
+type heapItem struct {
+	key    string
+	value  database_elem.DatabaseElem
+	source int
+}
+
+// smallest key on top, for equal keys the newest version first.
+// Versions with the same timestamp are ordered by source, sources are given newest table first
+type recordHeap []heapItem
+
+func (h recordHeap) Len() int { return len(h) }
+
+func (h recordHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key < h[j].key
+	}
+	if h[i].value.Timestamp != h[j].value.Timestamp {
+		return h[i].value.Timestamp > h[j].value.Timestamp
+	}
+	return h[i].source < h[j].source
+}
+
+func (h recordHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *recordHeap) Push(x any) { *h = append(*h, x.(heapItem)) }
+
+func (h *recordHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergeIterator goes through several tables at once in key order, keeping only the newest version of every key.
+// It holds a single record per table in memory, however big the tables are.
+type mergeIterator struct {
+	sources  []*sstable.Iterator
+	heap     recordHeap
+	shadowed uint64 // older versions skipped so far
+}
+
+// iterators have to be ordered newest table first
+func newMergeIterator(iterators []*sstable.Iterator) *mergeIterator {
+	it := &mergeIterator{sources: iterators, heap: make(recordHeap, 0, len(iterators))}
+	for i := range iterators {
+		it.advance(i)
+	}
+	heap.Init(&it.heap)
+	return it
+}
+
+func (it *mergeIterator) advance(source int) {
+	key, value := it.sources[source].Next()
+	if value != nil {
+		heap.Push(&it.heap, heapItem{key: key, value: *value, source: source})
+	}
+}
+
+// returns "" and nil once all tables are exhausted
+func (it *mergeIterator) Next() (string, *database_elem.DatabaseElem) {
+	if it.heap.Len() == 0 {
+		return "", nil
+	}
+
+	top := heap.Pop(&it.heap).(heapItem)
+	it.advance(top.source)
+
+	// older versions of the same key are dropped
+	for it.heap.Len() > 0 && it.heap[0].key == top.key {
+		old := heap.Pop(&it.heap).(heapItem)
+		it.advance(old.source)
+		it.shadowed++
+	}
+
+	return top.key, &top.value
+}
+
+func (it *mergeIterator) Close() {
+	for _, source := range it.sources {
+		source.Close()
+	}
+}
+
+// tombstoneGC tells if a tombstone may be dropped, which is once no table holding older data than
+// the compaction output can contain the deleted key. Filters are loaded the first time they are needed
+type tombstoneGC struct {
+	dir     string
+	tables  []manifest.Table
+	filters map[uint64]*bloomfilter.BloomFilter
+}
+
+// older tables are those on deeper levels and those on the output level with older data than the inputs.
+// On the bottom level there are none, so every tombstone goes
+func newTombstoneGC(m *manifest.Manifest, inputs []manifest.Table, level int) *tombstoneGC {
+	inInputs := make(map[uint64]bool)
+	seq := uint64(0)
+	for _, table := range inputs {
+		inInputs[table.Number] = true
+		if table.Seq > seq {
+			seq = table.Seq
+		}
+	}
+
+	gc := &tombstoneGC{dir: m.Dir(), tables: make([]manifest.Table, 0), filters: make(map[uint64]*bloomfilter.BloomFilter)}
+	for _, table := range m.Current().Tables {
+		if inInputs[table.Number] || table.Level < level || (table.Level == level && table.Seq > seq) {
+			continue
+		}
+		gc.tables = append(gc.tables, table)
+	}
+	return gc
+}
+
+func (gc *tombstoneGC) canDrop(key string) bool {
+	for _, table := range gc.tables {
+		if key < table.MinKey || key > table.MaxKey {
+			continue
+		}
+		filter, ok := gc.filters[table.Number]
+		if !ok {
+			filter = sstable.TableFilter(sstable.DataFile(gc.dir, table))
+			gc.filters[table.Number] = filter
+		}
+		if filter.Find(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// tableOutput writes records into tables of one level, starting a new table whenever the current
+// one reaches config.SSTableTargetSize bytes, or config.SSTableSize records if there is no byte target
+type tableOutput struct {
+	dirPath    string
+	level      int
+	config     *config2.Config
+	compaction string
+	writer     *sstable.Writer
+	tables     []manifest.Table
+}
+
+func newTableOutput(dirPath string, level int, config *config2.Config, compaction string) *tableOutput {
+	return &tableOutput{dirPath: dirPath, level: level, config: config, compaction: compaction, tables: make([]manifest.Table, 0)}
+}
+
+func (o *tableOutput) add(key string, value database_elem.DatabaseElem) {
+	if o.writer == nil {
+		o.writer = sstable.NewWriter(o.dirPath, o.level, o.config.SSTableFiles, int(o.config.SummaryCount), o.compaction)
+	}
+	o.writer.Add(key, value)
+	if o.config.SSTableTargetSize > 0 {
+		if o.writer.RawSize() >= o.config.SSTableTargetSize {
+			o.finishTable()
+		}
+	} else if uint64(o.writer.Count()) >= o.config.SSTableSize {
+		o.finishTable()
+	}
+}
+
+func (o *tableOutput) finishTable() {
+	if o.writer == nil {
+		return
+	}
+	if table := o.writer.Finish(); table != nil {
+		o.tables = append(o.tables, *table)
+	}
+	o.writer = nil
+}
+
+// manifest entries of all written tables
+func (o *tableOutput) finish() []manifest.Table {
+	o.finishTable()
+	return o.tables
+}
@@ -0,0 +1,62 @@
+package compaction
+
+import (
+	config2 "nosql-engine/packages/utils/config"
+	"nosql-engine/packages/utils/manifest"
+)
+
+// estimate of the bytes compaction still has to rewrite in the version before nothing is over its limit anymore
+func PendingBytes(version *manifest.Version, config *config2.Config) uint64 {
+	if config.LSMType == "size-tired" {
+		return pendingTiered(version, config)
+	}
+	return pendingLeveled(version, config)
+}
+
+// what goes down from every level over its target, together with the part of the next level it overlaps.
+// The bytes that go down are counted against the next level too, since they can push it over its own target
+func pendingLeveled(version *manifest.Version, config *config2.Config) uint64 {
+	levels := int(config.LsmLevels)
+	if levels < 2 {
+		return 0
+	}
+	targets := levelTargets(version, config)
+	sizes := make([]uint64, levels)
+	for level := range sizes {
+		sizes[level] = version.LevelSize(level)
+	}
+
+	pending := uint64(0)
+	if levelScore(0, version, config, targets) >= 1 {
+		pending += sizes[0] + sizes[1]
+		sizes[1] += sizes[0]
+	}
+	for level := 1; level < levels-1; level++ {
+		if sizes[level] <= targets[level] {
+			continue
+		}
+		excess := sizes[level] - targets[level]
+		pending += excess + uint64(float64(excess)*float64(sizes[level+1])/float64(sizes[level]))
+		sizes[level+1] += excess
+	}
+	return pending
+}
+
+// every bucket that has enough tables to be merged
+func pendingTiered(version *manifest.Version, config *config2.Config) uint64 {
+	min := int(config.MinThreshold)
+	if min < 2 {
+		min = DEFAULT_MIN_THRESHOLD
+	}
+
+	pending := uint64(0)
+	for _, bucket := range buckets(version.Level(TIERED_LEVEL), config) {
+		if len(bucket) < min {
+			continue
+		}
+		for _, table := range bucket {
+			pending += table.Size
+		}
+	}
+	return pending
+}
@@ -0,0 +1,57 @@
+package compaction
+
+import "sync"
+
+// Stats are counted over all compactions since the program started
+type Stats struct {
+	Compactions      uint64
+	TablesRead       uint64
+	TablesWritten    uint64
+	TombstonesPurged uint64 // deletes dropped because no older table can hold the deleted key
+	VersionsPurged   uint64 // older versions of keys that were overwritten
+	BytesIn          uint64 // bytes that came down from the upper level of a compaction, moved tables included
+	BytesRead        uint64
+	BytesWritten     uint64
+	TrivialMoves     uint64 // tables moved to the next level without being rewritten
+	BytesMoved       uint64
+	FilterDrops      uint64 // records compaction filters dropped
+	FilterChanges    uint64 // values compaction filters rewrote
+}
+
+// bytes compactions wrote for every byte that came down a level.
+// Moved tables came down without being written, so every move brings it lower
+func (s Stats) WriteAmplification() float64 {
+	if s.BytesIn == 0 {
+		return 0
+	}
+	return float64(s.BytesWritten) / float64(s.BytesIn)
+}
+
+var (
+	stats     Stats
+	statsLock sync.Mutex
+)
+
+func GetStats() Stats {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	return stats
+}
+
+func addStats(s Stats) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	stats.Compactions += s.Compactions
+	stats.TablesRead += s.TablesRead
+	stats.TablesWritten += s.TablesWritten
+	stats.TombstonesPurged += s.TombstonesPurged
+	stats.VersionsPurged += s.VersionsPurged
+	stats.BytesIn += s.BytesIn
+	stats.BytesRead += s.BytesRead
+	stats.BytesWritten += s.BytesWritten
+	stats.TrivialMoves += s.TrivialMoves
+	stats.BytesMoved += s.BytesMoved
+	stats.FilterDrops += s.FilterDrops
+	stats.FilterChanges += s.FilterChanges
+}
@@ -0,0 +1,73 @@
+package compaction
+
+import (
+	config2 "nosql-engine/packages/utils/config"
+	"nosql-engine/packages/utils/manifest"
+	"sort"
+	"sync"
+)
+
+// merges the inputs in up to config.MaxSubcompactions goroutines, each one writing its own tables
+// for its own part of the key space. The outputs don't overlap, so all of them can go into one edit.
+// Inputs go newest first
+func runSubcompactions(m *manifest.Manifest, inputs []manifest.Table, level int, config *config2.Config, compaction string) []manifest.Table {
+	splits := splitPoints(inputs, int(config.MaxSubcompactions))
+
+	results := make([][]manifest.Table, len(splits)+1)
+	var wg sync.WaitGroup
+	for i := range results {
+		start, end := "", ""
+		if i > 0 {
+			start = splits[i-1]
+		}
+		if i < len(splits) {
+			end = splits[i]
+		}
+
+		wg.Add(1)
+		go func(i int, start, end string) {
+			defer wg.Done()
+			output := newTableOutput(m.Dir(), level, config, compaction)
+			mergeRange(m, inputs, level, start, end, output.add)
+			results[i] = output.finish()
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	// in key order, the way the ranges go
+	outputs := make([]manifest.Table, 0)
+	for _, tables := range results {
+		outputs = append(outputs, tables...)
+	}
+	return outputs
+}
+
+// keys splitting the inputs into at most n ranges, the boundaries of the input tables spread evenly.
+// The smallest key is never one of them, so no range is empty from the start
+func splitPoints(inputs []manifest.Table, n int) []string {
+	if n < 2 || len(inputs) == 0 {
+		return nil
+	}
+
+	min, _ := keyRange(inputs)
+	seen := make(map[string]bool)
+	boundaries := make([]string, 0)
+	for _, table := range inputs {
+		for _, key := range []string{table.MinKey, table.MaxKey} {
+			if key > min && !seen[key] {
+				seen[key] = true
+				boundaries = append(boundaries, key)
+			}
+		}
+	}
+	sort.Strings(boundaries)
+
+	if len(boundaries) < n {
+		return boundaries
+	}
+	splits := make([]string, 0, n-1)
+	for i := 1; i < n; i++ {
+		splits = append(splits, boundaries[i*len(boundaries)/n])
+	}
+	return splits
+}
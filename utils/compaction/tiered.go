@@ -0,0 +1,123 @@
+package compaction
+
+import (
+	config2 "nosql-engine/packages/utils/config"
+	"nosql-engine/packages/utils/manifest"
+	"nosql-engine/packages/utils/sstable"
+	"sort"
+)
+
+const (
+	DEFAULT_BUCKET_LOW     = 0.5
+	DEFAULT_BUCKET_HIGH    = 1.5
+	DEFAULT_MIN_THRESHOLD  = 4
+	DEFAULT_MAX_THRESHOLD  = 32
+	TIERED_LEVEL           = 0
+	TIERED_COMPACTION_NAME = "size-tiered"
+)
+
+// merges buckets of similarly sized tables until no bucket has enough tables.
+// All tables stay on level 0, their seq decides which one is newer
+func SizeTieredCompaction(dirPath string) {
+	compactionLock.Lock()
+	defer compactionLock.Unlock()
+
+	sizeTieredCompaction(sstable.OpenManifest(dirPath), config2.GetConfig())
+}
+
+func sizeTieredCompaction(m *manifest.Manifest, config *config2.Config) {
+	for {
+		bucket := pickBucket(m.Current().Level(TIERED_LEVEL), config)
+		if bucket == nil {
+			return
+		}
+
+		writer := sstable.NewWriter(m.Dir(), TIERED_LEVEL, config.SSTableFiles, int(config.SummaryCount), TIERED_COMPACTION_NAME)
+		mergeTables(m, bucket, TIERED_LEVEL, writer.Add)
+
+		edit := manifest.Edit{}
+		if output := writer.Finish(); output != nil {
+			edit.Add = append(edit.Add, *output)
+		}
+		installEdit(m, edit, bucket)
+	}
+}
+
+// groups the tables into buckets of similar size, oldest bucket first.
+// A bucket only holds tables that are next to each other by age, so the merged table takes the place
+// of its inputs in the read order and nothing between them gets shadowed
+func buckets(tables []manifest.Table, config *config2.Config) [][]manifest.Table {
+	low, high := config.BucketLow, config.BucketHigh
+	if low <= 0 {
+		low = DEFAULT_BUCKET_LOW
+	}
+	if high <= 0 {
+		high = DEFAULT_BUCKET_HIGH
+	}
+
+	// oldest first
+	sorted := append([]manifest.Table{}, tables...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Seq < sorted[j].Seq
+	})
+
+	result := make([][]manifest.Table, 0)
+	bucket := make([]manifest.Table, 0)
+	total := uint64(0)
+	for _, table := range sorted {
+		if len(bucket) > 0 {
+			average := float64(total) / float64(len(bucket))
+			if float64(table.Size) < average*low || float64(table.Size) > average*high {
+				result = append(result, bucket)
+				bucket, total = make([]manifest.Table, 0), 0
+			}
+		}
+		bucket = append(bucket, table)
+		total += table.Size
+	}
+	if len(bucket) > 0 {
+		result = append(result, bucket)
+	}
+	return result
+}
+
+// the bucket with the most tables, of equally big ones the one with the smallest tables since it is the cheapest to merge.
+// nil if no bucket reached the min threshold
+func pickBucket(tables []manifest.Table, config *config2.Config) []manifest.Table {
+	min, max := int(config.MinThreshold), int(config.MaxThreshold)
+	if min < 2 {
+		min = DEFAULT_MIN_THRESHOLD
+	}
+	if max < min {
+		max = DEFAULT_MAX_THRESHOLD
+	}
+
+	var best []manifest.Table
+	bestSize := uint64(0)
+	for _, bucket := range buckets(tables, config) {
+		if len(bucket) < min {
+			continue
+		}
+		// the oldest tables of the bucket go first, what remains is merged the next time
+		if len(bucket) > max {
+			bucket = bucket[:max]
+		}
+
+		size := uint64(0)
+		for _, table := range bucket {
+			size += table.Size
+		}
+		if best == nil || len(bucket) > len(best) || (len(bucket) == len(best) && size < bestSize) {
+			best, bestSize = bucket, size
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	// newest first, the way the merge expects its inputs
+	sort.Slice(best, func(i, j int) bool {
+		return best[i].Seq > best[j].Seq
+	})
+	return best
+}
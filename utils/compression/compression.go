@@ -0,0 +1,73 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// codec ids, they are written to disk next to every compressed block so they must never change
+const (
+	NONE  = 0
+	LZ    = 1
+	FLATE = 2
+	ZLIB  = 3
+)
+
+// possible names are "none", "lz", "flate" and "zlib", anything unknown means no compression
+func CodecFromName(name string) byte {
+	switch name {
+	case "lz":
+		return LZ
+	case "flate":
+		return FLATE
+	case "zlib":
+		return ZLIB
+	default:
+		return NONE
+	}
+}
+
+func Compress(codec byte, data []byte) []byte {
+	switch codec {
+	case LZ:
+		return lzCompress(data)
+	case FLATE:
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	case ZLIB:
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		return buf.Bytes()
+	default:
+		return data
+	}
+}
+
+func Decompress(codec byte, data []byte) ([]byte, error) {
+	switch codec {
+	case NONE:
+		return data, nil
+	case LZ:
+		return lzDecompress(data)
+	case FLATE:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	case ZLIB:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, errors.New("unknown compression codec " + strconv.Itoa(int(codec)))
+	}
+}
@@ -0,0 +1,42 @@
+package compression
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	json := make([]byte, 0)
+	for i := 0; i < 200; i++ {
+		json = append(json, []byte(`{"id":`+strconv.Itoa(i)+`,"name":"user`+strconv.Itoa(i)+`","active":true}`)...)
+	}
+
+	random := make([]byte, 5000)
+	rand.Read(random)
+
+	inputs := [][]byte{json, random, []byte(""), []byte("a"), bytes.Repeat([]byte("ab"), 1000)}
+
+	for _, codec := range []string{"none", "lz", "flate", "zlib"} {
+		id := CodecFromName(codec)
+
+		for i, input := range inputs {
+			output, err := Decompress(id, Compress(id, input))
+			if err != nil {
+				t.Fatalf("%s failed for input %d: %s", codec, i, err)
+			}
+			if !bytes.Equal(input, output) {
+				t.Fatalf("%s changed input %d", codec, i)
+			}
+		}
+
+		if id != NONE && len(Compress(id, json)) >= len(json)/2 {
+			t.Fatalf("%s did not compress json", codec)
+		}
+	}
+
+	if _, err := Decompress(42, json); err == nil {
+		t.Fatalf("unknown codec was accepted")
+	}
+}
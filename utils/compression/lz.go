@@ -0,0 +1,122 @@
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+   Simple LZ77 codec, made to be fast rather than to compress well:
+   +------------------------+-----+-----+-----+
+   | Raw length (uvarint)   | Op  | ... | Op  |
+   +------------------------+-----+-----+-----+
+   Literal op = Tag 0b0LLLLLLL followed by L+1 raw bytes
+   Copy op    = Tag 0b1LLLLLLL followed by the offset (uvarint), copies L+4 bytes starting offset bytes back
+*/
+
+const (
+	lzHashBits     = 14
+	lzMinMatch     = 4
+	lzMaxMatch     = lzMinMatch + 0x7f
+	lzMaxLiteral   = 0x80
+	lzMaxOffset    = 1 << 16
+	lzCopyTag      = 0x80
+	lzLengthMask   = 0x7f
+	lzHashMultiple = 0x9E3779B1
+)
+
+func lzHash(data []byte) uint32 {
+	return (binary.LittleEndian.Uint32(data) * lzHashMultiple) >> (32 - lzHashBits)
+}
+
+func lzAppendLiterals(dst []byte, literals []byte) []byte {
+	for len(literals) > 0 {
+		n := len(literals)
+		if n > lzMaxLiteral {
+			n = lzMaxLiteral
+		}
+		dst = append(dst, byte(n-1))
+		dst = append(dst, literals[:n]...)
+		literals = literals[n:]
+	}
+	return dst
+}
+
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+
+	var table [1 << lzHashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+
+	literalStart := 0
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		h := lzHash(src[i:])
+		candidate := int(table[h])
+		table[h] = int32(i)
+
+		if candidate < 0 || i-candidate > lzMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(src) && length < lzMaxMatch && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = lzAppendLiterals(dst, src[literalStart:i])
+		dst = append(dst, byte(lzCopyTag|(length-lzMinMatch)))
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+
+		i += length
+		literalStart = i
+	}
+
+	return lzAppendLiterals(dst, src[literalStart:])
+}
+
+func lzDecompress(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("lz: corrupt header")
+	}
+	src = src[n:]
+	dst := make([]byte, 0, length)
+
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		if tag&lzCopyTag == 0 {
+			n := int(tag&lzLengthMask) + 1
+			if n > len(src) {
+				return nil, errors.New("lz: corrupt literal")
+			}
+			dst = append(dst, src[:n]...)
+			src = src[n:]
+			continue
+		}
+
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, errors.New("lz: corrupt copy")
+		}
+		src = src[n:]
+
+		// source and destination can overlap, so the copy goes byte by byte
+		start := len(dst) - int(offset)
+		for j := 0; j < int(tag&lzLengthMask)+lzMinMatch; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, errors.New("lz: wrong length")
+	}
+	return dst, nil
+}
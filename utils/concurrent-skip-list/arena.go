@@ -0,0 +1,67 @@
+package concurrentskiplist
+
+import "sync/atomic"
+
+const (
+	nodeSlabSize = 4096
+	nextSlabSize = 4 * nodeSlabSize
+)
+
+// Nodes and their next pointers are carved out of big slabs instead of being allocated one by one,
+// so the GC sees a handful of large objects per memtable instead of one (or two) per key.
+// Handing out a slot is a single atomic add, a full slab is replaced with CAS.
+type arena struct {
+	nodes atomic.Pointer[nodeSlab]
+	next  atomic.Pointer[nextSlab]
+}
+
+type nodeSlab struct {
+	used  int64
+	nodes []SkipListNode
+}
+
+type nextSlab struct {
+	used int64
+	next []atomic.Pointer[SkipListNode]
+}
+
+func newArena() *arena {
+	a := &arena{}
+	a.nodes.Store(&nodeSlab{nodes: make([]SkipListNode, nodeSlabSize)})
+	a.next.Store(&nextSlab{next: make([]atomic.Pointer[SkipListNode], nextSlabSize)})
+	return a
+}
+
+func (a *arena) allocNode(height int) *SkipListNode {
+	var node *SkipListNode
+	for node == nil {
+		slab := a.nodes.Load()
+		i := atomic.AddInt64(&slab.used, 1) - 1
+
+		if i < int64(len(slab.nodes)) {
+			node = &slab.nodes[i]
+		} else {
+			a.nodes.CompareAndSwap(slab, &nodeSlab{nodes: make([]SkipListNode, nodeSlabSize)})
+		}
+	}
+
+	node.next = a.allocNext(height)
+	return node
+}
+
+func (a *arena) allocNext(height int) []atomic.Pointer[SkipListNode] {
+	// towers taller than a slab would never fit, they are rare enough to allocate directly
+	if height > nextSlabSize/4 {
+		return make([]atomic.Pointer[SkipListNode], height)
+	}
+
+	for {
+		slab := a.next.Load()
+		end := atomic.AddInt64(&slab.used, int64(height))
+
+		if end <= int64(len(slab.next)) {
+			return slab.next[end-int64(height) : end : end]
+		}
+		a.next.CompareAndSwap(slab, &nextSlab{next: make([]atomic.Pointer[SkipListNode], nextSlabSize)})
+	}
+}
@@ -0,0 +1,175 @@
+package concurrentskiplist
+
+import (
+	"math/bits"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	generic_types "nosql-engine/packages/utils/generic-types"
+	"sync/atomic"
+)
+
+// Lock-free skip list. Inserts link a node bottom-up with CAS on the next pointers,
+// values are swapped atomically so readers never see a half written element.
+// Nodes are never unlinked, a delete is just a tombstone, which keeps the algorithm simple
+// (no marked pointers) and is all the memtable needs.
+type SkipList struct {
+	MaxHeight int
+	height    int32 // highest level currently in use
+	size      int64
+	seed      uint64
+	head      *SkipListNode
+	arena     *arena
+}
+
+type SkipListNode struct {
+	key  string
+	elem atomic.Pointer[database_elem.DatabaseElem]
+	next []atomic.Pointer[SkipListNode]
+}
+
+func New(maxHeight int) *SkipList {
+	if maxHeight < 1 {
+		maxHeight = 1
+	}
+
+	a := newArena()
+	head := a.allocNode(maxHeight)
+
+	return &SkipList{
+		MaxHeight: maxHeight,
+		height:    1,
+		size:      0,
+		seed:      0,
+		head:      head,
+		arena:     a,
+	}
+}
+
+// splitmix64 over an atomic counter, so rolling a level never takes the global math/rand lock
+func (s *SkipList) roll() int {
+	x := atomic.AddUint64(&s.seed, 0x9E3779B97F4A7C15)
+	x = (x ^ (x >> 30)) * 0xBF58476D1CE4E5B9
+	x = (x ^ (x >> 27)) * 0x94D049BB133111EB
+	x = x ^ (x >> 31)
+
+	// every trailing one bit is a coin flip that went up a level
+	level := bits.TrailingZeros64(^x) + 1
+	if level > s.MaxHeight {
+		level = s.MaxHeight
+	}
+
+	for {
+		height := atomic.LoadInt32(&s.height)
+		if int32(level) <= height || atomic.CompareAndSwapInt32(&s.height, height, int32(level)) {
+			break
+		}
+	}
+
+	return level
+}
+
+// fills preds and succs so that preds[i].key < key <= succs[i].key on every level,
+// returns the node with the given key if it is already linked on level 0
+func (s *SkipList) findSplice(key string, preds []*SkipListNode, succs []*SkipListNode) *SkipListNode {
+	current := s.head
+
+	for i := s.MaxHeight - 1; i >= 0; i-- {
+		next := current.next[i].Load()
+		for next != nil && next.key < key {
+			current = next
+			next = current.next[i].Load()
+		}
+
+		preds[i] = current
+		succs[i] = next
+	}
+
+	if succs[0] != nil && succs[0].key == key {
+		return succs[0]
+	}
+
+	return nil
+}
+
+func (s *SkipList) Find(key string) *database_elem.DatabaseElem {
+	current := s.head
+
+	for i := int(atomic.LoadInt32(&s.height)) - 1; i >= 0; i-- {
+		next := current.next[i].Load()
+		for next != nil && next.key < key {
+			current = next
+			next = current.next[i].Load()
+		}
+
+		if next != nil && next.key == key {
+			return next.elem.Load()
+		}
+	}
+
+	return nil
+}
+
+// returns true if a new key was inserted, false if an existing one was updated
+func (s *SkipList) Add(key string, elem database_elem.DatabaseElem) bool {
+	preds := make([]*SkipListNode, s.MaxHeight)
+	succs := make([]*SkipListNode, s.MaxHeight)
+	value := elem
+
+	var newNode *SkipListNode
+	for {
+		oldNode := s.findSplice(key, preds, succs)
+		if oldNode != nil {
+			oldNode.elem.Store(&value)
+			return false
+		}
+
+		if newNode == nil {
+			newNode = s.arena.allocNode(s.roll())
+			newNode.key = key
+			newNode.elem.Store(&value)
+		}
+
+		// the node becomes visible once it is linked on the bottom level
+		newNode.next[0].Store(succs[0])
+		if preds[0].next[0].CompareAndSwap(succs[0], newNode) {
+			break
+		}
+	}
+
+	for i := 1; i < len(newNode.next); i++ {
+		for {
+			newNode.next[i].Store(succs[i])
+			if preds[i].next[i].CompareAndSwap(succs[i], newNode) {
+				break
+			}
+			// somebody inserted next to us on this level, recompute the splice
+			s.findSplice(key, preds, succs)
+		}
+	}
+
+	atomic.AddInt64(&s.size, 1)
+	return true
+}
+
+// returns true if capacity has to be updated
+func (s *SkipList) Remove(key string, timestamp uint64) bool {
+	return s.Add(key, database_elem.DatabaseElem{
+		Value:     []byte(""),
+		Tombstone: 1,
+		Timestamp: timestamp,
+	})
+}
+
+func (s *SkipList) Size() int {
+	return int(atomic.LoadInt64(&s.size))
+}
+
+// returns a sorted snapshot of the list, inserts that are running concurrently may or may not be included
+func (s *SkipList) Flush() []generic_types.KeyVal[string, database_elem.DatabaseElem] {
+	elems := make([]generic_types.KeyVal[string, database_elem.DatabaseElem], 0, s.Size())
+
+	for current := s.head.next[0].Load(); current != nil; current = current.next[0].Load() {
+		elems = append(elems, generic_types.KeyVal[string, database_elem.DatabaseElem]{Key: current.key, Value: *current.elem.Load()})
+	}
+
+	return elems
+}
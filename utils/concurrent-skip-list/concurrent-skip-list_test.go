@@ -0,0 +1,192 @@
+package concurrentskiplist
+
+import (
+	"math/rand"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	skiplist "nosql-engine/packages/utils/skip-list"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+func randSeq(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func TestSkipList(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	elementsCnt := 100
+
+	skipList := New(32)
+	randomStr := make([]string, elementsCnt)
+
+	for i := 0; i < elementsCnt; i++ {
+		randomStr[i] = randSeq(10)
+		skipList.Add(randomStr[i], database_elem.DatabaseElem{Value: []byte(randomStr[i]), Tombstone: 0, Timestamp: uint64(time.Now().Unix())})
+	}
+
+	for i := 0; i < elementsCnt; i++ {
+		elem := skipList.Find(randomStr[i])
+		if elem == nil || string(elem.Value) != randomStr[i] {
+			t.Fatalf("SkipList failed for key " + randomStr[i])
+		}
+	}
+
+	skipList.Remove(randomStr[0], uint64(time.Now().Unix()))
+	if skipList.Find(randomStr[0]).Tombstone != 1 {
+		t.Fatalf("SkipList remove failed for key " + randomStr[0])
+	}
+
+	elems := skipList.Flush()
+	if len(elems) < elementsCnt {
+		t.Fatalf("SkipList flush failed")
+	}
+	if !sort.SliceIsSorted(elems, func(i, j int) bool { return elems[i].Key < elems[j].Key }) {
+		t.Fatalf("SkipList flush is not sorted")
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+	goroutines := 8
+	perGoroutine := 2000
+
+	skipList := New(32)
+	var wg sync.WaitGroup
+
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				key := strconv.Itoa(g) + "-" + strconv.Itoa(i)
+				skipList.Add(key, database_elem.DatabaseElem{Value: []byte(key)})
+				// every goroutine also overwrites a shared key and reads somebody else's keys
+				skipList.Add("shared", database_elem.DatabaseElem{Value: []byte(key)})
+				skipList.Find(strconv.Itoa((g+1)%goroutines) + "-" + strconv.Itoa(i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if skipList.Size() != goroutines*perGoroutine+1 {
+		t.Fatalf("SkipList size is %d, expected %d", skipList.Size(), goroutines*perGoroutine+1)
+	}
+
+	for g := 0; g < goroutines; g++ {
+		for i := 0; i < perGoroutine; i++ {
+			key := strconv.Itoa(g) + "-" + strconv.Itoa(i)
+			elem := skipList.Find(key)
+			if elem == nil || string(elem.Value) != key {
+				t.Fatalf("SkipList lost key " + key)
+			}
+		}
+	}
+
+	elems := skipList.Flush()
+	if len(elems) != skipList.Size() {
+		t.Fatalf("SkipList flush returned %d elements, expected %d", len(elems), skipList.Size())
+	}
+	for i := 1; i < len(elems); i++ {
+		if elems[i-1].Key >= elems[i].Key {
+			t.Fatalf("SkipList flush is not sorted at " + elems[i].Key)
+		}
+	}
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = randSeq(16)
+	}
+	return keys
+}
+
+func BenchmarkSkipListAdd(b *testing.B) {
+	keys := benchKeys(b.N)
+	list := skiplist.New(32)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list.Add(keys[i], database_elem.DatabaseElem{Value: []byte("value")})
+	}
+}
+
+func BenchmarkConcurrentSkipListAdd(b *testing.B) {
+	keys := benchKeys(b.N)
+	list := New(32)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		list.Add(keys[i], database_elem.DatabaseElem{Value: []byte("value")})
+	}
+}
+
+// the old list is not safe for concurrent use, so the only way to share it is a mutex
+func BenchmarkSkipListAddParallel(b *testing.B) {
+	list := skiplist.New(32)
+	var lock sync.Mutex
+	var counter int64
+	var counterLock sync.Mutex
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		counterLock.Lock()
+		counter++
+		prefix := strconv.FormatInt(counter, 10) + "-"
+		counterLock.Unlock()
+
+		for i := 0; pb.Next(); i++ {
+			key := prefix + strconv.Itoa(i)
+			lock.Lock()
+			list.Add(key, database_elem.DatabaseElem{Value: []byte("value")})
+			lock.Unlock()
+		}
+	})
+}
+
+func BenchmarkConcurrentSkipListAddParallel(b *testing.B) {
+	list := New(32)
+	var counter int64
+	var counterLock sync.Mutex
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		counterLock.Lock()
+		counter++
+		prefix := strconv.FormatInt(counter, 10) + "-"
+		counterLock.Unlock()
+
+		for i := 0; pb.Next(); i++ {
+			list.Add(prefix+strconv.Itoa(i), database_elem.DatabaseElem{Value: []byte("value")})
+		}
+	})
+}
+
+func BenchmarkConcurrentSkipListMixedParallel(b *testing.B) {
+	keys := benchKeys(10000)
+	list := New(32)
+	for _, key := range keys {
+		list.Add(key, database_elem.DatabaseElem{Value: []byte("value")})
+	}
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			key := keys[r.Intn(len(keys))]
+			if r.Intn(10) == 0 {
+				list.Add(key, database_elem.DatabaseElem{Value: []byte("value")})
+			} else {
+				list.Find(key)
+			}
+		}
+	})
+}
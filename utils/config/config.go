@@ -7,22 +7,61 @@ import (
 )
 
 type Config struct {
-	WalSegmentSize    uint64   `yaml:"wal_segment_size"`
-	MemtableSize      uint64   `yaml:"memtable_size"`
-	MemtableStructure string   `yaml:"memtable_structure"`
-	BTreeMin          uint64   `yaml:"btree_min"`
-	BTreeMax          uint64   `yaml:"btree_max"`
-	SkipListLevels    uint64   `yaml:"skiplist_levels"`
-	SummaryCount      uint64   `yaml:"summary_count"`
-	CacheSize         uint64   `yaml:"cache_size"`
-	LsmLevels         uint64   `yaml:"lsm_levels"`
-	SSTableFiles      string   `yaml:"sstable_files"`
-	LsmMaxPerLevel    uint64   `yaml:"lsm_max_per_level"`
-	ReqPerTime        uint64   `yaml:"req_per_time"`
-	TimeUnit          string   `yaml:"time_unit"` // possible values "second", "minute", "day"
-	LsmLeveledComp    []uint64 `yaml:"lsm_leveled_compaction_cfg"`
-	SSTableSize       uint64   `yaml:"sstable_size"`
-	LSMType           string   `yaml:"lsm_type"` // possible values "size-tired", "leveled"
+	WalSegmentSize         uint64            `yaml:"wal_segment_size"`
+	MemtableSize           uint64            `yaml:"memtable_size"`
+	MemtableStructure      string            `yaml:"memtable_structure"` // possible values "skiplist", "btree", "concurrent-skiplist"
+	BTreeMin               uint64            `yaml:"btree_min"`
+	BTreeMax               uint64            `yaml:"btree_max"`
+	SkipListLevels         uint64            `yaml:"skiplist_levels"`
+	SummaryCount           uint64            `yaml:"summary_count"`
+	CacheSize              uint64            `yaml:"cache_size"`
+	CachePolicy            string            `yaml:"cache_policy"`           // possible values "lru", "w-tinylfu"
+	CacheBytes             uint64            `yaml:"cache_bytes"`            // bytes the cached records may take, 0 means no limit, cache_size still limits their number
+	CacheNegative          bool              `yaml:"cache_negative_lookups"` // keys that weren't found are cached as absent
+	LsmLevels              uint64            `yaml:"lsm_levels"`
+	SSTableFiles           string            `yaml:"sstable_files"` // possible values "one", "many", "block"
+	LsmMaxPerLevel         uint64            `yaml:"lsm_max_per_level"`
+	ReqPerTime             uint64            `yaml:"req_per_time"`
+	TimeUnit               string            `yaml:"time_unit"`                  // possible values "second", "minute", "day"
+	LsmLeveledComp         []uint64          `yaml:"lsm_leveled_compaction_cfg"` // only the first value is used, the number of tables level 0 may hold. lsm_levels is the number of levels
+	SSTableSize            uint64            `yaml:"sstable_size"`
+	LSMType                string            `yaml:"lsm_type"`                          // possible values "size-tired", "leveled"
+	BlockCompression       []string          `yaml:"block_compression"`                 // per level, possible values "none", "lz", "flate", "zlib"
+	BloomBitsPerKey        []float64         `yaml:"bloom_bits_per_key"`                // per level, bits table filters get for every key
+	SSTableTargetSize      uint64            `yaml:"sstable_target_size"`               // bytes, compaction outputs are cut at this size instead of sstable_size records, 0 turns it off
+	LevelTargetBase        uint64            `yaml:"level_target_base"`                 // bytes level 1 may hold
+	LevelFanout            uint64            `yaml:"level_fanout"`                      // every next level may hold this many times more bytes
+	LevelDynamic           bool              `yaml:"level_dynamic"`                     // targets are computed back from the size of the last level
+	CompactionPriority     string            `yaml:"compaction_priority"`               // which table of a level goes down first, possible values "oldest", "overlapping", "tombstones"
+	BucketLow              float64           `yaml:"size_tiered_bucket_low"`            // a table joins a bucket if its size is at least this times the bucket average
+	BucketHigh             float64           `yaml:"size_tiered_bucket_high"`           // and at most this times the bucket average
+	MinThreshold           uint64            `yaml:"size_tiered_min_threshold"`         // tables a bucket needs before it is merged
+	MaxThreshold           uint64            `yaml:"size_tiered_max_threshold"`         // most tables merged at once
+	L0SlowdownTables       uint64            `yaml:"level0_slowdown_tables"`            // writes are delayed once level 0 has this many tables, 0 turns it off
+	L0StopTables           uint64            `yaml:"level0_stop_tables"`                // writes wait for compaction once level 0 has this many tables, 0 turns it off
+	PendingSlowdownBytes   uint64            `yaml:"pending_compaction_slowdown_bytes"` // same as above for the bytes compaction is behind
+	PendingStopBytes       uint64            `yaml:"pending_compaction_stop_bytes"`     // 0 turns either of them off
+	WriteSlowdownDelay     uint64            `yaml:"write_slowdown_delay"`              // milliseconds every delayed write sleeps
+	FlushRateLimit         uint64            `yaml:"flush_rate_limit"`                  // bytes per second flushes may write, 0 means no limit
+	CompactionRateLimit    uint64            `yaml:"compaction_rate_limit"`             // bytes per second compactions may read and write, 0 means no limit
+	RateLimitAutoTune      bool              `yaml:"rate_limit_auto_tune"`              // compaction rate follows foreground latency, between compaction_rate_limit_min and compaction_rate_limit
+	RateLimitTargetLatency uint64            `yaml:"rate_limit_target_latency"`         // microseconds a foreground read or write should take with auto-tune
+	CompactionRateLimitMin uint64            `yaml:"compaction_rate_limit_min"`
+	TableCacheSize         uint64            `yaml:"table_cache_size"`   // tables kept open for lookups
+	MaxSubcompactions      uint64            `yaml:"max_subcompactions"` // goroutines one leveled compaction may split into, by key ranges
+	BlockCacheSize         uint64            `yaml:"block_cache_size"`   // bytes of table blocks kept in memory, 0 turns the cache off
+	BlockCacheShards       uint64            `yaml:"block_cache_shards"` // parts of the cache with their own lock
+	PrefixExtractors       []PrefixExtractor `yaml:"prefix_extractors"`  // tables get a bloom filter of key prefixes, prefix scans skip tables it rules out
+	RangeFilterDepth       uint64            `yaml:"range_filter_depth"` // bytes of every key the range filters of tables hold, 0 turns them off
+	SSTableReader          string            `yaml:"sstable_reader"`     // possible values "pread", "mmap" (linux only, elsewhere tables are read with pread)
+}
+
+// prefix of the keys of a keyspace that goes into the prefix filters
+type PrefixExtractor struct {
+	Keyspace  string `yaml:"keyspace"`  // keys starting with it, "" for all keys. Of several matching keyspaces the longest one is used
+	Type      string `yaml:"type"`      // possible values "fixed", "delimiter"
+	Length    uint64 `yaml:"length"`    // "fixed": the keyspace and the length bytes after it
+	Delimiter string `yaml:"delimiter"` // "delimiter": the key up to and including the first delimiter after the keyspace
 }
 
 func GetConfig() *Config {
@@ -39,6 +78,9 @@ func GetConfig() *Config {
 		config.SkipListLevels = 32
 		config.SummaryCount = 3
 		config.CacheSize = 10
+		config.CachePolicy = "lru"
+		config.CacheBytes = 1 << 20
+		config.CacheNegative = false
 		config.LsmLevels = 4
 		config.SSTableFiles = "one"
 		config.LsmMaxPerLevel = 4
@@ -48,6 +90,34 @@ func GetConfig() *Config {
 		config.SSTableSize = 10
 		config.LsmLeveledComp = []uint64{4, 10, 100}
 		config.LSMType = "size-tired"
+		config.BlockCompression = []string{"none"}
+		config.BloomBitsPerKey = []float64{10}
+		config.SSTableTargetSize = 0
+		config.LevelTargetBase = 1 << 20
+		config.LevelFanout = 10
+		config.LevelDynamic = false
+		config.CompactionPriority = "oldest"
+		config.BucketLow = 0.5
+		config.BucketHigh = 1.5
+		config.MinThreshold = 4
+		config.MaxThreshold = 32
+		config.L0SlowdownTables = 20
+		config.L0StopTables = 36
+		config.PendingSlowdownBytes = 64 << 20
+		config.PendingStopBytes = 256 << 20
+		config.WriteSlowdownDelay = 1
+		config.FlushRateLimit = 0
+		config.CompactionRateLimit = 0
+		config.RateLimitAutoTune = false
+		config.RateLimitTargetLatency = 1000
+		config.CompactionRateLimitMin = 1 << 20
+		config.MaxSubcompactions = 1
+		config.TableCacheSize = 64
+		config.BlockCacheSize = 8 << 20
+		config.BlockCacheShards = 16
+		config.PrefixExtractors = nil
+		config.RangeFilterDepth = 16
+		config.SSTableReader = "pread"
 	} else {
 		err := yaml.Unmarshal(configData, &config)
 		if err != nil {
@@ -0,0 +1,194 @@
+package database
+
+import (
+	blockcache "nosql-engine/packages/utils/block-cache"
+	"nosql-engine/packages/utils/compaction"
+	"nosql-engine/packages/utils/config"
+	"nosql-engine/packages/utils/manifest"
+	ratelimiter "nosql-engine/packages/utils/rate-limiter"
+	"nosql-engine/packages/utils/sstable"
+	"sync"
+	"time"
+)
+
+const (
+	STALL_NONE     = "none"
+	STALL_SLOWDOWN = "slowdown"
+	STALL_STOPPED  = "stopped"
+)
+
+// Stats of the database, stalls are counted since it was opened and the rest is how things are right now
+type Stats struct {
+	StallState             string        // what the last write went through, one of STALL_NONE, STALL_SLOWDOWN, STALL_STOPPED
+	Slowdowns              uint64        // writes that were delayed
+	Stops                  uint64        // writes that waited for compaction
+	StallDuration          time.Duration // time writes spent delayed or waiting
+	L0Tables               int
+	PendingCompactionBytes uint64
+	FlushRate              uint64 // bytes per second, 0 means no limit
+	CompactionRate         uint64
+	Compaction             compaction.Stats
+	BlockCache             blockcache.Stats
+	Filters                []sstable.FilterStats // per level
+}
+
+// runs compactions in the background so flushes don't wait for them,
+// and holds writes back when compaction can't keep up with them
+type compactor struct {
+	dirPath  string
+	config   config.Config
+	manifest *manifest.Manifest
+
+	lock      sync.Mutex
+	cond      *sync.Cond // signals requests, finished rounds and closing
+	requested bool
+	busy      bool
+	closed    bool
+	stopped   chan struct{}
+
+	// stall state of the version it was computed for, a flush or compaction installs a new version
+	stallVersion *manifest.Version
+	stall        string
+
+	stats Stats
+}
+
+func newCompactor(dirPath string, config config.Config) *compactor {
+	c := &compactor{
+		dirPath:  dirPath,
+		config:   config,
+		manifest: sstable.OpenManifest(dirPath),
+		stopped:  make(chan struct{}),
+		stats:    Stats{StallState: STALL_NONE},
+	}
+	c.cond = sync.NewCond(&c.lock)
+	go c.run()
+	return c
+}
+
+func (c *compactor) run() {
+	defer close(c.stopped)
+
+	for {
+		c.lock.Lock()
+		for !c.requested && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.lock.Unlock()
+			return
+		}
+		c.requested, c.busy = false, true
+		c.lock.Unlock()
+
+		compact(c.dirPath, c.config.LSMType)
+
+		c.lock.Lock()
+		c.busy = false
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	}
+}
+
+func compact(dirPath string, lsmType string) {
+	if lsmType == "size-tired" {
+		compaction.SizeTieredCompaction(dirPath)
+	} else {
+		compaction.LeveledCompaction(0, dirPath)
+		// It will go up from 0 level if needed
+	}
+}
+
+// asks for a compaction round, several requests before the round starts are served by it together
+func (c *compactor) schedule() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.requested = true
+	c.cond.Broadcast()
+}
+
+// waits for the running round to finish and stops the goroutine
+func (c *compactor) close() {
+	c.lock.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	<-c.stopped
+}
+
+// c.lock has to be held. It is only computed again once the current version changed
+func (c *compactor) stallState() string {
+	version := c.manifest.Current()
+	if version == c.stallVersion {
+		return c.stall
+	}
+
+	l0 := uint64(len(version.Level(0)))
+	pending := compaction.PendingBytes(version, &c.config)
+
+	over := func(value, limit uint64) bool {
+		return limit > 0 && value >= limit
+	}
+	c.stallVersion, c.stall = version, STALL_NONE
+	if over(l0, c.config.L0StopTables) || over(pending, c.config.PendingStopBytes) {
+		c.stall = STALL_STOPPED
+	} else if over(l0, c.config.L0SlowdownTables) || over(pending, c.config.PendingSlowdownBytes) {
+		c.stall = STALL_SLOWDOWN
+	}
+	return c.stall
+}
+
+// called before every write. Past the slowdown limits the write sleeps, past the stop limits it waits
+// until compaction brings them back down. If compaction runs out of work and the limits are still
+// reached it can't do any better, so the write goes through instead of waiting forever
+func (c *compactor) throttle() {
+	c.lock.Lock()
+	state := c.stallState()
+	c.lock.Unlock()
+	start := time.Now()
+
+	switch state {
+	case STALL_SLOWDOWN:
+		c.schedule()
+		time.Sleep(time.Duration(c.config.WriteSlowdownDelay) * time.Millisecond)
+	case STALL_STOPPED:
+		c.schedule()
+		c.lock.Lock()
+		for !c.closed && (c.requested || c.busy) && c.stallState() == STALL_STOPPED {
+			c.cond.Wait()
+		}
+		c.lock.Unlock()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stats.StallState = state
+	switch state {
+	case STALL_SLOWDOWN:
+		c.stats.Slowdowns++
+	case STALL_STOPPED:
+		c.stats.Stops++
+	}
+	if state != STALL_NONE {
+		c.stats.StallDuration += time.Since(start)
+	}
+}
+
+func (c *compactor) getStats() Stats {
+	c.lock.Lock()
+	stats := c.stats
+	c.lock.Unlock()
+
+	version := c.manifest.Current()
+	stats.L0Tables = len(version.Level(0))
+	stats.PendingCompactionBytes = compaction.PendingBytes(version, &c.config)
+	stats.FlushRate = ratelimiter.Get(ratelimiter.FLUSH).Rate()
+	stats.CompactionRate = ratelimiter.Get(ratelimiter.COMPACTION).Rate()
+	stats.Compaction = compaction.GetStats()
+	stats.BlockCache = blockcache.Shared().Stats()
+	stats.Filters = sstable.GetFilterStats()
+	return stats
+}
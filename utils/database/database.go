@@ -5,31 +5,44 @@ import (
 	"nosql-engine/packages/utils/cache"
 	"nosql-engine/packages/utils/cms"
 	"nosql-engine/packages/utils/compaction"
+	compactionfilter "nosql-engine/packages/utils/compaction-filter"
 	"nosql-engine/packages/utils/config"
 	database_elem "nosql-engine/packages/utils/database-elem"
 	generic_types "nosql-engine/packages/utils/generic-types"
 	"nosql-engine/packages/utils/hll"
+	"nosql-engine/packages/utils/manifest"
 	"nosql-engine/packages/utils/memtable"
+	prefixextractor "nosql-engine/packages/utils/prefix-extractor"
+	ratelimiter "nosql-engine/packages/utils/rate-limiter"
 	simhash "nosql-engine/packages/utils/sim-hash"
 	"nosql-engine/packages/utils/sstable"
 	tokenbucket "nosql-engine/packages/utils/token-bucket"
 	"nosql-engine/packages/utils/wal"
-	"os"
 	"sort"
 	"strings"
 	"time"
 )
 
 type Database struct {
-	config   config.Config
-	memtable memtable.MemTable
-	wal      wal.WAL
-	cache    cache.Cache
+	config    config.Config
+	memtable  *memtable.MemTable
+	wal       wal.WAL
+	cache     cache.Cache // written through by puts and deletes, compaction filters invalidate it from the background
+	listener  int
+	compactor *compactor
+	manifest  *manifest.Manifest // of the user tables, kept so lookups don't open it every time
 }
 
 func New() *Database {
 	config := config.GetConfig()
 
+	// before anything is flushed, so every table gets its prefix filter
+	for _, extractor := range config.PrefixExtractors {
+		if e := prefixextractor.FromConfig(extractor); e != nil {
+			prefixextractor.Register(extractor.Keyspace, e)
+		}
+	}
+
 	walObj := wal.New("data/wal/", uint32(config.WalSegmentSize), 0)
 	walEntries := walObj.ReadAllEntries()
 
@@ -49,26 +62,62 @@ func New() *Database {
 
 		if memtableObj.CheckFlushed() {
 			walObj.EmptyWAL()
-			if config.LSMType == "size-tired" {
-				for i := 0; i < int(config.LsmLevels-1); i++ {
-					compaction.DoCompaction(uint64(i), "data/usertables/", config.LsmMaxPerLevel, config.LsmLevels, config.SSTableFiles, int(config.SummaryCount))
-					// compaction.MergeCompaction(i, "data/usertables")
-				}
-			} else {
-				compaction.LeveledCompaction(0, "data/usertables/")
-				// It will go up from 0 level if needed
-			}
+			compact("data/usertables/", config.LSMType)
 		}
 	}
 
+	cacheObj := cache.Locked(cache.NewWithPolicy(config.CachePolicy, int(config.CacheSize), config.CacheBytes))
+	listener := compactionfilter.AddListener(func(keys []string) {
+		cacheObj.InvalidateKeys(keys)
+	})
+
 	return &Database{
-		config:   *config,
-		memtable: *memtableObj,
-		wal:      *walObj,
-		cache:    cache.New(int(config.CacheSize)),
+		config:    *config,
+		memtable:  memtableObj,
+		wal:       *walObj,
+		cache:     cacheObj,
+		listener:  listener,
+		compactor: newCompactor("data/usertables/", *config),
+		manifest:  sstable.OpenManifest("data/usertables"),
 	}
 }
 
+// stops background compaction, waiting for a running one to finish
+func (db *Database) Close() {
+	db.compactor.close()
+	compactionfilter.RemoveListener(db.listener)
+}
+
+func (db *Database) Stats() Stats {
+	return db.compactor.getStats()
+}
+
+// bytes per second flushes may write, 0 removes the limit
+func (db *Database) SetFlushRateLimit(rate uint64) {
+	ratelimiter.Get(ratelimiter.FLUSH).SetRate(rate)
+}
+
+// bytes per second compactions may read and write, 0 removes the limit. It turns auto-tune off
+func (db *Database) SetCompactionRateLimit(rate uint64) {
+	ratelimiter.Get(ratelimiter.COMPACTION).SetRate(rate)
+}
+
+// filter for the keys starting with prefix, it sees them in every flush and compaction from now on
+func (db *Database) SetCompactionFilter(prefix string, filter compactionfilter.CompactionFilter) {
+	compactionfilter.Register(prefix, filter)
+}
+
+// prefix filters of tables written from now on hold the prefixes the extractor takes from the keys starting
+// with keyspace, List skips tables whose prefix filter rules out what it lists. Older tables are read as before
+func (db *Database) SetPrefixExtractor(keyspace string, extractor prefixextractor.Extractor) {
+	prefixextractor.Register(keyspace, extractor)
+}
+
+// lets the compaction rate follow foreground latency, between min and max bytes per second. target 0 turns it off
+func (db *Database) SetCompactionAutoTune(target time.Duration, min uint64, max uint64) {
+	ratelimiter.Get(ratelimiter.COMPACTION).SetAutoTune(target, min, max)
+}
+
 func (db *Database) Put(key string, value []byte) bool {
 	if !db.CheckTokens() || checkReserved(key) {
 		return false
@@ -78,6 +127,12 @@ func (db *Database) Put(key string, value []byte) bool {
 }
 
 func (db *Database) put(key string, value []byte) bool {
+	db.compactor.throttle()
+	start := time.Now()
+	defer func() {
+		ratelimiter.ObserveLatency(time.Since(start))
+	}()
+
 	dbElem := &database_elem.DatabaseElem{
 		Value:     value,
 		Tombstone: 0,
@@ -85,19 +140,14 @@ func (db *Database) put(key string, value []byte) bool {
 	}
 
 	if db.wal.PutEntry(key, value, 0) {
+		// the cached record would be read once the memtable is flushed. It is replaced before the
+		// insert, which may flush and have a compaction filter invalidate the key
+		db.cache.Update(key, *dbElem)
 		db.memtable.Insert(key, *dbElem)
 
 		if db.memtable.CheckFlushed() {
 			db.wal.EmptyWAL()
-			if db.config.LSMType == "size-tired" {
-				for i := 0; i < int(db.config.LsmLevels-1); i++ {
-					compaction.DoCompaction(uint64(i), "data/usertables/", db.config.LsmMaxPerLevel, db.config.LsmLevels, db.config.SSTableFiles, int(db.config.SummaryCount))
-					// compaction.MergeCompaction(i, "data/usertables")
-				}
-			} else {
-				compaction.LeveledCompaction(0, "data/usertables/")
-				// It will go up from 0 level if needed
-			}
+			db.compactor.schedule()
 		}
 
 		return true
@@ -115,21 +165,15 @@ func (db *Database) Delete(key string) bool {
 }
 
 func (db *Database) delete(key string) bool {
+	db.compactor.throttle()
+
 	if db.wal.PutEntry(key, []byte(""), 1) {
-		db.memtable.Delete(key)
 		db.cache.Delete(key)
+		db.memtable.Delete(key)
 
 		if db.memtable.CheckFlushed() {
 			db.wal.EmptyWAL()
-			if db.config.LSMType == "size-tired" {
-				for i := 0; i < int(db.config.LsmLevels-1); i++ {
-					compaction.DoCompaction(uint64(i), "data/usertables/", db.config.LsmMaxPerLevel, db.config.LsmLevels, db.config.SSTableFiles, int(db.config.SummaryCount))
-					// compaction.MergeCompaction(i, "data/usertables")
-				}
-			} else {
-				compaction.LeveledCompaction(0, "data/usertables/")
-				// It will go up from 0 level if needed
-			}
+			db.compactor.schedule()
 		}
 
 		return true
@@ -148,6 +192,13 @@ func (db *Database) Get(key string) (bool, []byte) {
 }
 
 func (db *Database) get(key string) []byte {
+	start := time.Now()
+	defer func() {
+		ratelimiter.ObserveLatency(time.Since(start))
+	}()
+
+	// what the tables return is only cached if nothing wrote or invalidated meanwhile
+	epoch := db.cache.Epoch()
 	found, keyValue := db.memtable.Find(key)
 
 	if found {
@@ -158,13 +209,7 @@ func (db *Database) get(key string) []byte {
 		}
 	}
 
-	if db.cache.Contains(key) {
-		elem := db.cache.Refer(key, database_elem.DatabaseElem{
-			Value:     []byte(""),
-			Tombstone: 0,
-			Timestamp: uint64(time.Now().Unix()),
-		})
-
+	if elem, ok := db.cache.Get(key); ok {
 		if elem.Tombstone == 1 {
 			return nil
 		} else {
@@ -172,16 +217,13 @@ func (db *Database) get(key string) []byte {
 		}
 	}
 
-	files, err := os.ReadDir("data/usertables")
-
-	if len(files) == 0 || os.IsNotExist(err) {
-		return nil
+	elem := &database_elem.DatabaseElem{}
+	if len(db.manifest.Current().Tables) > 0 {
+		found, elem = sstable.FindIn(db.manifest, key, db.config.LsmLevels)
 	}
 
-	found, elem := sstable.Find(key, "data/usertables", db.config.LsmLevels, db.config.SSTableFiles)
-
 	if found {
-		db.cache.Refer(key, *elem)
+		db.cache.ReferAt(key, *elem, epoch)
 
 		if elem.Tombstone == 1 {
 			return nil
@@ -190,6 +232,10 @@ func (db *Database) get(key string) []byte {
 		}
 	}
 
+	if db.config.CacheNegative {
+		// absent until a put replaces it
+		db.cache.ReferAt(key, database_elem.DatabaseElem{Tombstone: 1}, epoch)
+	}
 	return nil
 }
 
@@ -503,6 +549,26 @@ func (db *Database) RangeScan(start string, end string, pageSize uint64, page ui
 	return retValues
 }
 
+// compacts every table holding keys in [start, end] down to the bottom level, after flushing the memtable
+// so deletes still waiting in it are compacted too. progress is called after every step and can be nil
+func (db *Database) CompactRange(start string, end string, progress func(compaction.Progress)) {
+	db.flush()
+	compaction.CompactRange("data/usertables/", start, end, progress)
+}
+
+func (db *Database) CompactAll(progress func(compaction.Progress)) {
+	db.flush()
+	compaction.CompactAll("data/usertables/", progress)
+}
+
+func (db *Database) flush() {
+	if len(db.memtable.AllElements()) == 0 {
+		return
+	}
+	db.memtable.Flush()
+	db.wal.EmptyWAL()
+}
+
 func checkReserved(key string) bool {
 	reservedPrefixes := [...]string{"tb_", "hll_", "cms_", "bf_", "sh_"}
 
@@ -3,8 +3,16 @@ package database
 import (
 	"fmt"
 	"math/rand"
+	"nosql-engine/packages/utils/cache"
+	"nosql-engine/packages/utils/compaction"
+	compactionfilter "nosql-engine/packages/utils/compaction-filter"
+	"nosql-engine/packages/utils/config"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	generic_types "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/sstable"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -200,6 +208,7 @@ func TestDatabase(t *testing.T) {
 	// 	}
 	// }
 
+	db.Close()
 	os.RemoveAll("./data")
 }
 
@@ -208,6 +217,7 @@ func TestCompactions(t *testing.T) {
 	elementsCnt := 1000
 
 	db := New()
+	defer db.Close()
 	randomStr := make([]string, elementsCnt)
 
 	for i := 0; i < elementsCnt; i++ {
@@ -237,3 +247,133 @@ func TestTestCompactions(t *testing.T) {
 		TestCompactions(t)
 	}
 }
+
+func TestWriteStall(t *testing.T) {
+	prefix := "data/stallTables/"
+	defer os.RemoveAll(prefix)
+
+	cfg := *config.GetConfig()
+	cfg.LSMType = "leveled"
+	cfg.LsmLeveledComp = []uint64{4, 10, 100}
+	cfg.L0SlowdownTables = 2
+	cfg.L0StopTables = 4
+	cfg.PendingSlowdownBytes = 0
+	cfg.PendingStopBytes = 0
+
+	c := newCompactor(prefix, cfg)
+	defer c.close()
+
+	flush := func(n int) {
+		for i := 0; i < n; i++ {
+			elems := make([]generic_types.KeyVal[string, database_elem.DatabaseElem], 0)
+			for j := 0; j < 10; j++ {
+				key := "key" + strconv.Itoa(j)
+				elems = append(elems, generic_types.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: database_elem.DatabaseElem{Value: []byte(key), Timestamp: uint64(time.Now().Unix())}})
+			}
+			sstable.CreateSStable(elems, 3, prefix, 0, "one")
+		}
+	}
+
+	c.throttle()
+	if stats := c.getStats(); stats.StallState != STALL_NONE || stats.Slowdowns != 0 || stats.Stops != 0 {
+		t.Fatalf("empty level 0 stalled the write: %+v", stats)
+	}
+
+	flush(2)
+	c.throttle()
+	if stats := c.getStats(); stats.StallState != STALL_SLOWDOWN || stats.Slowdowns != 1 {
+		t.Fatalf("write wasn't slowed down with 2 tables on level 0: %+v", stats)
+	}
+
+	// the write has to wait until compaction moved level 0 down
+	flush(2)
+	c.throttle()
+	stats := c.getStats()
+	if stats.StallState != STALL_STOPPED || stats.Stops != 1 || stats.StallDuration == 0 {
+		t.Fatalf("write wasn't stopped with 4 tables on level 0: %+v", stats)
+	}
+	if stats.L0Tables != 0 {
+		t.Fatalf("write went on before compaction, %d tables left on level 0", stats.L0Tables)
+	}
+
+	// compaction can't go below its own limit, the write must not wait for it forever
+	c.config.L0StopTables = 3
+	flush(3)
+	c.throttle()
+	if stats := c.getStats(); stats.Stops != 2 || stats.L0Tables != 3 {
+		t.Fatalf("unexpected stats after a stop compaction can't resolve: %+v", stats)
+	}
+}
+
+type rewriteFilter struct{}
+
+func (rewriteFilter) Filter(ctx compactionfilter.Context, key string, value []byte) (compactionfilter.Decision, []byte) {
+	return compactionfilter.CHANGE_VALUE, []byte("rewritten")
+}
+
+func TestCacheCoherence(t *testing.T) {
+	db := New()
+	defer os.RemoveAll("./data")
+	defer db.Close()
+	db.config.CacheNegative = true
+
+	// the memtable is flushed so reads go to the tables and the cache
+	flush := func() {
+		for i := 0; i < int(db.config.MemtableSize); i++ {
+			db.put("filler"+strconv.Itoa(i), []byte("filler"))
+		}
+	}
+	expect := func(key string, value []byte) {
+		if got := db.get(key); !reflect.DeepEqual(got, value) {
+			t.Fatalf("GET of %s returned %q instead of %q", key, got, value)
+		}
+	}
+
+	db.put("key", []byte("old"))
+	flush()
+	expect("key", []byte("old"))
+	db.put("key", []byte("new"))
+	flush()
+	expect("key", []byte("new"))
+
+	db.delete("key")
+	flush()
+	expect("key", nil)
+
+	// the negative lookup is cached and replaced by the put
+	expect("absent", nil)
+	db.put("absent", []byte("there"))
+	flush()
+	expect("absent", []byte("there"))
+
+	// a filter rewrites the cached record in a compaction
+	db.put("cf_key", []byte("original"))
+	flush()
+	expect("cf_key", []byte("original"))
+	db.SetCompactionFilter("cf_", rewriteFilter{})
+	defer compactionfilter.Unregister("cf_")
+	compaction.CompactAll("data/usertables/", nil)
+	expect("cf_key", []byte("rewritten"))
+}
+
+func TestCacheFillCountsOnce(t *testing.T) {
+	db := New()
+	defer os.RemoveAll("./data")
+	defer db.Close()
+	db.config.CacheNegative = true
+	counted := cache.NewTinyLFU(100, 0)
+	db.cache = cache.Locked(counted)
+
+	db.put("cold", []byte("value"))
+	for i := 0; i < int(db.config.MemtableSize); i++ {
+		db.put("filler"+strconv.Itoa(i), []byte("filler"))
+	}
+
+	// the miss and the fill from the tables are one read
+	for _, key := range []string{"cold", "absent"} {
+		db.get(key)
+		if count := counted.Frequency(key); count != 1 {
+			t.Fatalf("one GET of %s was counted %d times", key, count)
+		}
+	}
+}
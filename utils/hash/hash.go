@@ -42,3 +42,19 @@ func ToBinary(s string) string {
 	}
 	return res
 }
+
+// 64-bit FNV-1a of the data started from the seed, with the murmur3 finalizer so every bit of
+// the result depends on every bit of the input. Much cheaper than HashWithSeed
+func Hash64(data []byte, seed uint64) uint64 {
+	h := uint64(14695981039346656037) ^ seed
+	for _, b := range data {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,532 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+   MANIFEST is an append-only log of version edits, one record per edit:
+   +---------------+-------------------+------------------+----------------+-----+----------------+------------------+-----------+
+   |    CRC (4B)   | Payload Size (8B) | Next File (8B)   | Added Count(8B)| Table | ... | Removed Count (8B)| Number (8B) | ... |
+   +---------------+-------------------+------------------+----------------+-----+----------------+------------------+-----------+
+   Table = Number (8B) | Level (8B) | Size (8B) | Name | Min Key | Max Key, strings are written as size (8B) + bytes
+   CRC = 32bit hash computed over the payload
+   After the removed numbers comes the Seq (8B) of every added table, records written before Seq existed end without it.
+
+   Replaying all records gives the current set of tables. A record that was only partly written
+   (crash while appending) fails its CRC and is dropped together with everything after it.
+   On open the log is rewritten as a single record holding the whole version.
+*/
+
+const (
+	FILE_NAME = "MANIFEST"
+
+	CRC_SIZE          = 4
+	PAYLOAD_SIZE_SIZE = 8
+	HEADER_SIZE       = CRC_SIZE + PAYLOAD_SIZE_SIZE
+)
+
+type Table struct {
+	Number uint64 // unique in the directory, a bigger number means a table written later
+	Level  int
+	Name   string // file name prefix of the table relative to the directory, "usertable-L0-1-"
+	MinKey string
+	MaxKey string
+	Size   uint64 // bytes on disk
+	Seq    uint64 // age of the newest data in the table, flushed tables get their number, compaction outputs the largest seq of their inputs
+}
+
+// Version is the set of tables live at one moment, it is never changed once it was made current
+type Version struct {
+	Tables []Table // sorted by level, newest data first inside a level
+	levels []levelIndex
+}
+
+// key ranges of one level, built once with the version
+type levelIndex struct {
+	newest   []Table // the level's part of Tables
+	byKey    []Table // sorted by min key
+	disjoint bool    // no two tables overlap, so at most one can hold a key
+}
+
+func newVersion(tables []Table) *Version {
+	v := &Version{Tables: tables, levels: make([]levelIndex, 0)}
+	for start := 0; start < len(tables); {
+		level := tables[start].Level
+		end := start
+		for end < len(tables) && tables[end].Level == level {
+			end++
+		}
+		for len(v.levels) <= level {
+			v.levels = append(v.levels, levelIndex{})
+		}
+
+		byKey := append([]Table{}, tables[start:end]...)
+		sort.Slice(byKey, func(i, j int) bool {
+			return byKey[i].MinKey < byKey[j].MinKey
+		})
+		disjoint := true
+		for i := 1; i < len(byKey); i++ {
+			if byKey[i].MinKey <= byKey[i-1].MaxKey {
+				disjoint = false
+			}
+		}
+		v.levels[level] = levelIndex{newest: tables[start:end], byKey: byKey, disjoint: disjoint}
+		start = end
+	}
+	return v
+}
+
+type Edit struct {
+	Add      []Table
+	Remove   []uint64 // numbers of the removed tables
+	NextFile uint64   // file numbers below this one must not be handed out again, 0 if it didn't change
+}
+
+type Manifest struct {
+	dir      string
+	lock     sync.Mutex // serializes edits, readers only load current
+	file     *os.File
+	info     os.FileInfo
+	current  atomic.Pointer[Version]
+	nextFile uint64
+
+	refsLock sync.Mutex
+	refs     map[*Version]int // versions readers are using right now
+	retired  []retiredTable   // tables out of the manifest whose files may still be read
+}
+
+type retiredTable struct {
+	table  Table
+	remove func(Table)
+}
+
+var (
+	manifests     = make(map[string]*Manifest)
+	manifestsLock sync.Mutex
+)
+
+// returns the manifest of the directory, it is loaded (or created) the first time and shared after that.
+// recover is called once, right after loading, created tells if there was no MANIFEST in the directory.
+// Every call checks that the MANIFEST is still the one loaded, callers that read or write all the time
+// keep the manifest instead of opening it for every operation
+func Open(dir string, recover func(m *Manifest, created bool)) *Manifest {
+	dir = filepath.Clean(dir)
+
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+
+	if m, ok := manifests[dir]; ok {
+		// the directory can be removed under us (tests, manual cleanup), then we start over
+		info, err := os.Stat(filepath.Join(dir, FILE_NAME))
+		if err == nil && os.SameFile(info, m.info) {
+			return m
+		}
+		m.file.Close()
+		delete(manifests, dir)
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		panic(err)
+	}
+
+	m, created := load(dir)
+	manifests[dir] = m
+	if recover != nil {
+		recover(m, created)
+	}
+	return m
+}
+
+// forgets the manifest, the next Open reads it again from disk
+func (m *Manifest) Close() {
+	manifestsLock.Lock()
+	defer manifestsLock.Unlock()
+
+	if manifests[m.dir] == m {
+		delete(manifests, m.dir)
+	}
+	m.file.Close()
+}
+
+func (m *Manifest) Dir() string {
+	return m.dir
+}
+
+// the version to read from, it stays valid even if an edit is applied meanwhile
+func (m *Manifest) Current() *Version {
+	return m.current.Load()
+}
+
+func (m *Manifest) NewFileNumber() uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	number := m.nextFile
+	m.nextFile++
+	return number
+}
+
+// current version, its tables stay on disk until it is released even if compaction removes them meanwhile
+func (m *Manifest) Acquire() *Version {
+	m.refsLock.Lock()
+	defer m.refsLock.Unlock()
+
+	version := m.current.Load()
+	m.refs[version]++
+	return version
+}
+
+func (m *Manifest) Release(version *Version) {
+	m.refsLock.Lock()
+	defer m.refsLock.Unlock()
+
+	m.refs[version]--
+	if m.refs[version] <= 0 {
+		delete(m.refs, version)
+		m.collect()
+	}
+}
+
+// remove is called for every table once no acquired version holds it anymore, right away if none does.
+// The tables have to be out of the current version already
+func (m *Manifest) Retire(tables []Table, remove func(Table)) {
+	m.refsLock.Lock()
+	defer m.refsLock.Unlock()
+
+	for _, table := range tables {
+		m.retired = append(m.retired, retiredTable{table: table, remove: remove})
+	}
+	m.collect()
+}
+
+// refsLock has to be held
+func (m *Manifest) collect() {
+	inUse := make(map[uint64]bool)
+	for version := range m.refs {
+		for _, table := range version.Tables {
+			inUse[table.Number] = true
+		}
+	}
+
+	kept := make([]retiredTable, 0)
+	for _, retired := range m.retired {
+		if inUse[retired.table.Number] {
+			kept = append(kept, retired)
+		} else {
+			retired.remove(retired.table)
+		}
+	}
+	m.retired = kept
+}
+
+// writes the edit to the log and makes the resulting version current, all of it or nothing becomes visible
+func (m *Manifest) Apply(edit Edit) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	version := m.current.Load().apply(edit)
+	if edit.NextFile > m.nextFile {
+		m.nextFile = edit.NextFile
+	}
+	for _, table := range edit.Add {
+		if table.Number >= m.nextFile {
+			m.nextFile = table.Number + 1
+		}
+	}
+	edit.NextFile = m.nextFile
+
+	if _, err := m.file.Write(encodeRecord(edit)); err != nil {
+		panic(err)
+	}
+	if err := m.file.Sync(); err != nil {
+		panic(err)
+	}
+
+	m.current.Store(version)
+}
+
+// created tells if there was no MANIFEST to load
+func load(dir string) (*Manifest, bool) {
+	path := filepath.Join(dir, FILE_NAME)
+	m := &Manifest{dir: dir, nextFile: 1, refs: make(map[*Version]int), retired: make([]retiredTable, 0)}
+	version := newVersion(make([]Table, 0))
+
+	data, err := os.ReadFile(path)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		panic(err)
+	}
+	for len(data) > 0 {
+		edit, rest, err := decodeRecord(data)
+		if err != nil {
+			break
+		}
+		version = version.apply(edit)
+		if edit.NextFile > m.nextFile {
+			m.nextFile = edit.NextFile
+		}
+		data = rest
+	}
+	for _, table := range version.Tables {
+		if table.Number >= m.nextFile {
+			m.nextFile = table.Number + 1
+		}
+	}
+
+	// the whole version goes to a new file which then replaces the old log in one rename. The new file
+	// is on disk before the rename and the rename is on disk before anything is appended to it
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := tmp.Write(encodeRecord(Edit{Add: version.Tables, NextFile: m.nextFile})); err != nil {
+		panic(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		panic(err)
+	}
+	if err := tmp.Close(); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		panic(err)
+	}
+	SyncDir(dir)
+
+	m.file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(err)
+	}
+	m.info, err = m.file.Stat()
+	if err != nil {
+		panic(err)
+	}
+	m.current.Store(version)
+	return m, created
+}
+
+// makes renames, links and new files in the directory durable. Windows can't sync a directory, it doesn't need to
+func SyncDir(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		panic(err)
+	}
+}
+
+func (v *Version) apply(edit Edit) *Version {
+	removed := make(map[uint64]bool)
+	for _, number := range edit.Remove {
+		removed[number] = true
+	}
+
+	tables := make([]Table, 0, len(v.Tables)+len(edit.Add))
+	for _, table := range v.Tables {
+		if !removed[table.Number] {
+			tables = append(tables, table)
+		}
+	}
+	for _, table := range edit.Add {
+		if table.Seq == 0 {
+			table.Seq = table.Number
+		}
+		if !removed[table.Number] {
+			tables = append(tables, table)
+		}
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Level != tables[j].Level {
+			return tables[i].Level < tables[j].Level
+		}
+		if tables[i].Seq != tables[j].Seq {
+			return tables[i].Seq > tables[j].Seq
+		}
+		return tables[i].Number > tables[j].Number
+	})
+	return newVersion(tables)
+}
+
+// tables on levels below maxLevel whose key range holds the key, in the order they have to be read.
+// A level of non-overlapping tables is binary searched and gives at most one, on the others
+// (level 0, size-tiered levels) every table holding the key is returned, newest first
+func (v *Version) Candidates(key string, maxLevel int) []Table {
+	candidates := make([]Table, 0)
+	for level := 0; level < len(v.levels) && level < maxLevel; level++ {
+		index := v.levels[level]
+		if index.disjoint {
+			i := sort.Search(len(index.byKey), func(i int) bool {
+				return index.byKey[i].MaxKey >= key
+			})
+			if i < len(index.byKey) && index.byKey[i].MinKey <= key {
+				candidates = append(candidates, index.byKey[i])
+			}
+			continue
+		}
+		for _, table := range index.newest {
+			if table.MinKey <= key && key <= table.MaxKey {
+				candidates = append(candidates, table)
+			}
+		}
+	}
+	return candidates
+}
+
+// tables of the level, newest data first
+func (v *Version) Level(level int) []Table {
+	tables := make([]Table, 0)
+	for _, table := range v.Tables {
+		if table.Level == level {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// tables of the level whose key range overlaps [min, max]
+func (v *Version) Overlapping(level int, min, max string) []Table {
+	tables := make([]Table, 0)
+	for _, table := range v.Level(level) {
+		if table.MinKey <= max && table.MaxKey >= min {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// sum of the table sizes on the level
+func (v *Version) LevelSize(level int) uint64 {
+	size := uint64(0)
+	for _, table := range v.Level(level) {
+		size += table.Size
+	}
+	return size
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func encodeRecord(edit Edit) []byte {
+	payload := make([]byte, 0)
+	payload = binary.LittleEndian.AppendUint64(payload, edit.NextFile)
+
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(len(edit.Add)))
+	for _, table := range edit.Add {
+		payload = binary.LittleEndian.AppendUint64(payload, table.Number)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(table.Level))
+		payload = binary.LittleEndian.AppendUint64(payload, table.Size)
+		payload = appendString(payload, table.Name)
+		payload = appendString(payload, table.MinKey)
+		payload = appendString(payload, table.MaxKey)
+	}
+
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(len(edit.Remove)))
+	for _, number := range edit.Remove {
+		payload = binary.LittleEndian.AppendUint64(payload, number)
+	}
+	for _, table := range edit.Add {
+		payload = binary.LittleEndian.AppendUint64(payload, table.Seq)
+	}
+
+	record := make([]byte, HEADER_SIZE, HEADER_SIZE+len(payload))
+	binary.LittleEndian.PutUint32(record[0:CRC_SIZE], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint64(record[CRC_SIZE:HEADER_SIZE], uint64(len(payload)))
+	return append(record, payload...)
+}
+
+// reads fields out of a payload, the first error sticks
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return n
+}
+
+func (d *decoder) string() string {
+	length := d.uint64()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.buf)) < length {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.buf[:length])
+	d.buf = d.buf[length:]
+	return s
+}
+
+func decodeRecord(data []byte) (Edit, []byte, error) {
+	var edit Edit
+	if len(data) < HEADER_SIZE {
+		return edit, nil, io.ErrUnexpectedEOF
+	}
+	size := binary.LittleEndian.Uint64(data[CRC_SIZE:HEADER_SIZE])
+	if uint64(len(data)-HEADER_SIZE) < size {
+		return edit, nil, io.ErrUnexpectedEOF
+	}
+	payload := data[HEADER_SIZE : HEADER_SIZE+size]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[0:CRC_SIZE]) {
+		return edit, nil, errors.New("manifest record checksum mismatch")
+	}
+
+	d := &decoder{buf: payload}
+	edit.NextFile = d.uint64()
+
+	added := d.uint64()
+	for i := uint64(0); i < added && d.err == nil; i++ {
+		table := Table{}
+		table.Number = d.uint64()
+		table.Level = int(d.uint64())
+		table.Size = d.uint64()
+		table.Name = d.string()
+		table.MinKey = d.string()
+		table.MaxKey = d.string()
+		edit.Add = append(edit.Add, table)
+	}
+
+	removed := d.uint64()
+	for i := uint64(0); i < removed && d.err == nil; i++ {
+		edit.Remove = append(edit.Remove, d.uint64())
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		for i := range edit.Add {
+			edit.Add[i].Seq = d.uint64()
+		}
+	}
+
+	if d.err != nil {
+		return edit, nil, d.err
+	}
+	return edit, data[HEADER_SIZE+size:], nil
+}
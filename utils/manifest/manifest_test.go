@@ -0,0 +1,150 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func table(number uint64, level int) Table {
+	name := "usertable-L" + strconv.Itoa(level) + "-" + strconv.FormatUint(number, 10) + "-"
+	return Table{Number: number, Level: level, Name: name, MinKey: "a" + name, MaxKey: "z" + name, Size: number * 100, Seq: number}
+}
+
+func TestManifestRecovery(t *testing.T) {
+	dir := "data/manifestTest"
+	m := Open(dir, nil)
+
+	m.Apply(Edit{Add: []Table{table(m.NewFileNumber(), 0), table(m.NewFileNumber(), 0)}})
+	before := m.Current()
+	m.Apply(Edit{Add: []Table{table(m.NewFileNumber(), 1)}, Remove: []uint64{1}})
+
+	// versions are never changed in place
+	if len(before.Tables) != 2 || before.Tables[0].Number != 2 {
+		t.Fatalf("old version was changed: %+v", before.Tables)
+	}
+
+	m.Close()
+	m = Open(dir, func(m *Manifest, created bool) {
+		if created {
+			t.Fatalf("existing manifest was not found")
+		}
+	})
+
+	tables := m.Current().Tables
+	if len(tables) != 2 || tables[0] != table(2, 0) || tables[1] != table(3, 1) {
+		t.Fatalf("wrong tables after recovery: %+v", tables)
+	}
+	if m.NewFileNumber() != 4 {
+		t.Fatalf("file numbers are reused after recovery")
+	}
+
+	// the log was rewritten as one record and the temporary file renamed over it
+	if _, err := os.Stat(filepath.Join(dir, FILE_NAME+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary manifest was left behind")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, FILE_NAME))
+	if _, rest, err := decodeRecord(data); err != nil || len(rest) != 0 {
+		t.Fatalf("rewritten manifest isn't a single record: %v", err)
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestManifestTornRecord(t *testing.T) {
+	dir := "data/manifestTest"
+	m := Open(dir, nil)
+	m.Apply(Edit{Add: []Table{table(1, 0)}})
+	m.Close()
+
+	// a crash in the middle of appending an edit leaves only part of the record
+	record := encodeRecord(Edit{Add: []Table{table(2, 0)}, Remove: []uint64{1}})
+	file, _ := os.OpenFile(filepath.Join(dir, FILE_NAME), os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(record[:len(record)-3])
+	file.Close()
+
+	m = Open(dir, nil)
+	tables := m.Current().Tables
+	if len(tables) != 1 || tables[0] != table(1, 0) {
+		t.Fatalf("torn record was applied: %+v", tables)
+	}
+
+	m.Apply(Edit{Add: []Table{table(2, 1)}})
+	m.Close()
+	if tables := Open(dir, nil).Current().Tables; len(tables) != 2 {
+		t.Fatalf("edit after the torn record was lost: %+v", tables)
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestManifestRetire(t *testing.T) {
+	dir := "data/manifestTest"
+	m := Open(dir, nil)
+	m.Apply(Edit{Add: []Table{table(1, 0), table(2, 0)}})
+
+	removed := make([]uint64, 0)
+	remove := func(table Table) {
+		removed = append(removed, table.Number)
+	}
+
+	// a reader is still going through table 1
+	version := m.Acquire()
+	m.Apply(Edit{Add: []Table{table(3, 1)}, Remove: []uint64{1, 2}})
+	m.Retire([]Table{table(1, 0), table(2, 0)}, remove)
+	if len(removed) != 0 {
+		t.Fatalf("tables of an acquired version were removed: %v", removed)
+	}
+
+	m.Release(version)
+	if len(removed) != 2 {
+		t.Fatalf("tables weren't removed after the version was released: %v", removed)
+	}
+
+	// nobody holds the current version, so a retired table goes right away
+	m.Apply(Edit{Remove: []uint64{3}})
+	m.Retire([]Table{table(3, 1)}, remove)
+	if len(removed) != 3 {
+		t.Fatalf("unused table wasn't removed: %v", removed)
+	}
+
+	m.Close()
+	os.RemoveAll("data/")
+}
+
+func TestCandidates(t *testing.T) {
+	ranged := func(number uint64, level int, min, max string) Table {
+		table := table(number, level)
+		table.MinKey, table.MaxKey = min, max
+		return table
+	}
+	version := newVersion(nil).apply(Edit{Add: []Table{
+		ranged(1, 0, "a", "m"),
+		ranged(2, 0, "k", "z"),
+		ranged(3, 1, "a", "f"),
+		ranged(4, 1, "g", "p"),
+		ranged(5, 1, "q", "z"),
+		ranged(6, 2, "a", "k"),
+		ranged(7, 2, "h", "z"), // overlapping, both have to be searched
+	}})
+
+	numbers := func(tables []Table) []uint64 {
+		result := make([]uint64, 0)
+		for _, table := range tables {
+			result = append(result, table.Number)
+		}
+		return result
+	}
+
+	if got := numbers(version.Candidates("l", 3)); !reflect.DeepEqual(got, []uint64{2, 1, 4, 7}) {
+		t.Fatalf("wrong candidates for l: %v", got)
+	}
+	if got := numbers(version.Candidates("i", 3)); !reflect.DeepEqual(got, []uint64{1, 4, 7, 6}) {
+		t.Fatalf("wrong candidates for i: %v", got)
+	}
+	if got := numbers(version.Candidates("pz", 2)); !reflect.DeepEqual(got, []uint64{2}) {
+		t.Fatalf("key between two level 1 tables matched one of them: %v", got)
+	}
+}
@@ -2,20 +2,25 @@ package memtable
 
 import (
 	btree "nosql-engine/packages/utils/btree"
+	concurrentskiplist "nosql-engine/packages/utils/concurrent-skip-list"
 	database_elem "nosql-engine/packages/utils/database-elem"
 
 	generic_types "nosql-engine/packages/utils/generic-types"
 	skiplist "nosql-engine/packages/utils/skip-list"
 	"nosql-engine/packages/utils/sstable"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type MemTable struct {
 	structType   string
 	maxCapacity  int
-	capacity     int
+	capacity     atomic.Int64
+	lock         sync.RWMutex // writers of the concurrent skip list share it, flushes and the other structures take it alone
 	tree         *btree.BTree
 	list         *skiplist.SkipList
+	concList     *concurrentskiplist.SkipList
 	summaryCount int
 	sstableMode  string
 }
@@ -32,7 +37,6 @@ func New(capacity int, structType string, max uint64, min uint64, summaryCount i
 		return &MemTable{
 			structType:   structType,
 			maxCapacity:  capacity,
-			capacity:     0,
 			tree:         btree.Init(int(min), int(max)),
 			list:         nil,
 			summaryCount: summaryCount,
@@ -42,12 +46,21 @@ func New(capacity int, structType string, max uint64, min uint64, summaryCount i
 		return &MemTable{
 			structType:   structType,
 			maxCapacity:  capacity,
-			capacity:     0,
 			tree:         nil,
 			list:         skiplist.New(int(max)),
 			summaryCount: summaryCount,
 			sstableMode:  sstableMode,
 		}
+	} else if structType == "concurrent-skiplist" {
+		return &MemTable{
+			structType:   structType,
+			maxCapacity:  capacity,
+			tree:         nil,
+			list:         nil,
+			concList:     concurrentskiplist.New(int(max)),
+			summaryCount: summaryCount,
+			sstableMode:  sstableMode,
+		}
 	} else {
 		panic("Invalid structType!")
 	}
@@ -57,7 +70,7 @@ func (mt *MemTable) insertSkipList(key string, elem database_elem.DatabaseElem)
 	res := mt.list.Add(key, elem)
 
 	if res {
-		mt.capacity++
+		mt.capacity.Add(1)
 	}
 }
 
@@ -65,19 +78,52 @@ func (mt *MemTable) insertBTree(key string, elem database_elem.DatabaseElem) {
 	res := mt.tree.Set(key, elem)
 
 	if res {
-		mt.capacity++
+		mt.capacity.Add(1)
 	}
 }
 
-func (mt *MemTable) Insert(key string, elem database_elem.DatabaseElem) {
-	if mt.structType == "btree" {
-		mt.insertBTree(key, elem)
+func (mt *MemTable) insertConcSkipList(key string, elem database_elem.DatabaseElem) {
+	res := mt.concList.Add(key, elem)
+
+	if res {
+		mt.capacity.Add(1)
 	}
-	if mt.structType == "skiplist" {
-		mt.insertSkipList(key, elem)
+}
+
+func (mt *MemTable) Insert(key string, elem database_elem.DatabaseElem) {
+	mt.write(func() {
+		if mt.structType == "btree" {
+			mt.insertBTree(key, elem)
+		}
+		if mt.structType == "skiplist" {
+			mt.insertSkipList(key, elem)
+		}
+		if mt.structType == "concurrent-skiplist" {
+			mt.insertConcSkipList(key, elem)
+		}
+	})
+}
+
+// runs the write under the lock and flushes once the memtable is full. The concurrent skip list takes
+// writers at the same time, only one of them flushes and swaps it for an empty one
+func (mt *MemTable) write(fn func()) {
+	if mt.structType == "concurrent-skiplist" {
+		mt.lock.RLock()
+		fn()
+		mt.lock.RUnlock()
+	} else {
+		mt.lock.Lock()
+		fn()
+		mt.lock.Unlock()
 	}
-	if mt.capacity >= mt.maxCapacity {
-		mt.Flush()
+
+	if mt.capacity.Load() >= int64(mt.maxCapacity) {
+		mt.lock.Lock()
+		// another writer may have flushed meanwhile
+		if mt.capacity.Load() >= int64(mt.maxCapacity) {
+			mt.flush()
+		}
+		mt.lock.Unlock()
 	}
 }
 
@@ -90,11 +136,7 @@ func (mt *MemTable) deleteBTree(key string) {
 	} else {
 		deletedElem := &database_elem.DatabaseElem{Tombstone: 1, Value: []byte(""), Timestamp: uint64(time.Now().Unix())}
 		mt.tree.Set(key, *deletedElem)
-		mt.capacity++
-	}
-
-	if mt.capacity >= mt.maxCapacity {
-		mt.Flush()
+		mt.capacity.Add(1)
 	}
 }
 
@@ -102,20 +144,28 @@ func (mt *MemTable) deleteSkipList(key string) {
 	res := mt.list.Remove(key)
 
 	if res {
-		mt.capacity++
+		mt.capacity.Add(1)
 	}
+}
+
+func (mt *MemTable) deleteConcSkipList(key string) {
+	res := mt.concList.Remove(key, uint64(time.Now().Unix()))
 
-	if mt.capacity >= mt.maxCapacity {
-		mt.Flush()
+	if res {
+		mt.capacity.Add(1)
 	}
 }
 
 func (mt *MemTable) Delete(key string) {
-	if mt.structType == "btree" {
-		mt.deleteBTree(key)
-	} else if mt.structType == "skiplist" {
-		mt.deleteSkipList(key)
-	}
+	mt.write(func() {
+		if mt.structType == "btree" {
+			mt.deleteBTree(key)
+		} else if mt.structType == "skiplist" {
+			mt.deleteSkipList(key)
+		} else if mt.structType == "concurrent-skiplist" {
+			mt.deleteConcSkipList(key)
+		}
+	})
 }
 
 func (mt *MemTable) findBTree(key string) (found bool, elem generic_types.KeyVal[string, database_elem.DatabaseElem]) {
@@ -143,17 +193,48 @@ func (mt *MemTable) findSkipList(key string) (found bool, elem generic_types.Key
 	return
 }
 
+func (mt *MemTable) findConcSkipList(key string) (found bool, elem generic_types.KeyVal[string, database_elem.DatabaseElem]) {
+	value := mt.concList.Find(key)
+	elem.Key = key
+
+	if value == nil {
+		found = false
+		elem.Value = database_elem.DatabaseElem{
+			Tombstone: 0,
+			Value:     []byte(""),
+			Timestamp: 0,
+		}
+	} else {
+		found = true
+		elem.Value = *value
+	}
+
+	return
+}
+
 // First element returned is a boolean telling if the element was found, the second is a KeyValue pair
 // containing element info. Check if the tombstone is 0 before returning in read path!
 func (mt *MemTable) Find(key string) (bool, generic_types.KeyVal[string, database_elem.DatabaseElem]) {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
 	if mt.structType == "btree" {
 		return mt.findBTree(key)
+	} else if mt.structType == "concurrent-skiplist" {
+		return mt.findConcSkipList(key)
 	} else {
 		return mt.findSkipList(key)
 	}
 }
 
 func (mt *MemTable) Flush() {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	mt.flush()
+}
+
+// mt.lock has to be held alone
+func (mt *MemTable) flush() {
 	if mt.structType == "btree" {
 		prevMin := mt.tree.MinChildren
 		prevMax := mt.tree.MaxChildren
@@ -165,17 +246,27 @@ func (mt *MemTable) Flush() {
 		sstable.CreateSStable(mt.list.Flush(), mt.summaryCount, "data/usertables", 0, mt.sstableMode)
 		mt.list = skiplist.New(prevMax)
 	}
+	if mt.structType == "concurrent-skiplist" {
+		prevMax := mt.concList.MaxHeight
+		sstable.CreateSStable(mt.concList.Flush(), mt.summaryCount, "data/usertables", 0, mt.sstableMode)
+		mt.concList = concurrentskiplist.New(prevMax)
+	}
 
-	mt.capacity = 0
+	mt.capacity.Store(0)
 }
 
 func (mt *MemTable) CheckFlushed() bool {
-	return mt.capacity == 0
+	return mt.capacity.Load() == 0
 }
 
 func (mt *MemTable) AllElements() []generic_types.KeyVal[string, database_elem.DatabaseElem] {
+	mt.lock.RLock()
+	defer mt.lock.RUnlock()
+
 	if mt.structType == "btree" {
 		return mt.tree.SortedSlice()
+	} else if mt.structType == "concurrent-skiplist" {
+		return mt.concList.Flush()
 	} else {
 		return mt.list.Flush()
 	}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"math/rand"
 	database_elem "nosql-engine/packages/utils/database-elem"
+	"nosql-engine/packages/utils/sstable"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -26,12 +29,13 @@ func TestMemTable(t *testing.T) {
 
 	memtableTree := New(capacity, "btree", 4, 2, 3, "many")
 	memtableList := New(capacity, "skiplist", 32, 0, 3, "many")
+	memtableConcList := New(capacity, "concurrent-skiplist", 32, 0, 3, "many")
 
 	randomStr := make([]string, elementsCnt)
 	for i := 0; i < elementsCnt; i++ {
 		// testing for flush
 		if i != 0 && i%capacity == 0 {
-			if memtableList.capacity != 0 || memtableTree.capacity != 0 {
+			if memtableList.capacity.Load() != 0 || memtableTree.capacity.Load() != 0 || memtableConcList.capacity.Load() != 0 {
 				t.Fatalf("Flush didn't happen!")
 			}
 		}
@@ -47,6 +51,11 @@ func TestMemTable(t *testing.T) {
 			Tombstone: 0,
 			Timestamp: uint64(time.Now().Unix()),
 		})
+		memtableConcList.Insert(randomStr[i], database_elem.DatabaseElem{
+			Value:     []byte(randomStr[i]),
+			Tombstone: 0,
+			Timestamp: uint64(time.Now().Unix()),
+		})
 	}
 
 	// test finding
@@ -62,12 +71,19 @@ func TestMemTable(t *testing.T) {
 		if found && i < elementsCnt-(elementsCnt%capacity)-1 {
 			t.Fatalf("MemtableList find failed for key " + randomStr[i])
 		}
+
+		found, _ = memtableConcList.Find(randomStr[i])
+
+		if found && i < elementsCnt-(elementsCnt%capacity)-1 {
+			t.Fatalf("MemtableConcList find failed for key " + randomStr[i])
+		}
 	}
 
 	// test deleting
 	for i := elementsCnt - (elementsCnt % capacity) - 1; i < elementsCnt; i++ {
 		memtableList.Delete(randomStr[i])
 		memtableTree.Delete(randomStr[i])
+		memtableConcList.Delete(randomStr[i])
 
 		found, keyval := memtableList.Find(randomStr[i])
 
@@ -80,25 +96,78 @@ func TestMemTable(t *testing.T) {
 		if !found || keyval.Value.Tombstone != 1 {
 			t.Fatalf("MemtableTree delete failed for key " + randomStr[i])
 		}
+
+		found, keyval = memtableConcList.Find(randomStr[i])
+
+		if !found || keyval.Value.Tombstone != 1 {
+			t.Fatalf("MemtableConcList delete failed for key " + randomStr[i])
+		}
 	}
 
-	capacityBefore := memtableList.capacity
+	capacityBefore := int(memtableList.capacity.Load())
 	for i := 0; i < memtableList.maxCapacity-capacityBefore; i++ {
 		memtableList.Delete(randomStr[i])
 	}
 
-	if memtableList.capacity != 0 {
-		t.Fatalf("MemtableList delete failed! " + fmt.Sprint(memtableList.capacity))
+	if memtableList.capacity.Load() != 0 {
+		t.Fatalf("MemtableList delete failed! " + fmt.Sprint(memtableList.capacity.Load()))
 	}
 
-	capacityBefore = memtableTree.capacity
+	capacityBefore = int(memtableTree.capacity.Load())
 	for i := 0; i < memtableTree.maxCapacity-capacityBefore; i++ {
 		memtableTree.Delete(randomStr[i])
 	}
 
-	if memtableTree.capacity != 0 {
-		t.Fatalf("MemtableTree delete failed! " + fmt.Sprint(memtableTree.capacity))
+	if memtableTree.capacity.Load() != 0 {
+		t.Fatalf("MemtableTree delete failed! " + fmt.Sprint(memtableTree.capacity.Load()))
+	}
+
+	capacityBefore = int(memtableConcList.capacity.Load())
+	for i := 0; i < memtableConcList.maxCapacity-capacityBefore; i++ {
+		memtableConcList.Delete(randomStr[i])
+	}
+
+	if memtableConcList.capacity.Load() != 0 {
+		t.Fatalf("MemtableConcList delete failed! " + fmt.Sprint(memtableConcList.capacity.Load()))
 	}
 
 	os.RemoveAll("./data")
 }
+
+// run with -race, writers fill the memtable at the same time and one of them flushes it whenever it is full
+func TestMemTableConcurrent(t *testing.T) {
+	defer os.RemoveAll("./data")
+	writers := 8
+	perWriter := 100
+	memtable := New(50, "concurrent-skiplist", 32, 0, 3, "many")
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := "key" + strconv.Itoa(w) + "_" + strconv.Itoa(i)
+				memtable.Insert(key, database_elem.DatabaseElem{Value: []byte(key), Timestamp: uint64(time.Now().Unix())})
+				memtable.Find(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// no record got lost in a flush
+	for w := 0; w < writers; w++ {
+		for i := 0; i < perWriter; i++ {
+			key := "key" + strconv.Itoa(w) + "_" + strconv.Itoa(i)
+			if found, _ := memtable.Find(key); found {
+				continue
+			}
+			if found, _ := sstable.Find(key, "data/usertables", 1, "many"); !found {
+				t.Fatalf("%s was lost", key)
+			}
+		}
+	}
+	if memtable.capacity.Load() >= 50 {
+		t.Fatalf("full memtable wasn't flushed, it holds %d records", memtable.capacity.Load())
+	}
+}
@@ -0,0 +1,175 @@
+package prefixextractor
+
+import (
+	"nosql-engine/packages/utils/config"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Extractor picks the part of a key prefix filters are built from. It gets the key without its keyspace.
+// If a string is in the domain, every string starting with it has to be too and has to give the same prefix,
+// a prefix scan can then look up the prefix of what it scans for instead of the prefixes of the keys
+type Extractor interface {
+	Extract(key string) (string, bool) // false if the key is out of the domain and isn't in the filter
+	Name() string                      // stored with the tables, filters built by another extractor aren't used
+}
+
+type fixed struct {
+	length int
+}
+
+// the first length bytes, shorter keys are out of the domain
+func Fixed(length int) Extractor {
+	return fixed{length: length}
+}
+
+func (e fixed) Extract(key string) (string, bool) {
+	if len(key) < e.length {
+		return "", false
+	}
+	return key[:e.length], true
+}
+
+func (e fixed) Name() string {
+	return "fixed:" + strconv.Itoa(e.length)
+}
+
+type delimited struct {
+	delimiter string
+}
+
+// everything up to and including the first delimiter, keys without it are out of the domain
+func Delimiter(delimiter string) Extractor {
+	return delimited{delimiter: delimiter}
+}
+
+func (e delimited) Extract(key string) (string, bool) {
+	if e.delimiter == "" {
+		return "", false
+	}
+	i := strings.Index(key, e.delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return key[:i+len(e.delimiter)], true
+}
+
+func (e delimited) Name() string {
+	return "delimiter:" + strconv.Quote(e.delimiter)
+}
+
+// extractor described by the config, nil if its type is unknown
+func FromConfig(c config.PrefixExtractor) Extractor {
+	switch c.Type {
+	case "fixed":
+		return Fixed(int(c.Length))
+	case "delimiter":
+		return Delimiter(c.Delimiter)
+	}
+	return nil
+}
+
+// Set is the extractors of all keyspaces at one point, it doesn't change once it is made
+type Set struct {
+	extractors map[string]Extractor
+	name       string
+}
+
+var (
+	current     = &Set{extractors: make(map[string]Extractor)}
+	currentLock sync.Mutex
+)
+
+// extractor for the keys starting with keyspace, "" for all keys. Of several matching keyspaces the longest one is used
+func Register(keyspace string, extractor Extractor) {
+	update(func(extractors map[string]Extractor) {
+		extractors[keyspace] = extractor
+	})
+}
+
+func Unregister(keyspace string) {
+	update(func(extractors map[string]Extractor) {
+		delete(extractors, keyspace)
+	})
+}
+
+// tables being written keep the set they started with, so changes make a new one
+func update(fn func(extractors map[string]Extractor)) {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+
+	extractors := make(map[string]Extractor)
+	for keyspace, extractor := range current.extractors {
+		extractors[keyspace] = extractor
+	}
+	fn(extractors)
+	current = newSet(extractors)
+}
+
+func newSet(extractors map[string]Extractor) *Set {
+	keyspaces := make([]string, 0, len(extractors))
+	for keyspace := range extractors {
+		keyspaces = append(keyspaces, keyspace)
+	}
+	sort.Strings(keyspaces)
+
+	parts := make([]string, len(keyspaces))
+	for i, keyspace := range keyspaces {
+		parts[i] = strconv.Quote(keyspace) + "=" + extractors[keyspace].Name()
+	}
+	return &Set{extractors: extractors, name: strings.Join(parts, ";")}
+}
+
+func Current() *Set {
+	currentLock.Lock()
+	defer currentLock.Unlock()
+	return current
+}
+
+// describes all extractors of the set, "" if there are none
+func (s *Set) Name() string {
+	return s.name
+}
+
+func (s *Set) Empty() bool {
+	return len(s.extractors) == 0
+}
+
+func (s *Set) lookup(key string) (string, Extractor) {
+	keyspace, found := "", Extractor(nil)
+	longest := -1
+	for ks, extractor := range s.extractors {
+		if len(ks) > longest && strings.HasPrefix(key, ks) {
+			keyspace, found, longest = ks, extractor, len(ks)
+		}
+	}
+	return keyspace, found
+}
+
+// prefix of the key that goes into the filter, it starts with the keyspace.
+// false if no keyspace has the key or its extractor leaves it out
+func (s *Set) Extract(key string) (string, bool) {
+	keyspace, extractor := s.lookup(key)
+	if extractor == nil {
+		return "", false
+	}
+	prefix, ok := extractor.Extract(key[len(keyspace):])
+	if !ok {
+		return "", false
+	}
+	return keyspace + prefix, true
+}
+
+// what a scan for all keys starting with prefix looks up in the filters. false if the keys can have
+// different prefixes, then the filters can't rule anything out
+func (s *Set) ForPrefix(prefix string) (string, bool) {
+	// a longer keyspace starting with the prefix would extract some of the keys in another way
+	for keyspace := range s.extractors {
+		if len(keyspace) > len(prefix) && strings.HasPrefix(keyspace, prefix) {
+			return "", false
+		}
+	}
+	return s.Extract(prefix)
+}
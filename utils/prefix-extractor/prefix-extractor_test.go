@@ -0,0 +1,58 @@
+package prefixextractor
+
+import (
+	"nosql-engine/packages/utils/config"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	Register("user:", Delimiter(":"))
+	Register("user:log/", Fixed(4))
+	defer Unregister("user:")
+	defer Unregister("user:log/")
+	set := Current()
+
+	cases := []struct {
+		key    string
+		prefix string
+		ok     bool
+	}{
+		{"user:42:profile", "user:42:", true},
+		{"user:42", "", false},
+		{"user:log/2024-01-01", "user:log/2024", true}, // the longest keyspace wins
+		{"user:log/20", "", false},
+		{"other:42:profile", "", false},
+	}
+	for _, c := range cases {
+		if prefix, ok := set.Extract(c.key); prefix != c.prefix || ok != c.ok {
+			t.Fatalf("%s gave %q %v instead of %q %v", c.key, prefix, ok, c.prefix, c.ok)
+		}
+	}
+
+	if prefix, ok := set.ForPrefix("user:42:pro"); !ok || prefix != "user:42:" {
+		t.Fatalf("scan of user:42:pro looks up %q %v", prefix, ok)
+	}
+	// keys starting with "user:lo" can belong to either keyspace
+	if _, ok := set.ForPrefix("user:lo"); ok {
+		t.Fatalf("scan across two keyspaces used the filters")
+	}
+}
+
+func TestName(t *testing.T) {
+	before := Current()
+	Register("a", FromConfig(config.PrefixExtractor{Type: "fixed", Length: 3}))
+	Register("b", FromConfig(config.PrefixExtractor{Type: "delimiter", Delimiter: "/"}))
+	after := Current()
+	defer Unregister("a")
+	defer Unregister("b")
+
+	if before.Name() != "" || !before.Empty() {
+		t.Fatalf("a set made before Register changed")
+	}
+	if after.Name() != `"a"=fixed:3;"b"=delimiter:"/"` {
+		t.Fatalf("wrong name %s", after.Name())
+	}
+	if FromConfig(config.PrefixExtractor{Type: "regex"}) != nil {
+		t.Fatalf("unknown extractor type was accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package rangefilter
+
+import (
+	"encoding/binary"
+	"io"
+	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	"os"
+)
+
+const (
+	MAX_PROBES = 4096 // filter lookups one query may take, past them it gives up and can't rule the range out
+
+	PREFIX_TAG = 0 // entry for "some key starts with these nibbles"
+	KEY_TAG    = 1 // entry for "this is a whole key"
+)
+
+// RangeFilter tells if a set of keys may have one in [start, end]. It is a bloom filter of every prefix
+// of the keys up to depth bytes, together with the keys shorter than that. Prefixes grow half a byte at
+// a time. A query walks the prefixes from the shortest one down: a prefix that is in the filter and lies
+// in the range is followed down to a whole key or to depth, so one false positive doesn't make the whole
+// range look taken. With 16 children per prefix a false positive rarely leads to another one below it,
+// with 256 it would almost always do
+type RangeFilter struct {
+	depth   int
+	entries int
+	bf      *bloomfilter.BloomFilter
+}
+
+// filter of the keys, they have to be sorted. Every entry gets about bitsPerKey bits
+func New(keys []string, depth int, bitsPerKey float64) *RangeFilter {
+	entries := make([]string, 0, len(keys))
+	last := ""
+	levels := 2 * depth
+	for _, key := range keys {
+		key = nibbles(key)
+		// prefixes up to the common one with the previous key are in already
+		common := 0
+		for common < len(key) && common < len(last) && common < levels && key[common] == last[common] {
+			common++
+		}
+		for length := common + 1; length <= len(key) && length <= levels; length++ {
+			entries = append(entries, entry(PREFIX_TAG, key[:length]))
+		}
+		if len(key) < levels {
+			entries = append(entries, entry(KEY_TAG, key))
+		}
+		last = key
+	}
+
+	bf := bloomfilter.NewBlocked(len(entries), bitsPerKey)
+	for _, e := range entries {
+		bf.Add(e)
+	}
+	return &RangeFilter{depth: depth, entries: len(entries), bf: bf}
+}
+
+// every byte becomes its two halves, so prefixes of the result are prefixes of the key cut at half bytes.
+// The order of strings stays the same
+func nibbles(key string) string {
+	ret := make([]byte, 0, 2*len(key))
+	for i := 0; i < len(key); i++ {
+		ret = append(ret, key[i]>>4, key[i]&0x0F)
+	}
+	return string(ret)
+}
+
+func entry(tag byte, key string) string {
+	return string([]byte{tag}) + key
+}
+
+// false only if no key is in [start, end]
+func (f *RangeFilter) MayContain(start, end string) bool {
+	if start > end {
+		return false
+	}
+	probes := 0
+	return f.explore("", nibbles(start), nibbles(end), &probes)
+}
+
+// some key starts with prefix and strings starting with it are in the range, is one of those keys in it too.
+// All strings are halved into nibbles
+func (f *RangeFilter) explore(prefix, start, end string, probes *int) bool {
+	// longer prefixes aren't in the filter
+	if len(prefix) >= 2*f.depth {
+		return true
+	}
+	if prefix >= start && prefix <= end && f.find(KEY_TAG, prefix, probes) {
+		return true
+	}
+
+	// nibbles after the prefix that keep the strings in the range, only the bounds themselves limit them
+	low, high := 0, 15
+	if len(start) > len(prefix) && start[:len(prefix)] == prefix {
+		low = int(start[len(prefix)])
+	}
+	if len(end) >= len(prefix) && end[:len(prefix)] == prefix {
+		if len(end) == len(prefix) {
+			return false
+		}
+		high = int(end[len(prefix)])
+	}
+
+	for b := low; b <= high; b++ {
+		if *probes >= MAX_PROBES {
+			return true
+		}
+		child := prefix + string([]byte{byte(b)})
+		if f.find(PREFIX_TAG, child, probes) && f.explore(child, start, end, probes) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *RangeFilter) find(tag byte, key string, probes *int) bool {
+	*probes++
+	return f.bf.Find(entry(tag, key))
+}
+
+// bytes the filter takes on disk
+func (f *RangeFilter) Size() uint64 {
+	return 4 + 8 + f.bf.Size()
+}
+
+// false positive rate of one lookup in the underlying bloom filter, a range query takes several of them
+func (f *RangeFilter) FalsePositiveRate() float64 {
+	return f.bf.FalsePositiveRate(f.entries)
+}
+
+func (f *RangeFilter) Depth() int {
+	return f.depth
+}
+
+// File structure is 4 bytes for the depth, 8 for the number of entries and the serialized bloom filter
+func (f *RangeFilter) MakeFile(path string, filename string, mode string) uint64 {
+	_, err := os.ReadDir(path)
+	if os.IsNotExist(err) {
+		os.MkdirAll(path, os.ModePerm)
+	} else if err != nil {
+		panic(err)
+	}
+	var file *os.File
+	var start int64
+	if mode == "many" {
+		file, err = os.Create(path + filename)
+	} else {
+		file, err = os.OpenFile(path+filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		start, _ = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	file.Write(f.Serialize())
+	file.Close()
+	return uint64(start)
+}
+
+func (f *RangeFilter) Serialize() []byte {
+	ret := make([]byte, 0, f.Size())
+	ret = binary.BigEndian.AppendUint32(ret, uint32(f.depth))
+	ret = binary.BigEndian.AppendUint64(ret, uint64(f.entries))
+	return append(ret, f.bf.Serialize()...)
+}
+
+func Deserialize(byteArr []byte) *RangeFilter {
+	return &RangeFilter{
+		depth:   int(binary.BigEndian.Uint32(byteArr[0:4])),
+		entries: int(binary.BigEndian.Uint64(byteArr[4:12])),
+		bf:      bloomfilter.Deserialize(byteArr[12:]),
+	}
+}
+
+// reads the filter that starts at fileOffset, size is what Size returned when it was written
+func NewFromFile(name string, fileOffset uint64, size uint64) *RangeFilter {
+	file, err := os.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	buffer := make([]byte, size)
+	if _, err := file.ReadAt(buffer, int64(fileOffset)); err != nil {
+		panic(err)
+	}
+	return Deserialize(buffer)
+}
@@ -0,0 +1,74 @@
+package rangefilter
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestRangeFilter(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	keys := make([]string, 0)
+	for i := 0; i < 2000; i++ {
+		// even numbers only, the odd ones in between are the empty ranges
+		keys = append(keys, fmt.Sprintf("user:%08d", 2*random.Intn(1000000)))
+	}
+	keys = append(keys, "a", "ab", "user:00000002:with-a-long-suffix-past-the-depth")
+	sort.Strings(keys)
+	keys = dedupe(keys)
+	filter := New(keys, 12, 10)
+
+	for i, key := range keys {
+		if !filter.MayContain(key, key) {
+			t.Fatalf("%s isn't in [%s, %s]", key, key, key)
+		}
+		if i > 0 && !filter.MayContain(keys[i-1]+"\x00", key) {
+			t.Fatalf("%s isn't in the range up to it", key)
+		}
+	}
+	if !filter.MayContain("user:00000002:w", "user:00000002:x") {
+		t.Fatalf("key longer than the depth was missed")
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		odd := fmt.Sprintf("user:%08d", 2*random.Intn(1000000)+1)
+		if sort.SearchStrings(keys, odd) < len(keys) && keys[sort.SearchStrings(keys, odd)] == odd {
+			continue
+		}
+		if filter.MayContain(odd, odd+"\xff") {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Fatalf("%d of 1000 empty ranges weren't ruled out", falsePositives)
+	}
+	if filter.MayContain("b", "c") || filter.MayContain("user:99999999", "z") {
+		t.Fatalf("range past all keys wasn't ruled out")
+	}
+
+	path := "../../data/filter/"
+	offset := filter.MakeFile(path, "testRangeFilter.bin", "one")
+	read := NewFromFile(path+"testRangeFilter.bin", offset, filter.Size())
+	for _, key := range keys {
+		if !read.MayContain(key, key) {
+			t.Fatalf("%s isn't in the filter read back", key)
+		}
+	}
+	if read.Depth() != 12 || read.FalsePositiveRate() != filter.FalsePositiveRate() {
+		t.Fatalf("filter read back differs")
+	}
+	os.RemoveAll("../../data/")
+}
+
+func dedupe(keys []string) []string {
+	ret := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
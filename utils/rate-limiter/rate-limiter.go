@@ -0,0 +1,160 @@
+package ratelimiter
+
+import (
+	"nosql-engine/packages/utils/config"
+	"sync"
+	"time"
+)
+
+const (
+	FLUSH      = "flush"
+	COMPACTION = "compaction"
+
+	BURST                 = 100 * time.Millisecond // bytes that can go at once without waiting, as time at the current rate
+	TUNE_INTERVAL         = time.Second
+	TUNE_DOWN             = 0.8 // rate is multiplied by this when foreground latency is over the target
+	TUNE_UP               = 1.25
+	DEFAULT_AUTO_TUNE_MIN = 1 << 20
+	DEFAULT_AUTO_TUNE_MAX = 256 << 20
+)
+
+// Limiter lets through a number of bytes per second, callers that go over it wait
+type Limiter struct {
+	lock   sync.Mutex
+	rate   uint64 // bytes per second, 0 means no limit
+	tokens float64
+	last   time.Time
+
+	// auto-tune moves the rate between min and max to keep foreground latency under target
+	target       time.Duration
+	min, max     uint64
+	latencySum   time.Duration
+	latencyCount uint64
+	tunedAt      time.Time
+}
+
+var (
+	limiters     map[string]*Limiter
+	limitersOnce sync.Once
+)
+
+func New(rate uint64) *Limiter {
+	return &Limiter{rate: rate, tokens: BURST.Seconds() * float64(rate), last: time.Now(), tunedAt: time.Now()}
+}
+
+// shared limiter of flushes or compactions, FLUSH or COMPACTION. Both start from the config
+func Get(kind string) *Limiter {
+	limitersOnce.Do(func() {
+		cfg := config.GetConfig()
+		limiters = map[string]*Limiter{
+			FLUSH:      New(cfg.FlushRateLimit),
+			COMPACTION: New(cfg.CompactionRateLimit),
+		}
+		if cfg.RateLimitAutoTune {
+			limiters[COMPACTION].SetAutoTune(time.Duration(cfg.RateLimitTargetLatency)*time.Microsecond, cfg.CompactionRateLimitMin, cfg.CompactionRateLimit)
+		}
+	})
+	return limiters[kind]
+}
+
+// reports how long a foreground read or write took, compaction is slowed down while they take too long
+func ObserveLatency(latency time.Duration) {
+	Get(COMPACTION).ObserveLatency(latency)
+}
+
+func (l *Limiter) Rate() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// 0 turns the limit off. A rate set by hand turns auto-tune off too, it would move the rate away again
+func (l *Limiter) SetRate(rate uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.refill()
+	l.rate = rate
+	l.target = 0
+}
+
+// target 0 turns auto-tune off and leaves the rate where it is.
+// max 0 means DEFAULT_AUTO_TUNE_MAX, min 0 means DEFAULT_AUTO_TUNE_MIN
+func (l *Limiter) SetAutoTune(target time.Duration, min, max uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if min == 0 {
+		min = DEFAULT_AUTO_TUNE_MIN
+	}
+	if max == 0 {
+		max = DEFAULT_AUTO_TUNE_MAX
+	}
+	if max < min {
+		max = min
+	}
+	l.target, l.min, l.max = target, min, max
+	l.latencySum, l.latencyCount, l.tunedAt = 0, 0, time.Now()
+
+	if target > 0 && (l.rate == 0 || l.rate > max) {
+		l.rate = max
+	}
+}
+
+func (l *Limiter) ObserveLatency(latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.target == 0 {
+		return
+	}
+	l.latencySum += latency
+	l.latencyCount++
+
+	if time.Since(l.tunedAt) < TUNE_INTERVAL {
+		return
+	}
+	average := l.latencySum / time.Duration(l.latencyCount)
+	l.refill()
+	if average > l.target {
+		l.rate = uint64(float64(l.rate) * TUNE_DOWN)
+	} else if average < l.target/2 {
+		l.rate = uint64(float64(l.rate) * TUNE_UP)
+	}
+	if l.rate < l.min {
+		l.rate = l.min
+	}
+	if l.rate > l.max {
+		l.rate = l.max
+	}
+	l.latencySum, l.latencyCount, l.tunedAt = 0, 0, time.Now()
+}
+
+// takes the bytes from the budget, waiting if there aren't enough of them left
+func (l *Limiter) Request(bytes uint64) {
+	l.lock.Lock()
+	if l.rate == 0 {
+		l.lock.Unlock()
+		return
+	}
+	l.refill()
+	l.tokens -= float64(bytes)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.lock.Unlock()
+
+	// the debt is already taken, whoever comes next waits for it too
+	time.Sleep(wait)
+}
+
+// lock has to be held
+func (l *Limiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if burst := BURST.Seconds() * float64(l.rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+}
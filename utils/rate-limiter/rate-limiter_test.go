@@ -0,0 +1,65 @@
+package ratelimiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	rate := uint64(1 << 20)
+	limiter := New(rate)
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		limiter.Request(10 << 10)
+	}
+	// 300KB at 1MB/s, less the burst of 100ms
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("300KB at 1MB/s took %v", elapsed)
+	}
+
+	limiter.SetRate(0)
+	start = time.Now()
+	limiter.Request(1 << 30)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("request without a limit waited %v", elapsed)
+	}
+}
+
+func TestAutoTune(t *testing.T) {
+	limiter := New(0)
+	limiter.SetAutoTune(time.Millisecond, 1<<20, 8<<20)
+	if limiter.Rate() != 8<<20 {
+		t.Fatalf("auto-tune didn't start from the max rate: %d", limiter.Rate())
+	}
+
+	for i := 0; i < 20; i++ {
+		limiter.tunedAt = time.Now().Add(-TUNE_INTERVAL)
+		limiter.ObserveLatency(10 * time.Millisecond)
+	}
+	if limiter.Rate() != 1<<20 {
+		t.Fatalf("slow foreground didn't bring the rate down to the min: %d", limiter.Rate())
+	}
+
+	limiter.tunedAt = time.Now().Add(-TUNE_INTERVAL)
+	limiter.ObserveLatency(10 * time.Microsecond)
+	if limiter.Rate() <= 1<<20 {
+		t.Fatalf("fast foreground didn't raise the rate: %d", limiter.Rate())
+	}
+}
+
+func TestSetRateStopsAutoTune(t *testing.T) {
+	for _, rate := range []uint64{0, 512 << 10} {
+		limiter := New(0)
+		limiter.SetAutoTune(time.Millisecond, 1<<20, 8<<20)
+		limiter.SetRate(rate)
+
+		for i := 0; i < 3; i++ {
+			limiter.tunedAt = time.Now().Add(-TUNE_INTERVAL)
+			limiter.ObserveLatency(10 * time.Millisecond)
+		}
+		if limiter.Rate() != rate {
+			t.Fatalf("auto-tune moved the rate set by hand from %d to %d", rate, limiter.Rate())
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"log"
+	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	"nosql-engine/packages/utils/compression"
+	"nosql-engine/packages/utils/config"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	GTypes "nosql-engine/packages/utils/generic-types"
+	"os"
+	"sort"
+)
+
+/*
+   Block mode Data.db layout:
+   +---------------+-----+---------------+---------------+--------------+--------------------------------+--------+
+   | Data block 0  | ... | Data block N  |  Index block  |    Filter    | Prefix and range filters (opt) | Footer |
+   +---------------+-----+---------------+---------------+--------------+--------------------------------+--------+
+
+   Every block is followed by a trailer: compression codec (1B) and CRC (4B) of the stored contents and the codec.
+   The codec is chosen per level when the table is written, blocks that don't shrink enough are stored raw,
+   so a table (or a level) can mix codecs and stays readable whatever the config says now.
+   Block contents are a list of prefix compressed entries, followed by the restart array:
+   +-------------------+---------------------+------------------+-----------------+-------+
+   | Shared (uvarint)  | Unshared (uvarint)  | Value size (uvarint) | Key delta   | Value |
+   +-------------------+---------------------+------------------+-----------------+-------+
+   ... | Restart 0 (4B) | ... | Restart K (4B) | Restart count (4B) |
+   Every RESTART_INTERVAL-th entry stores its whole key (Shared = 0) and its offset is a restart point,
+   so a block can be binary searched over the restart points and scanned linearly from there.
+
+   Data block value = Timestamp (8B) | Tombstone (1B) | Value
+   Index block has one entry per data block: key = last key of the block, value = Offset (8B) | Size (8B)
+   Footer is the common one from properties.go, tables written before it have
+   Index offset (8B) | Index size (8B) | Filter offset (8B) | BLOCK_MAGIC (8B) instead.
+*/
+
+const (
+	BLOCK_SIZE         = 4096
+	RESTART_INTERVAL   = 16
+	BLOCK_TRAILER_SIZE = 5
+	BLOCK_FOOTER_SIZE  = 32
+	BLOCK_MAGIC        = 0x6b636f6c62747373 // "sstblock"
+)
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+type blockBuilder struct {
+	buf             []byte
+	restarts        []uint32
+	counter         int
+	lastKey         string
+	restartInterval int
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	return &blockBuilder{
+		buf:             make([]byte, 0, BLOCK_SIZE),
+		restarts:        []uint32{0},
+		counter:         0,
+		lastKey:         "",
+		restartInterval: restartInterval,
+	}
+}
+
+func (b *blockBuilder) add(key string, value []byte) {
+	shared := 0
+	if b.counter < b.restartInterval {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+
+	b.buf = binary.AppendUvarint(b.buf, uint64(shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+
+	b.lastKey = key
+	b.counter++
+}
+
+func (b *blockBuilder) empty() bool {
+	return len(b.buf) == 0
+}
+
+func (b *blockBuilder) estimatedSize() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+func (b *blockBuilder) finish() []byte {
+	for _, restart := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, restart)
+	}
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+	return b.buf
+}
+
+func encodeBlockValue(elem database_elem.DatabaseElem) []byte {
+	value := make([]byte, 0, 9+len(elem.Value))
+	value = binary.LittleEndian.AppendUint64(value, elem.Timestamp)
+	value = append(value, elem.Tombstone)
+	value = append(value, elem.Value...)
+	return value
+}
+
+func decodeBlockValue(value []byte) database_elem.DatabaseElem {
+	elemValue := make([]byte, len(value)-9)
+	copy(elemValue, value[9:])
+	return database_elem.DatabaseElem{
+		Timestamp: binary.LittleEndian.Uint64(value[0:8]),
+		Tombstone: value[8],
+		Value:     elemValue,
+	}
+}
+
+func encodeBlockHandle(handle blockHandle) []byte {
+	value := make([]byte, 0, 16)
+	value = binary.LittleEndian.AppendUint64(value, handle.offset)
+	value = binary.LittleEndian.AppendUint64(value, handle.size)
+	return value
+}
+
+func decodeBlockHandle(value []byte) blockHandle {
+	return blockHandle{offset: binary.LittleEndian.Uint64(value[0:8]), size: binary.LittleEndian.Uint64(value[8:16])}
+}
+
+// compresses the block, writes it with its trailer and returns where it ended up
+func writeBlock(file *os.File, offset uint64, contents []byte, codec byte) blockHandle {
+	stored := contents
+	if codec != compression.NONE {
+		compressed := compression.Compress(codec, contents)
+		// not worth decompressing on every read if it saves less than 1/8
+		if len(compressed) < len(contents)-len(contents)/8 {
+			stored = compressed
+		} else {
+			codec = compression.NONE
+		}
+	}
+
+	block := make([]byte, 0, len(stored)+BLOCK_TRAILER_SIZE)
+	block = append(block, stored...)
+	block = append(block, codec)
+	block = binary.LittleEndian.AppendUint32(block, CRC32(block))
+	file.Write(block)
+
+	return blockHandle{offset: offset, size: uint64(len(stored))}
+}
+
+// codec for the blocks of tables on the given level, the last configured one is used for deeper levels
+func compressionForLevel(level int) byte {
+	codecs := config.GetConfig().BlockCompression
+	if len(codecs) == 0 {
+		return compression.NONE
+	}
+	if level >= len(codecs) {
+		level = len(codecs) - 1
+	}
+	return compression.CodecFromName(codecs[level])
+}
+
+// block mode table that is being built record by record
+type blockTableWriter struct {
+	props      *Properties
+	file       *os.File
+	codec      byte
+	bitsPerKey float64
+	offset     uint64
+	data       *blockBuilder
+	index      *blockBuilder
+	keys       []string
+	mtData     [][]byte
+	lastKey    string
+}
+
+func newBlockTableWriter(file *os.File, codec byte, bitsPerKey float64, props *Properties) *blockTableWriter {
+	return &blockTableWriter{
+		props:      props,
+		file:       file,
+		codec:      codec,
+		bitsPerKey: bitsPerKey,
+		offset:     0,
+		data:       newBlockBuilder(RESTART_INTERVAL),
+		index:      newBlockBuilder(1),
+		keys:       make([]string, 0),
+		mtData:     make([][]byte, 0),
+	}
+}
+
+func (w *blockTableWriter) add(key string, elem database_elem.DatabaseElem) {
+	w.data.add(key, encodeBlockValue(elem))
+	w.keys = append(w.keys, key)
+	w.lastKey = key
+
+	if w.data.estimatedSize() >= BLOCK_SIZE {
+		w.flushBlock()
+	}
+}
+
+func (w *blockTableWriter) flushBlock() {
+	if w.data.empty() {
+		return
+	}
+
+	contents := w.data.finish()
+	handle := writeBlock(w.file, w.offset, contents, w.codec)
+	w.offset += handle.size + BLOCK_TRAILER_SIZE
+	w.mtData = append(w.mtData, contents)
+	w.index.add(w.lastKey, encodeBlockHandle(handle))
+
+	w.data = newBlockBuilder(RESTART_INTERVAL)
+}
+
+// writes the index block, the filter and the footer, name is the table name with the prefix
+func (w *blockTableWriter) finish(prefix string, nameWithoutPrefix string) {
+	w.flushBlock()
+
+	indexHandle := writeBlock(w.file, w.offset, w.index.finish(), w.codec)
+	w.file.Close()
+
+	bf := bloomfilter.NewBlocked(len(w.keys), w.bitsPerKey)
+	for _, key := range w.keys {
+		bf.Add(key)
+	}
+	filterOffset := bf.MakeFile(prefix, nameWithoutPrefix+"Data.db", "one")
+	writePrefixFilter(newPrefixFilter(w.keys, w.bitsPerKey, w.props), prefix, nameWithoutPrefix, "block", w.props)
+	writeRangeFilter(newRangeFilter(w.keys, w.bitsPerKey), prefix, nameWithoutPrefix, "block", w.props)
+
+	w.props.DiskSize = fileSize(prefix + nameWithoutPrefix + "Data.db")
+	appendFooter(prefix+nameWithoutPrefix+"Data.db", footer{
+		format:       "block",
+		indexOffset:  indexHandle.offset,
+		indexSize:    indexHandle.size,
+		filterOffset: filterOffset,
+	}, w.props)
+
+	CreateMerkleFile(prefix+nameWithoutPrefix, w.mtData)
+	createTOCFile(prefix+nameWithoutPrefix, "block")
+}
+
+type blockTable struct {
+	filename     string
+	id           uint64 // of the file in the block cache
+	index        []GTypes.KeyVal[string, blockHandle]
+	filterOffset uint64
+}
+
+// the index block is read from m if the table is mapped, m is nil otherwise
+func openBlockTable(filename string, m *mappedFile) *blockTable {
+	f := mustReadFooter(filename)
+	if f.format != "block" {
+		log.Fatal(filename + ": not a block sstable")
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	indexHandle := blockHandle{offset: f.indexOffset, size: f.indexSize}
+	filterOffset := f.filterOffset
+
+	var contents []byte
+	if m != nil {
+		contents = readMappedBlock(m, indexHandle)
+	} else {
+		contents = readBlock(file, indexHandle)
+	}
+
+	// keys are copied, the index outlives the block
+	index := make([]GTypes.KeyVal[string, blockHandle], 0)
+	it := newBlockIter(contents)
+	for it.next() {
+		index = append(index, GTypes.KeyVal[string, blockHandle]{Key: string(it.key), Value: decodeBlockHandle(it.value)})
+	}
+
+	return &blockTable{filename: filename, id: mustFileID(filename), index: index, filterOffset: filterOffset}
+}
+
+func readBlock(file *os.File, handle blockHandle) []byte {
+	buffer := make([]byte, handle.size+BLOCK_TRAILER_SIZE)
+	_, err := file.ReadAt(buffer, int64(handle.offset))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	stored := buffer[:handle.size]
+	trailer := buffer[handle.size:]
+	if CRC32(buffer[:handle.size+1]) != binary.LittleEndian.Uint32(trailer[1:]) {
+		log.Fatal("crc not match values")
+	}
+
+	contents, err := compression.Decompress(trailer[0], stored)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return contents
+}
+
+// returns the number of the first block that can contain a key >= key
+func (t *blockTable) seekBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].Key >= key
+	})
+}
+
+func (t *blockTable) minKey(file *os.File) string {
+	if len(t.index) == 0 {
+		return ""
+	}
+	it := newBlockIter(t.cachedBlock(file, t.index[0].Value, true))
+	it.next()
+	return string(it.key)
+}
+
+func (t *blockTable) maxKey() string {
+	if len(t.index) == 0 {
+		return ""
+	}
+	return t.index[len(t.index)-1].Key
+}
+
+// blockIter walks the entries of a block without copying them, key and value point into the block (or into
+// buf for keys that share a prefix with the one before) and change with every entry
+type blockIter struct {
+	data     []byte // entries without the restart array
+	restarts []uint32
+	pos      int
+	key      []byte
+	value    []byte
+	buf      []byte
+}
+
+func newBlockIter(contents []byte) *blockIter {
+	count := binary.LittleEndian.Uint32(contents[len(contents)-4:])
+	restartsStart := len(contents) - 4 - 4*int(count)
+
+	restarts := make([]uint32, count)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(contents[restartsStart+4*i:])
+	}
+
+	return &blockIter{data: contents[:restartsStart], restarts: restarts, pos: 0}
+}
+
+// decodes the entry at the current position and moves past it
+func (it *blockIter) next() bool {
+	if it.pos >= len(it.data) {
+		return false
+	}
+
+	shared, n := binary.Uvarint(it.data[it.pos:])
+	it.pos += n
+	unshared, n := binary.Uvarint(it.data[it.pos:])
+	it.pos += n
+	valueSize, n := binary.Uvarint(it.data[it.pos:])
+	it.pos += n
+
+	delta := it.data[it.pos : it.pos+int(unshared)]
+	if shared == 0 {
+		it.key = delta
+	} else {
+		it.buf = append(append(it.buf[:0], it.key[:shared]...), delta...)
+		it.key = it.buf
+	}
+	it.pos += int(unshared)
+	it.value = it.data[it.pos : it.pos+int(valueSize)]
+	it.pos += int(valueSize)
+
+	return true
+}
+
+// key stored at a restart point, restart entries never share a prefix
+func (it *blockIter) restartKey(i int) []byte {
+	pos := int(it.restarts[i])
+	_, n := binary.Uvarint(it.data[pos:])
+	pos += n
+	unshared, n := binary.Uvarint(it.data[pos:])
+	pos += n
+	_, n = binary.Uvarint(it.data[pos:])
+	pos += n
+	return it.data[pos : pos+int(unshared)]
+}
+
+// positions the iterator on the first entry with key >= key, returns false if there is none
+func (it *blockIter) seek(key string) bool {
+	// last restart point with a key < key, the entry we are looking for is after it
+	// comparisons with a converted slice don't allocate
+	i := sort.Search(len(it.restarts), func(i int) bool {
+		return string(it.restartKey(i)) >= key
+	})
+	if i > 0 {
+		i--
+	}
+
+	it.pos = int(it.restarts[i])
+	it.key = nil
+	for it.next() {
+		if string(it.key) >= key {
+			return true
+		}
+	}
+	return false
+}
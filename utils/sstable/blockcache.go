@@ -0,0 +1,103 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"log"
+	blockcache "nosql-engine/packages/utils/block-cache"
+	"os"
+	"path/filepath"
+)
+
+const PAGE_SIZE = 4096 // "one" and "many" tables have no blocks, they are cached in pages of this size
+
+// id of a table file in the block cache. A file written again under the same name gets another id,
+// so blocks of a deleted table can't be served for a new one
+func fileID(filename string) (uint64, bool) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, false
+	}
+	buffer := make([]byte, 16)
+	binary.LittleEndian.PutUint64(buffer[0:8], uint64(info.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint64(buffer[8:16], uint64(info.Size()))
+
+	h := fnv.New64a()
+	h.Write([]byte(filepath.Clean(filename)))
+	h.Write(buffer)
+	return h.Sum64(), true
+}
+
+func mustFileID(filename string) uint64 {
+	id, ok := fileID(filename)
+	if !ok {
+		log.Fatal(filename + ": can't stat table file")
+	}
+	return id
+}
+
+// drops the blocks of the file from the cache, called before the file is deleted
+func evictBlocks(filename string) {
+	if id, ok := fileID(filename); ok {
+		blockcache.Shared().EvictTable(id)
+	}
+}
+
+// block of a "block" table, from the cache if it is there. fill puts blocks read from disk into the cache
+func (t *blockTable) cachedBlock(file *os.File, handle blockHandle, fill bool) []byte {
+	key := blockcache.Key{Table: t.id, Offset: handle.offset}
+	if block, ok := blockcache.Shared().Get(key); ok {
+		return block
+	}
+	block := readBlock(file, handle)
+	if fill {
+		blockcache.Shared().Insert(key, block)
+	}
+	return block
+}
+
+// pagedFile reads a "one" or "many" table file through the block cache a page at a time
+type pagedFile struct {
+	file *os.File
+	id   uint64
+	size uint64
+	fill bool // pages read from disk are put into the cache
+}
+
+func newPagedFile(file *os.File, filename string) *pagedFile {
+	return &pagedFile{file: file, id: mustFileID(filename), size: fileSize(filename), fill: true}
+}
+
+func (p *pagedFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(buffer) {
+		pos := uint64(offset) + uint64(n)
+		if pos >= p.size {
+			return n, io.EOF
+		}
+		page := p.page(pos - pos%PAGE_SIZE)
+		n += copy(buffer[n:], page[pos%PAGE_SIZE:])
+	}
+	return n, nil
+}
+
+func (p *pagedFile) page(offset uint64) []byte {
+	key := blockcache.Key{Table: p.id, Offset: offset}
+	if page, ok := blockcache.Shared().Get(key); ok {
+		return page
+	}
+
+	size := uint64(PAGE_SIZE)
+	if p.size-offset < size {
+		size = p.size - offset
+	}
+	page := make([]byte, size)
+	if _, err := p.file.ReadAt(page, int64(offset)); err != nil && err != io.EOF {
+		log.Fatal(err)
+	}
+	if p.fill {
+		blockcache.Shared().Insert(key, page)
+	}
+	return page
+}
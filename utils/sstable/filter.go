@@ -0,0 +1,215 @@
+package sstable
+
+import (
+	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	"nosql-engine/packages/utils/config"
+	prefixextractor "nosql-engine/packages/utils/prefix-extractor"
+	rangefilter "nosql-engine/packages/utils/range-filter"
+	"strings"
+	"sync"
+)
+
+const DEFAULT_BITS_PER_KEY = 10
+
+// FilterStats counts what the filters of one level did for point lookups, prefix and range scans
+type FilterStats struct {
+	Checks         uint64 // lookups that asked a filter
+	Negatives      uint64 // the filter ruled the key out and the table wasn't read
+	FalsePositives uint64 // the filter let the key through and the table didn't have it
+
+	PrefixChecks    uint64 // prefix scans that asked a prefix filter
+	PrefixNegatives uint64 // the prefix filter ruled the prefix out and the scan skipped the table
+
+	RangeChecks    uint64 // range scans that asked a range filter
+	RangeNegatives uint64 // the range filter ruled the range out and the scan skipped the table
+}
+
+// share of the lookups of missing keys the filters let through
+func (s FilterStats) FalsePositiveRate() float64 {
+	if s.Negatives+s.FalsePositives == 0 {
+		return 0
+	}
+	return float64(s.FalsePositives) / float64(s.Negatives+s.FalsePositives)
+}
+
+var (
+	filterStats     []FilterStats
+	filterStatsLock sync.Mutex
+)
+
+// stats of every level since the program started, index is the level
+func GetFilterStats() []FilterStats {
+	filterStatsLock.Lock()
+	defer filterStatsLock.Unlock()
+	return append([]FilterStats{}, filterStats...)
+}
+
+// stats of the level, filterStatsLock has to be held
+func levelFilterStats(level int) *FilterStats {
+	for len(filterStats) <= level {
+		filterStats = append(filterStats, FilterStats{})
+	}
+	return &filterStats[level]
+}
+
+func recordFilter(level int, passed bool, found bool) {
+	filterStatsLock.Lock()
+	defer filterStatsLock.Unlock()
+
+	stats := levelFilterStats(level)
+	stats.Checks++
+	if !passed {
+		stats.Negatives++
+	} else if !found {
+		stats.FalsePositives++
+	}
+}
+
+func recordPrefixFilter(level int, passed bool) {
+	filterStatsLock.Lock()
+	defer filterStatsLock.Unlock()
+
+	stats := levelFilterStats(level)
+	stats.PrefixChecks++
+	if !passed {
+		stats.PrefixNegatives++
+	}
+}
+
+func recordRangeFilter(level int, passed bool) {
+	filterStatsLock.Lock()
+	defer filterStatsLock.Unlock()
+
+	stats := levelFilterStats(level)
+	stats.RangeChecks++
+	if !passed {
+		stats.RangeNegatives++
+	}
+}
+
+// bits per key of filters on the given level, the last configured value is used for deeper levels.
+// Deeper levels hold most of the keys, a few bits less there save most of the memory
+func bitsPerKeyForLevel(level int) float64 {
+	bits := config.GetConfig().BloomBitsPerKey
+	if len(bits) == 0 {
+		return DEFAULT_BITS_PER_KEY
+	}
+	if level >= len(bits) {
+		level = len(bits) - 1
+	}
+	return bits[level]
+}
+
+// filter of a new table on the given level
+func newTableFilter(keys int, level int) *bloomfilter.BloomFilter {
+	return bloomfilter.NewBlocked(keys, bitsPerKeyForLevel(level))
+}
+
+// prefix filter of a new table, nil if no extractor is set. The extractors it is built with go into props
+func newPrefixFilter(keys []string, bitsPerKey float64, props *Properties) *bloomfilter.BloomFilter {
+	extractors := prefixextractor.Current()
+	if extractors.Empty() {
+		return nil
+	}
+
+	prefixes := make([]string, 0)
+	for _, key := range keys {
+		prefix, ok := extractors.Extract(key)
+		// keys come sorted, most keys with the same prefix are next to each other
+		if ok && (len(prefixes) == 0 || prefixes[len(prefixes)-1] != prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	// even with no prefixes at all the filter tells scans there is nothing for them
+	bf := bloomfilter.NewBlocked(len(prefixes), bitsPerKey)
+	for _, prefix := range prefixes {
+		bf.Add(prefix)
+	}
+	props.PrefixExtractor = extractors.Name()
+	return bf
+}
+
+// appends the prefix filter to the data file of "one" and "block" tables, "many" tables get a file of their own.
+// name is the table name without the prefix
+func writePrefixFilter(bf *bloomfilter.BloomFilter, prefix string, name string, mode string, props *Properties) {
+	if bf == nil {
+		return
+	}
+	if mode == "many" {
+		bf.MakeFile(prefix, name+"PrefixFilter.db", "many")
+		return
+	}
+	props.PrefixFilterOffset = bf.MakeFile(prefix, name+"Data.db", "one")
+}
+
+// prefix filter of a table, nil if it has none. dataFile is the name of its "Data file"
+func readPrefixFilter(dataFile string) (*bloomfilter.BloomFilter, string) {
+	props, err := ReadProperties(dataFile)
+	if err != nil || props.PrefixExtractor == "" {
+		return nil, ""
+	}
+	if props.Format == "many" {
+		return bloomfilter.NewFromFile(strings.TrimSuffix(dataFile, "Data.db")+"PrefixFilter.db", 0), props.PrefixExtractor
+	}
+	return bloomfilter.NewFromFile(dataFile, props.PrefixFilterOffset), props.PrefixExtractor
+}
+
+// false if the prefix filter of the table rules out every key starting with prefix. Tables without one,
+// or with one built by other extractors than the current ones, can't be ruled out
+func (r *tableReader) mayHavePrefix(prefix string, extractors *prefixextractor.Set) bool {
+	if r.prefixFilter == nil || r.prefixExtractor != extractors.Name() {
+		return true
+	}
+	filterKey, ok := extractors.ForPrefix(prefix)
+	if !ok {
+		return true
+	}
+	passed := r.prefixFilter.Find(filterKey)
+	recordPrefixFilter(r.level, passed)
+	return passed
+}
+
+// range filter of a new table, nil if range filters are off
+func newRangeFilter(keys []string, bitsPerKey float64) *rangefilter.RangeFilter {
+	depth := int(config.GetConfig().RangeFilterDepth)
+	if depth == 0 {
+		return nil
+	}
+	return rangefilter.New(keys, depth, bitsPerKey)
+}
+
+// same as writePrefixFilter, "many" tables keep it in RangeFilter.db
+func writeRangeFilter(rf *rangefilter.RangeFilter, prefix string, name string, mode string, props *Properties) {
+	if rf == nil {
+		return
+	}
+	props.RangeFilterSize = rf.Size()
+	props.RangeFilterFPR = rf.FalsePositiveRate()
+	if mode == "many" {
+		rf.MakeFile(prefix, name+"RangeFilter.db", "many")
+		return
+	}
+	props.RangeFilterOffset = rf.MakeFile(prefix, name+"Data.db", "one")
+}
+
+// range filter of a table, nil if it has none. dataFile is the name of its "Data file"
+func readRangeFilter(dataFile string) *rangefilter.RangeFilter {
+	props, err := ReadProperties(dataFile)
+	if err != nil || props.RangeFilterSize == 0 {
+		return nil
+	}
+	if props.Format == "many" {
+		return rangefilter.NewFromFile(strings.TrimSuffix(dataFile, "Data.db")+"RangeFilter.db", 0, props.RangeFilterSize)
+	}
+	return rangefilter.NewFromFile(dataFile, props.RangeFilterOffset, props.RangeFilterSize)
+}
+
+// false if the range filter of the table rules out every key in [start, end]
+func (r *tableReader) mayHaveRange(start, end string) bool {
+	if r.rangeFilter == nil {
+		return true
+	}
+	passed := r.rangeFilter.MayContain(start, end)
+	recordRangeFilter(r.level, passed)
+	return passed
+}
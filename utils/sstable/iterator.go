@@ -0,0 +1,210 @@
+package sstable
+
+import (
+	"bufio"
+	"io"
+	"log"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	ratelimiter "nosql-engine/packages/utils/rate-limiter"
+	"os"
+	"strings"
+)
+
+// Iterator goes through all records of a table in key order, whatever format the table was written in
+type Iterator struct {
+	dataFile string
+	footer   *footer
+	file     *os.File
+	pages    *pagedFile  // "one" and "many" tables are read through the block cache
+	mapped   *mappedFile // the data file in READER_MMAP mode, the block cache isn't used then
+	reader   *bufio.Reader
+	pos      uint64
+	end      uint64
+	lower    string // keys before it are skipped, set by Seek
+	table    *blockTable
+	blockNum int
+	block    *blockIter
+	fill     bool
+	limiter  *ratelimiter.Limiter // nil if reads aren't limited
+}
+
+// dataFile is the name of the "Data file" of the table
+func NewIterator(dataFile string) *Iterator {
+	return NewLimitedIterator(dataFile, nil)
+}
+
+// every read goes through the limiter first, compactions read their inputs this way
+func NewLimitedIterator(dataFile string, limiter *ratelimiter.Limiter) *Iterator {
+	file, err := os.Open(dataFile)
+	if err != nil {
+		panic(err)
+	}
+
+	f := mustReadFooter(dataFile)
+	it := &Iterator{dataFile: dataFile, footer: f, file: file, fill: true, limiter: limiter}
+	it.mapped = mapIfEnabled(file, f.fileSize)
+
+	if f.format == "block" {
+		it.table = openBlockTable(dataFile, it.mapped)
+		it.blockNum = -1
+	} else {
+		it.pages = newPagedFile(file, dataFile)
+		it.end = f.dataEnd()
+		it.moveTo(0)
+	}
+
+	return it
+}
+
+// false keeps blocks the iterator reads from disk out of the block cache. Compactions read every
+// block of their inputs once, they would push out the blocks lookups need
+func (it *Iterator) SetFillCache(fill bool) {
+	it.fill = fill
+	if it.pages != nil {
+		it.pages.fill = fill
+	}
+}
+
+// moves the iterator so Next returns the first record with a key >= key, it can only go forward
+func (it *Iterator) Seek(key string) {
+	it.lower = key
+
+	if it.table != nil {
+		// the block before the first one that can hold the key, Next moves on to it
+		if num := it.table.seekBlock(key) - 1; num > it.blockNum {
+			it.blockNum = num
+			it.block = nil
+		}
+		return
+	}
+
+	if offset := it.seekIndex(key); offset > it.pos {
+		it.moveTo(offset)
+	}
+}
+
+func (it *Iterator) moveTo(offset uint64) {
+	it.pos = offset
+	it.reader = bufio.NewReader(io.NewSectionReader(it.source(), int64(offset), int64(it.end-offset)))
+}
+
+// where the records of a "one" or "many" table are read from
+func (it *Iterator) source() io.ReaderAt {
+	if it.mapped != nil {
+		return it.mapped
+	}
+	return it.pages
+}
+
+// offset of the first record with a key >= key in a "one" or "many" table, end if there is none
+func (it *Iterator) seekIndex(key string) uint64 {
+	var summary Summary
+	index, indexEnd := it.source(), it.footer.summaryOffset
+	if it.footer.format == "many" {
+		summaryFile := strings.TrimSuffix(it.dataFile, "Data.db") + "Summary.db"
+		indexFile := strings.TrimSuffix(it.dataFile, "Data.db") + "Index.db"
+		summary = readSummary(summaryFile, 0, fileSize(summaryFile))
+
+		file, err := os.Open(indexFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		if m := mapIfEnabled(file, fileSize(indexFile)); m != nil {
+			defer m.close()
+			index, indexEnd = m, m.size()
+		} else {
+			pages := newPagedFile(file, indexFile)
+			pages.fill = it.fill
+			index, indexEnd = pages, fileSize(indexFile)
+		}
+	} else if it.mapped != nil {
+		summary = parseSummary(it.mapped.slice(it.footer.summaryOffset, it.footer.filterOffset-it.footer.summaryOffset))
+	} else {
+		summary = readSummary(it.dataFile, it.footer.summaryOffset, it.footer.filterOffset)
+	}
+
+	if key <= summary.Start {
+		return 0
+	}
+	if key > summary.Stop {
+		return it.end
+	}
+
+	// the last summary entry before the key, the key is somewhere after it in the index
+	indexOffset := summary.Indexes[0].Value
+	for _, entry := range summary.Indexes {
+		if entry.Key >= key {
+			break
+		}
+		indexOffset = entry.Value
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(index, int64(indexOffset), int64(indexEnd-indexOffset)))
+	for {
+		filekey, err := tryReadKeyFrom(reader)
+		if err != nil {
+			return it.end
+		}
+		offset := readUint64From(reader)
+		if filekey >= key {
+			return offset
+		}
+	}
+}
+
+// returns "" and nil once the table is exhausted
+func (it *Iterator) Next() (string, *database_elem.DatabaseElem) {
+	for {
+		key, elem := it.next()
+		if elem == nil || key >= it.lower {
+			return key, elem
+		}
+	}
+}
+
+func (it *Iterator) next() (string, *database_elem.DatabaseElem) {
+	if it.table == nil {
+		if it.pos >= it.end {
+			return "", nil
+		}
+		key, elem, size := readRecordFrom(it.reader)
+		it.pos += size
+		it.throttle(size)
+		return key, &elem
+	}
+
+	for it.block == nil || !it.block.next() {
+		it.blockNum++
+		if it.blockNum >= len(it.table.index) {
+			return "", nil
+		}
+		handle := it.table.index[it.blockNum].Value
+		it.throttle(handle.size + BLOCK_TRAILER_SIZE)
+		if it.mapped != nil {
+			it.block = newBlockIter(readMappedBlock(it.mapped, handle))
+		} else {
+			it.block = newBlockIter(it.table.cachedBlock(it.file, handle, it.fill))
+		}
+	}
+
+	elem := decodeBlockValue(it.block.value)
+	return string(it.block.key), &elem
+}
+
+func (it *Iterator) throttle(bytes uint64) {
+	if it.limiter != nil {
+		it.limiter.Request(bytes)
+	}
+}
+
+// the iterator can't be used afterwards, nothing it returned points into the table
+func (it *Iterator) Close() {
+	it.file.Close()
+	it.mapped.close()
+}
+
+// detects the format of the table from its "Data file": "many", "block" or "one"
+func TableFormat(dataFile string) string {
+	return mustReadFooter(dataFile).format
+}
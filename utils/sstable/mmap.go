@@ -0,0 +1,168 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"nosql-engine/packages/utils/compression"
+	"nosql-engine/packages/utils/config"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	"os"
+	"sync"
+)
+
+const (
+	READER_PREAD = "pread" // tables are read with ReadAt through the block cache
+	READER_MMAP  = "mmap"  // tables are mapped into memory, only on linux, elsewhere it falls back to READER_PREAD
+)
+
+var (
+	readerMode     string
+	readerModeLock sync.Mutex
+)
+
+// how tables opened from now on are read, READER_PREAD or READER_MMAP. Tables already open stay as they are
+func SetReaderMode(mode string) {
+	readerModeLock.Lock()
+	defer readerModeLock.Unlock()
+	readerMode = mode
+}
+
+func getReaderMode() string {
+	readerModeLock.Lock()
+	defer readerModeLock.Unlock()
+	if readerMode == "" {
+		readerMode = config.GetConfig().SSTableReader
+	}
+	return readerMode
+}
+
+// mappedFile is a table file mapped into memory. Its slices point into the mapping, they may only be used
+// until unmap, so nothing read from it may outlive the reader that mapped it without being copied
+type mappedFile struct {
+	data []byte
+}
+
+// mapping of the file if the reader mode asks for one, nil otherwise. Files that can't be mapped or are shorter
+// than the size bytes the caller is going to read (empty, truncated) aren't mapped either, the caller reads them
+// with pread, which reports what is wrong with them
+func mapIfEnabled(file *os.File, size uint64) *mappedFile {
+	if getReaderMode() != READER_MMAP {
+		return nil
+	}
+	m, err := mapFile(file)
+	if err != nil {
+		return nil
+	}
+	if m.size() < size {
+		m.close()
+		return nil
+	}
+	return m
+}
+
+// size bytes from offset, without copying
+func (m *mappedFile) slice(offset, size uint64) []byte {
+	return m.data[offset : offset+size]
+}
+
+func (m *mappedFile) size() uint64 {
+	return uint64(len(m.data))
+}
+
+// copies like a file would, for the readers that go through io.Reader
+func (m *mappedFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	if offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(buffer, m.data[offset:])
+	if n < len(buffer) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mappedFile) close() {
+	if m == nil || m.data == nil {
+		return
+	}
+	if err := unmapFile(m); err != nil {
+		log.Fatal(err)
+	}
+	m.data = nil
+}
+
+// block of a "block" table straight from the mapping, uncompressed blocks aren't copied.
+// The block cache is left out, it would only hold a second copy of what the page cache has
+func readMappedBlock(m *mappedFile, handle blockHandle) []byte {
+	buffer := m.slice(handle.offset, handle.size+BLOCK_TRAILER_SIZE)
+	stored := buffer[:handle.size]
+	trailer := buffer[handle.size:]
+	if CRC32(buffer[:handle.size+1]) != binary.LittleEndian.Uint32(trailer[1:]) {
+		log.Fatal("crc not match values")
+	}
+	if trailer[0] == compression.NONE {
+		return stored
+	}
+	contents, err := compression.Decompress(trailer[0], stored)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return contents
+}
+
+// same as lookup for a mapped "one" or "many" table, index keys are compared where they lie in the mapping.
+// [start, stop] is the part of the index the summary points to
+func (r *tableReader) lookupMapped(key string, start, stop uint64) (bool, database_elem.DatabaseElem) {
+	index := r.indexMap.slice(0, r.indexEnd)
+	for pos := start; pos <= stop && pos+8 <= uint64(len(index)); {
+		length := binary.LittleEndian.Uint64(index[pos:])
+		filekey := index[pos+8 : pos+8+length]
+		offset := binary.LittleEndian.Uint64(index[pos+8+length:])
+		pos += 16 + length
+		// comparisons with a converted slice don't allocate
+		if string(filekey) == key {
+			return true, mappedRecord(r.dataMap.slice(0, r.footer.dataEnd()), offset)
+		}
+		if string(filekey) > key {
+			break
+		}
+	}
+	return false, database_elem.DatabaseElem{}
+}
+
+// record of a "one" or "many" table at the offset of its mapped records. The value is copied out of the mapping
+func mappedRecord(data []byte, offset uint64) database_elem.DatabaseElem {
+	record, err := recordAt(data, offset)
+	if err != nil {
+		log.Fatal(err)
+	}
+	timestamp := binary.LittleEndian.Uint64(record[4:12])
+	tombstone := record[12]
+	keyLength := binary.LittleEndian.Uint64(record[13:21])
+	value := make([]byte, len(record)-int(29+keyLength))
+	copy(value, record[29+keyLength:])
+	return database_elem.DatabaseElem{Tombstone: tombstone, Value: value, Timestamp: timestamp}
+}
+
+// the whole record at offset with its crc checked: crc, timestamp, tombstone, key size, key, value size, value
+func recordAt(data []byte, offset uint64) ([]byte, error) {
+	record := data[offset:]
+	if len(record) < 21 {
+		return nil, errors.New("record is truncated")
+	}
+	keyLength := binary.LittleEndian.Uint64(record[13:21])
+	if uint64(len(record)) < 29+keyLength {
+		return nil, errors.New("record is truncated")
+	}
+	valueLength := binary.LittleEndian.Uint64(record[21+keyLength:])
+	if uint64(len(record)) < 29+keyLength+valueLength {
+		return nil, errors.New("record is truncated")
+	}
+	record = record[:29+keyLength+valueLength]
+	if CRC32(record[4:]) != binary.LittleEndian.Uint32(record[0:4]) {
+		return nil, errors.New("crc not match values")
+	}
+	return record, nil
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package sstable
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// maps the whole file read only, the mapping stays valid after the file is closed or deleted
+func mapFile(file *os.File) (*mappedFile, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// an empty mapping isn't allowed
+	if info.Size() == 0 {
+		return nil, errors.New(file.Name() + ": empty file can't be mapped")
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{data: data}, nil
+}
+
+func unmapFile(m *mappedFile) error {
+	return syscall.Munmap(m.data)
+}
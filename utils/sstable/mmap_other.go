@@ -0,0 +1,17 @@
+//go:build !linux
+
+package sstable
+
+import (
+	"errors"
+	"os"
+)
+
+// tables are read with ReadAt instead
+func mapFile(file *os.File) (*mappedFile, error) {
+	return nil, errors.New("mmap reads are only supported on linux")
+}
+
+func unmapFile(m *mappedFile) error {
+	return nil
+}
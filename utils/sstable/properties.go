@@ -0,0 +1,358 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+   Every Data.db ends with the properties block and a fixed size footer:
+   +------------------+------------------+-------------------+------------------+
+   | Index offset (8B)| Index size (8B)  | Summary offset(8B)| Filter offset(8B)|
+   +------------------+------------------+-------------------+------------------+
+   | Properties offset (8B) | Properties size (8B) | Format (4B) | Version (4B) | Checksum (4B) | Magic (8B) |
+   +------------------------+----------------------+-------------+--------------+---------------+------------+
+   Offsets point into Data.db, the ones a format doesn't use are 0 ("many" keeps its index, summary
+   and filter in their own files). Checksum = CRC of the properties block and the footer fields before it.
+   The prefix and range filters of "one" and "block" tables lie between the filter and the properties block,
+   the properties tell where. Version 1 properties blocks end after Compaction, the prefix filter fields
+   came with version 2 and the range filter fields with version 3.
+
+   Tables written before the footer existed are read as version 0: "one" files end with three raw offsets
+   (index, summary, filter), "many" data files end with the last record, "block" files end with BLOCK_MAGIC.
+*/
+
+const (
+	FOOTER_SIZE    = 68
+	FOOTER_MAGIC   = 0x7473736c71736f6e // "nosqlsst"
+	FOOTER_VERSION = 3
+
+	PREFIX_FILTER_VERSION = 2 // first version with the prefix filter in the properties
+	RANGE_FILTER_VERSION  = 3 // first version with the range filter in the properties
+
+	FORMAT_ONE   = 1
+	FORMAT_MANY  = 2
+	FORMAT_BLOCK = 3
+)
+
+var formatNames = map[uint32]string{FORMAT_ONE: "one", FORMAT_MANY: "many", FORMAT_BLOCK: "block"}
+
+type Properties struct {
+	Version        uint32
+	Format         string
+	EntryCount     uint64
+	TombstoneCount uint64
+	MinKey         string
+	MaxKey         string
+	MinTimestamp   uint64
+	MaxTimestamp   uint64
+	RawSize        uint64 // keys and values as they were added
+	DiskSize       uint64 // data, index, summary and filter as they ended up on disk
+	Compaction     string // what created the table, "flush" or the compaction that wrote it
+
+	PrefixExtractor    string // name of the extractors the prefix filter was built with, "" if the table has none
+	PrefixFilterOffset uint64 // in Data.db, "many" tables keep the prefix filter in PrefixFilter.db instead
+
+	RangeFilterOffset uint64  // in Data.db, "many" tables keep the range filter in RangeFilter.db instead
+	RangeFilterSize   uint64  // bytes, 0 if the table has no range filter
+	RangeFilterFPR    float64 // estimated false positive rate of one lookup in the range filter
+}
+
+type footer struct {
+	version       uint32
+	format        string
+	indexOffset   uint64
+	indexSize     uint64
+	summaryOffset uint64
+	filterOffset  uint64
+	propsOffset   uint64
+	propsSize     uint64
+	fileSize      uint64
+}
+
+func newProperties(format string, compaction string) *Properties {
+	return &Properties{Version: FOOTER_VERSION, Format: format, Compaction: compaction}
+}
+
+// records have to be added in key order
+func (p *Properties) add(key string, elem database_elem.DatabaseElem) {
+	if p.EntryCount == 0 {
+		p.MinKey = key
+		p.MinTimestamp = elem.Timestamp
+		p.MaxTimestamp = elem.Timestamp
+	}
+	p.MaxKey = key
+	p.EntryCount++
+	if elem.Tombstone == 1 {
+		p.TombstoneCount++
+	}
+	if elem.Timestamp < p.MinTimestamp {
+		p.MinTimestamp = elem.Timestamp
+	}
+	if elem.Timestamp > p.MaxTimestamp {
+		p.MaxTimestamp = elem.Timestamp
+	}
+	p.RawSize += uint64(len(key) + len(elem.Value))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	if len(buf) < 8 || uint64(len(buf)-8) < binary.LittleEndian.Uint64(buf) {
+		return "", nil, errors.New("properties block is truncated")
+	}
+	length := binary.LittleEndian.Uint64(buf)
+	return string(buf[8 : 8+length]), buf[8+length:], nil
+}
+
+func (p *Properties) encode() []byte {
+	buf := make([]byte, 0)
+	buf = binary.LittleEndian.AppendUint64(buf, p.EntryCount)
+	buf = binary.LittleEndian.AppendUint64(buf, p.TombstoneCount)
+	buf = appendString(buf, p.MinKey)
+	buf = appendString(buf, p.MaxKey)
+	buf = binary.LittleEndian.AppendUint64(buf, p.MinTimestamp)
+	buf = binary.LittleEndian.AppendUint64(buf, p.MaxTimestamp)
+	buf = binary.LittleEndian.AppendUint64(buf, p.RawSize)
+	buf = binary.LittleEndian.AppendUint64(buf, p.DiskSize)
+	buf = appendString(buf, p.Compaction)
+	buf = appendString(buf, p.PrefixExtractor)
+	buf = binary.LittleEndian.AppendUint64(buf, p.PrefixFilterOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, p.RangeFilterOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, p.RangeFilterSize)
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(p.RangeFilterFPR))
+	return buf
+}
+
+func decodeProperties(buf []byte, version uint32, format string) (*Properties, error) {
+	p := &Properties{Version: version, Format: format}
+	var err error
+
+	if len(buf) < 16 {
+		return nil, errors.New("properties block is truncated")
+	}
+	p.EntryCount = binary.LittleEndian.Uint64(buf[0:8])
+	p.TombstoneCount = binary.LittleEndian.Uint64(buf[8:16])
+	buf = buf[16:]
+
+	if p.MinKey, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if p.MaxKey, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < 32 {
+		return nil, errors.New("properties block is truncated")
+	}
+	p.MinTimestamp = binary.LittleEndian.Uint64(buf[0:8])
+	p.MaxTimestamp = binary.LittleEndian.Uint64(buf[8:16])
+	p.RawSize = binary.LittleEndian.Uint64(buf[16:24])
+	p.DiskSize = binary.LittleEndian.Uint64(buf[24:32])
+	if p.Compaction, buf, err = readString(buf[32:]); err != nil {
+		return nil, err
+	}
+
+	if version < PREFIX_FILTER_VERSION {
+		return p, nil
+	}
+	if p.PrefixExtractor, buf, err = readString(buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < 8 {
+		return nil, errors.New("properties block is truncated")
+	}
+	p.PrefixFilterOffset = binary.LittleEndian.Uint64(buf[0:8])
+
+	if version < RANGE_FILTER_VERSION {
+		return p, nil
+	}
+	if len(buf) < 32 {
+		return nil, errors.New("properties block is truncated")
+	}
+	p.RangeFilterOffset = binary.LittleEndian.Uint64(buf[8:16])
+	p.RangeFilterSize = binary.LittleEndian.Uint64(buf[16:24])
+	p.RangeFilterFPR = math.Float64frombits(binary.LittleEndian.Uint64(buf[24:32]))
+
+	return p, nil
+}
+
+// appends the properties block and the footer to the data file, the properties start where the file ends now
+func appendFooter(dataFile string, f footer, props *Properties) {
+	file, err := os.OpenFile(dataFile, os.O_APPEND|os.O_WRONLY, os.ModeAppend)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	start, _ := file.Seek(0, io.SeekEnd)
+	propsBytes := props.encode()
+
+	format := uint32(0)
+	for id, name := range formatNames {
+		if name == f.format {
+			format = id
+		}
+	}
+
+	buf := make([]byte, 0, len(propsBytes)+FOOTER_SIZE)
+	buf = append(buf, propsBytes...)
+	buf = binary.LittleEndian.AppendUint64(buf, f.indexOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, f.indexSize)
+	buf = binary.LittleEndian.AppendUint64(buf, f.summaryOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, f.filterOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(start))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(propsBytes)))
+	buf = binary.LittleEndian.AppendUint32(buf, format)
+	buf = binary.LittleEndian.AppendUint32(buf, FOOTER_VERSION)
+	buf = binary.LittleEndian.AppendUint32(buf, CRC32(buf))
+	buf = binary.LittleEndian.AppendUint64(buf, FOOTER_MAGIC)
+
+	file.Write(buf)
+}
+
+// reads the footer of a table of any format and version, dataFile is the name of its "Data file"
+func readFooter(dataFile string) (*footer, error) {
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	tail := make([]byte, FOOTER_SIZE)
+	if size >= FOOTER_SIZE {
+		file.ReadAt(tail, size-FOOTER_SIZE)
+	} else {
+		tail = tail[FOOTER_SIZE-size:]
+		file.ReadAt(tail, 0)
+	}
+
+	if len(tail) >= 8 && binary.LittleEndian.Uint64(tail[len(tail)-8:]) == FOOTER_MAGIC {
+		if len(tail) < FOOTER_SIZE {
+			return nil, errors.New(dataFile + ": sstable footer is truncated")
+		}
+		f := &footer{
+			indexOffset:   binary.LittleEndian.Uint64(tail[0:8]),
+			indexSize:     binary.LittleEndian.Uint64(tail[8:16]),
+			summaryOffset: binary.LittleEndian.Uint64(tail[16:24]),
+			filterOffset:  binary.LittleEndian.Uint64(tail[24:32]),
+			propsOffset:   binary.LittleEndian.Uint64(tail[32:40]),
+			propsSize:     binary.LittleEndian.Uint64(tail[40:48]),
+			version:       binary.LittleEndian.Uint32(tail[52:56]),
+			fileSize:      uint64(size),
+		}
+		if f.version == 0 || f.version > FOOTER_VERSION {
+			return nil, errors.New(dataFile + ": unsupported sstable version " + strconv.Itoa(int(f.version)) +
+				", this build reads versions up to " + strconv.Itoa(FOOTER_VERSION))
+		}
+		format, ok := formatNames[binary.LittleEndian.Uint32(tail[48:52])]
+		if !ok {
+			return nil, errors.New(dataFile + ": unknown sstable format " + strconv.Itoa(int(binary.LittleEndian.Uint32(tail[48:52]))))
+		}
+		f.format = format
+
+		if f.propsOffset+f.propsSize+FOOTER_SIZE != uint64(size) {
+			return nil, errors.New(dataFile + ": sstable footer points outside of the file")
+		}
+		checked := make([]byte, f.propsSize+56)
+		file.ReadAt(checked, int64(f.propsOffset))
+		if CRC32(checked) != binary.LittleEndian.Uint32(tail[56:60]) {
+			return nil, errors.New(dataFile + ": sstable footer checksum mismatch")
+		}
+		return f, nil
+	}
+
+	// version 0 tables, written before the footer existed
+	if len(tail) >= 8 && binary.LittleEndian.Uint64(tail[len(tail)-8:]) == BLOCK_MAGIC && len(tail) >= BLOCK_FOOTER_SIZE {
+		legacy := tail[len(tail)-BLOCK_FOOTER_SIZE:]
+		return &footer{
+			version:      0,
+			format:       "block",
+			indexOffset:  binary.LittleEndian.Uint64(legacy[0:8]),
+			indexSize:    binary.LittleEndian.Uint64(legacy[8:16]),
+			filterOffset: binary.LittleEndian.Uint64(legacy[16:24]),
+			fileSize:     uint64(size),
+		}, nil
+	}
+	if _, err := os.Stat(strings.TrimSuffix(dataFile, "Data.db") + "Index.db"); err == nil {
+		return &footer{version: 0, format: "many", fileSize: uint64(size)}, nil
+	}
+	if len(tail) >= 24 {
+		legacy := tail[len(tail)-24:]
+		f := &footer{
+			version:       0,
+			format:        "one",
+			indexOffset:   binary.LittleEndian.Uint64(legacy[0:8]),
+			summaryOffset: binary.LittleEndian.Uint64(legacy[8:16]),
+			filterOffset:  binary.LittleEndian.Uint64(legacy[16:24]),
+			fileSize:      uint64(size),
+		}
+		// without a magic number the offsets are all we can check
+		if f.indexOffset <= f.summaryOffset && f.summaryOffset <= f.filterOffset && f.filterOffset <= uint64(size-24) {
+			f.indexSize = f.summaryOffset - f.indexOffset
+			return f, nil
+		}
+	}
+
+	return nil, errors.New(dataFile + ": not an sstable (no footer found)")
+}
+
+// where the records of the table end
+func (f *footer) dataEnd() uint64 {
+	switch f.format {
+	case "one":
+		return f.indexOffset
+	case "many":
+		if f.version == 0 {
+			return f.fileSize
+		}
+		return f.propsOffset
+	default:
+		return f.indexOffset
+	}
+}
+
+func mustReadFooter(dataFile string) *footer {
+	f, err := readFooter(dataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+// properties of the table, dataFile is the name of its "Data file"
+func ReadProperties(dataFile string) (*Properties, error) {
+	f, err := readFooter(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	if f.version == 0 {
+		return nil, errors.New(dataFile + ": sstable version 0 has no properties block")
+	}
+
+	file, err := os.Open(dataFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, f.propsSize)
+	if _, err := file.ReadAt(buf, int64(f.propsOffset)); err != nil {
+		return nil, err
+	}
+	return decodeProperties(buf, f.version, f.format)
+}
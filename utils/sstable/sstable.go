@@ -5,21 +5,19 @@ import (
 	"encoding/binary"
 	"hash/crc32"
 	"io"
-	"io/fs"
 	"log"
-	"math"
 	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	compactionfilter "nosql-engine/packages/utils/compaction-filter"
 	database_elem "nosql-engine/packages/utils/database-elem"
 	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
 	merkletree "nosql-engine/packages/utils/merkle-tree"
+	prefixextractor "nosql-engine/packages/utils/prefix-extractor"
+	rangefilter "nosql-engine/packages/utils/range-filter"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
 )
 
-var order = 0
-
 const (
 	SINGLE = 0
 	PREFIX = 1
@@ -40,56 +38,37 @@ type Summary struct {
 	Indexes []GTypes.KeyVal[string, uint64]
 }
 
-func new(array []GTypes.KeyVal[string, database_elem.DatabaseElem], count int) SSTable {
-	bf := bloomfilter.New(len(array), 0.01)
-	index := make([]GTypes.KeyVal[string, uint64], 0)
-
-	sumIndexes := make([]GTypes.KeyVal[string, uint64], 0)
-	if len(array) <= count {
-		count = 1
-	} else {
-		count = (len(array) / count)
-	}
-	for i := 0; i < len(array); i++ {
-		if i == 0 || i == len(array)-1 || (i+1)%count == 0 {
-			sumIndexes = append(sumIndexes, GTypes.KeyVal[string, uint64]{Key: array[i].Key, Value: uint64(i)})
+// writes the flushed memtable as a new table and adds it to the manifest, records go through the compaction filters
+func CreateSStable(array []GTypes.KeyVal[string, database_elem.DatabaseElem], count int, prefix string, level int, mode string) {
+	ctx := compactionfilter.Context{Level: level, Bottommost: false, Flush: true}
+	w := NewWriter(prefix, level, mode, count, "flush")
+	filtered := make([]string, 0)
+	for _, element := range array {
+		decision, elem := compactionfilter.Apply(ctx, element.Key, element.Value)
+		if decision != compactionfilter.KEEP {
+			filtered = append(filtered, element.Key)
 		}
+		w.Add(element.Key, elem)
 	}
-
-	sum := Summary{Start: array[0].Key, Stop: array[len(array)-1].Key, Indexes: sumIndexes}
-	TOC := ""
-	return SSTable{Bf: *bf, Data: array, Index: index, Summary: sum, TOC: TOC}
-}
-
-func CreateSStable(array []GTypes.KeyVal[string, database_elem.DatabaseElem], count int, prefix string, level int, mode string) {
-	DefineOrder(prefix, level)
-
-	st := new(array, count)
-	for offset, element := range array {
-		key := element.Key
-
-		st.Index = append(st.Index, GTypes.KeyVal[string, uint64]{Key: key, Value: uint64(offset)})
-		st.Bf.Add(string(key))
+	if table := w.Finish(); table != nil {
+		OpenManifest(prefix).Apply(manifest.Edit{Add: []manifest.Table{*table}})
+	}
+	if len(filtered) > 0 {
+		compactionfilter.Notify(filtered)
 	}
-	CreateFiles(st, prefix, level, mode, false)
 }
 
-func CreateFiles(st SSTable, prefix string, level int, mode string, dataExists bool) {
-	name := "/usertable-L" + strconv.Itoa(level) + "-" + strconv.Itoa(order) + "-"
-
+// name is the table name without the prefix. The data file is already written and the index points into it.
+// prefixBf and rf are nil if the table gets no prefix or range filter
+func writeFiles(st SSTable, prefixBf *bloomfilter.BloomFilter, rf *rangefilter.RangeFilter, prefix string, name string, mode string, props *Properties) {
 	if mode == "many" {
 		st.Bf.MakeFile(prefix, name+"Filter.db", mode)
+		writePrefixFilter(prefixBf, prefix, name, mode, props)
+		writeRangeFilter(rf, prefix, name, mode, props)
 	}
 
 	nameWithoutPrefix := name
 	name = prefix + name
-	if !dataExists {
-		arr := createDataFile(name, st)
-
-		for i := range st.Index {
-			st.Index[i].Value = arr[i]
-		}
-	}
 
 	arr, indexOffset := createIndexFile(name, st, mode)
 
@@ -98,57 +77,31 @@ func CreateFiles(st SSTable, prefix string, level int, mode string, dataExists b
 		st.Summary.Indexes[i].Value = arr[in] + indexOffset
 	}
 	summOffset := createSummaryFile(name, st, mode)
-	var bfOffset uint64
 	if mode == "one" {
-		bfOffset = st.Bf.MakeFile(prefix, nameWithoutPrefix+"Data.db", mode)
-		appendFileOffsets(name, indexOffset, summOffset, bfOffset)
+		bfOffset := st.Bf.MakeFile(prefix, nameWithoutPrefix+"Data.db", mode)
+		writePrefixFilter(prefixBf, prefix, nameWithoutPrefix, mode, props)
+		writeRangeFilter(rf, prefix, nameWithoutPrefix, mode, props)
+		props.DiskSize = fileSize(name + "Data.db")
+		appendFooter(name+"Data.db", footer{
+			format:        "one",
+			indexOffset:   indexOffset,
+			indexSize:     summOffset - indexOffset,
+			summaryOffset: summOffset,
+			filterOffset:  bfOffset,
+		}, props)
+	} else {
+		props.DiskSize = fileSize(name+"Data.db") + fileSize(name+"Index.db") + fileSize(name+"Summary.db") + fileSize(name+"Filter.db") + fileSize(name+"PrefixFilter.db") + fileSize(name+"RangeFilter.db")
+		appendFooter(name+"Data.db", footer{format: "many"}, props)
 	}
 	createTOCFile(name, mode)
 }
 
-func createDataFile(name string, st SSTable) []uint64 {
-	file, err := os.Create(name + "Data.db")
+func fileSize(filename string) uint64 {
+	info, err := os.Stat(filename)
 	if err != nil {
-		panic(err)
+		return 0
 	}
-	offsetstart := make([]uint64, 0)
-	mtdata := make([][]byte, 0)
-	for _, element := range st.Data {
-		byteslice := make([]byte, 0)
-		tmpbs := make([]byte, 8)
-
-		binary.LittleEndian.PutUint64(tmpbs, uint64(element.Value.Timestamp))
-		byteslice = append(byteslice, tmpbs...)
-
-		byteslice = append(byteslice, element.Value.Tombstone)
-
-		binary.LittleEndian.PutUint64(tmpbs, uint64(len(element.Key)))
-		byteslice = append(byteslice, tmpbs...)
-		byteslice = append(byteslice, []byte(element.Key)...)
-
-		binary.LittleEndian.PutUint64(tmpbs, uint64(len(element.Value.Value)))
-		byteslice = append(byteslice, tmpbs...)
-		byteslice = append(byteslice, element.Value.Value...)
-
-		crc := CRC32(byteslice)
-
-		crcslice := make([]byte, 4)
-		binary.LittleEndian.PutUint32(crcslice, uint32(crc))
-
-		mtelem := make([]byte, 0)
-		mtelem = append(mtelem, crcslice...)
-		mtelem = append(mtelem, byteslice...)
-
-		mtdata = append(mtdata, mtelem)
-
-		offset, _ := file.Seek(0, 1)
-		offsetstart = append(offsetstart, uint64(offset))
-		file.Write(crcslice)
-		file.Write(byteslice)
-	}
-	file.Close()
-	CreateMerkleFile(name, mtdata)
-	return offsetstart
+	return uint64(info.Size())
 }
 
 func createIndexFile(name string, st SSTable, mode string) ([]uint64, uint64) {
@@ -244,165 +197,59 @@ func createTOCFile(name string, mode string) {
 		file.WriteString(name + "Filter.db\n")
 	}
 	file.WriteString(name + "Metadata.db\n")
-
-	file.Close()
-}
-
-func appendFileOffsets(name string, indexOffset, summOffset, bfOffset uint64) {
-	file, err := os.OpenFile(name+"Data.db", os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModeAppend)
-	if err != nil {
-		panic(err)
+	// after the files readTOC expects at fixed lines
+	for _, optional := range []string{"PrefixFilter.db", "RangeFilter.db"} {
+		if _, err := os.Stat(name + optional); err == nil {
+			file.WriteString(name + optional + "\n")
+		}
 	}
-	byteslice := make([]byte, 0)
-	tmpbs := make([]byte, 8)
-
-	binary.LittleEndian.PutUint64(tmpbs, uint64(indexOffset))
-	byteslice = append(byteslice, tmpbs...)
 
-	binary.LittleEndian.PutUint64(tmpbs, uint64(summOffset))
-	byteslice = append(byteslice, tmpbs...)
-
-	binary.LittleEndian.PutUint64(tmpbs, uint64(bfOffset))
-	byteslice = append(byteslice, tmpbs...)
-
-	file.Write(byteslice)
 	file.Close()
 }
 
 func readFileOffsets(filename string) (uint64, uint64, uint64) { //index, summary, bloomfilter
-	readFile, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer readFile.Close()
-
-	readFile.Seek(-24, os.SEEK_END)
-	return readUint64(*readFile), readUint64(*readFile), readUint64(*readFile)
+	f := mustReadFooter(filename)
+	return f.indexOffset, f.summaryOffset, f.filterOffset
 }
 
-func ReadFileOffset(filename string) uint64 { //index
-	readFile, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer readFile.Close()
-
-	readFile.Seek(-24, os.SEEK_END)
-	return readUint64(*readFile)
+// where the records end in a "one" or "many" data file
+func ReadFileOffset(filename string) uint64 {
+	return mustReadFooter(filename).dataEnd()
 }
 
 func CRC32(data []byte) uint32 {
 	return crc32.ChecksumIEEE(data)
 }
 
-func DefineOrder(prefix string, level int) {
-	files, err := os.ReadDir("./" + prefix)
-	if os.IsNotExist(err) {
-		os.MkdirAll(prefix, os.ModePerm)
-	} else if err != nil {
-		panic(err)
-	}
-	order = 0
-
-	for _, file := range files {
-		var s string = file.Name()
-		numbers := make([]int, 0)
-		pos := 0
-		if !strings.Contains(s, "L"+strconv.Itoa(level)) {
-			continue
-		}
-		for i := 13; ; i++ {
-			if len(s) < 14 {
-				break
-			}
-			if s[i] < '0' || s[i] > '9' {
-				break
-			}
-			var a int = int(s[i]) - 48
-			numbers = append(numbers, a)
-			pos++
-		}
-		pos = int(math.Pow10(pos - 1))
-		number := 0
-		for _, a := range numbers {
-			number += a * pos
-			pos /= 10
-		}
-		if order < number {
-			order = number
+// tables in the order they are searched, lower levels first and newer tables first inside a level
+func readOrder(version *manifest.Version, levelNum uint64) []manifest.Table {
+	arr := make([]manifest.Table, 0)
+	for _, table := range version.Tables {
+		if table.Level < int(levelNum) {
+			arr = append(arr, table)
 		}
 	}
-	order++
-	st := order
-	st++
-}
-
-func readOrder(prefix string, levelNum uint64) []string {
-	filespath := prefix
-	files, err := os.ReadDir("./" + filespath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	arr := make([]string, 0)
-	for i := 0; i < int(levelNum); i++ {
-		tocs := findAllTOCPerLevel(i, files)
-		tocs = sortTOCPerLevel(tocs)
-		arr = append(arr, tocs...)
-	}
 	return arr
 }
 
-func findAllTOCPerLevel(level int, files []fs.DirEntry) []string {
-	tocfiles := make([]string, 0)
-	for _, file := range files {
-		name := file.Name()
-		if !strings.Contains(name, "TOC") {
-			continue
-		}
-		if !strings.Contains(name, "L"+strconv.Itoa(level)) {
-			continue
-		}
-		tocfiles = append(tocfiles, name)
-	}
-	return tocfiles
-}
-
-func sortTOCPerLevel(s []string) []string {
-	sort.Slice(s, func(i, j int) bool {
-		s1, s2 := s[i], s[j]
-		n1, _ := strconv.Atoi(strings.Split(s1[13:], "-")[0])
-		n2, _ := strconv.Atoi(strings.Split(s2[13:], "-")[0])
-		return n1 > n2
-	})
-	return s
+func Find(key string, prefix string, levels uint64, mode string) (bool, *database_elem.DatabaseElem) {
+	return FindIn(OpenManifest(prefix), key, levels)
 }
 
-func Find(key string, prefix string, levels uint64, mode string) (bool, *database_elem.DatabaseElem) {
-	filespath := prefix
-	arrToc := readOrder(prefix, levels)
+// same as Find for a manifest the caller keeps open
+func FindIn(m *manifest.Manifest, key string, levels uint64) (bool, *database_elem.DatabaseElem) {
+	version := m.Acquire()
+	defer m.Release(version)
+	cache := getTableCache()
 
-	for _, name := range arrToc {
-		fmap := readTOC(name, filespath, mode)
-		summOffset, bfOffset := uint64(0), uint64(0)
-		if mode == "one" {
-			_, summOffset, bfOffset = readFileOffsets(fmap["data"])
-		}
-
-		bf := bloomfilter.NewFromFile(fmap["filter"], bfOffset)
-		found := bf.Find(key)
+	for _, table := range version.Candidates(key, int(levels)) {
+		reader := cache.get(m, table)
+		found, dbel := reader.find(key)
+		cache.release(reader)
 		if !found {
 			continue
 		}
-		found, start, stop := checkSummary(key, fmap["summary"], summOffset)
-		if !found {
-			continue
-		}
-		found, start = checkIndex(key, fmap["index"], start, stop)
-		if !found {
-			continue
-		}
-		deleted, dbel := readData(fmap["data"], start)
-		if deleted {
+		if dbel.Tombstone == 1 {
 			return false, nil
 		}
 		return true, &dbel
@@ -410,6 +257,15 @@ func Find(key string, prefix string, levels uint64, mode string) (bool, *databas
 	return false, nil
 }
 
+// bloom filter of a table of any format, dataFile is the name of its "Data file"
+func TableFilter(dataFile string) *bloomfilter.BloomFilter {
+	f := mustReadFooter(dataFile)
+	if f.format == "many" {
+		return bloomfilter.NewFromFile(strings.TrimSuffix(dataFile, "Data.db")+"Filter.db", 0)
+	}
+	return bloomfilter.NewFromFile(dataFile, f.filterOffset)
+}
+
 func checkCRC(crc uint32, timestamp uint64, tombstone byte, key string, value []byte) bool {
 	byteslice := make([]byte, 0)
 	tmpbs := make([]byte, 8)
@@ -430,85 +286,6 @@ func checkCRC(crc uint32, timestamp uint64, tombstone byte, key string, value []
 	return (crc == CRC32(byteslice))
 }
 
-func checkSummary(key string, filename string, fileOffset uint64) (bool, uint64, uint64) { //returns range of index bytes where key may be
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	file.Seek(int64(fileOffset), io.SeekStart)
-	start := readKey(*file)
-	stop := readKey(*file)
-	if key < start || key > stop {
-		return false, 0, 0
-	}
-	prevoffset := uint64(0)
-	for {
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-
-		if filekey == key {
-			return true, offset, offset
-		}
-		if filekey > key {
-			return true, prevoffset, offset
-		}
-		prevoffset = offset
-	}
-}
-
-func checkIndex(key string, filename string, start uint64, stop uint64) (bool, uint64) {
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	file.Seek(int64(start), io.SeekStart)
-	for {
-		pos, _ := file.Seek(0, io.SeekCurrent)
-		if stop < uint64(pos) {
-			return false, 0
-		}
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-		if filekey == key {
-			return true, offset
-		}
-		if filekey > key {
-			return false, 0
-		}
-	}
-}
-
-func readData(filename string, offset uint64) (bool, database_elem.DatabaseElem) {
-	b, db, _ := readDataWithKey(filename, offset)
-	return b, db
-}
-
-func readDataWithKey(filename string, offset uint64) (bool, database_elem.DatabaseElem, string) {
-	readFile, err := os.Open(filename)
-	if err != nil {
-		panic(err)
-	}
-	defer readFile.Close()
-
-	if err != nil {
-		log.Fatal(err)
-	}
-	readFile.Seek(int64(offset), io.SeekStart)
-	crc := readUint32(*readFile)
-	timestamp := readUint64(*readFile)
-	tombstone := readByte(*readFile)
-	key := readKey(*readFile)
-	length := readUint64(*readFile)
-	value := readBytes(*readFile, length)
-	equals := checkCRC(crc, timestamp, tombstone, key, value)
-	if !equals {
-		log.Fatal("crc not match values")
-	}
-	return tombstone == byte(1), database_elem.DatabaseElem{Tombstone: tombstone, Value: value, Timestamp: timestamp}, key
-}
-
 func readKey(f os.File) string {
 	length := readUint64(f)
 	buffer := make([]byte, length)
@@ -543,7 +320,7 @@ func readBytes(f os.File, length uint64) []byte {
 	return buffer
 }
 
-func readTOC(filename, prefix, mode string) map[string]string { //data, index, summary, filter
+func readTOC(filename, prefix string) map[string]string { //data, index, summary, filter, format
 	readFile, err := os.Open(prefix + "/" + filename)
 
 	if err != nil {
@@ -559,17 +336,21 @@ func readTOC(filename, prefix, mode string) map[string]string { //data, index, s
 
 	readFile.Close()
 
+	// the format is taken from the table itself and not from the config,
+	// so tables written before the config was changed stay readable
 	fmap := make(map[string]string)
-	if mode == "many" {
+	if len(fileLines) > 2 {
 		fmap["data"] = fileLines[0]
 		fmap["index"] = fileLines[1]
 		fmap["summary"] = fileLines[2]
 		fmap["filter"] = fileLines[3]
+		fmap["format"] = "many"
 	} else {
 		fmap["data"] = fileLines[0]
 		fmap["index"] = fileLines[0]
 		fmap["summary"] = fileLines[0]
 		fmap["filter"] = fileLines[0]
+		fmap["format"] = TableFormat(fileLines[0])
 	}
 
 	return fmap
@@ -579,24 +360,26 @@ func PrefixScan(key string, prefix string, levels uint64, mode string, logsPerPa
 	kvMap := make(map[string]database_elem.DatabaseElem)
 	kvRet := make(map[string]database_elem.DatabaseElem)
 	filespath := prefix
-	arrToc := readOrder(prefix, levels)
+	m := OpenManifest(prefix)
+	version := m.Acquire()
+	defer m.Release(version)
+	cache := getTableCache()
+	extractors := prefixextractor.Current()
 	pageNumberCounter := 0
 
-	for _, name := range arrToc {
-		fmap := readTOC(name, filespath, mode)
-		summOffset, _ := uint64(0), uint64(0)
-		if mode == "one" {
-			_, summOffset, _ = readFileOffsets(fmap["data"])
-		}
-
-		found, start, stop := checkPrefixSummary(key, fmap["summary"], summOffset)
-		if !found {
+	// tables the prefix filters rule out aren't read at all
+	for _, table := range readOrder(version, levels) {
+		reader := cache.get(m, table)
+		skip := !reader.mayHavePrefix(key, extractors)
+		cache.release(reader)
+		if skip {
 			continue
 		}
-		offsets := checkPrefixIndex(key, fmap["index"], start, stop)
-		for _, start := range offsets {
-			deleted, dbel, key := readDataWithKey(fmap["data"], start)
-			if deleted || isSpecialKey(key) {
+
+		fmap := readTOC(table.Name+"TOC.txt", filespath)
+		for _, record := range prefixRecords(key, fmap) {
+			key, dbel := record.Key, record.Value
+			if dbel.Tombstone == 1 || isSpecialKey(key) {
 				continue
 			}
 			_, ok := kvMap[key]
@@ -626,61 +409,17 @@ func PrefixScan(key string, prefix string, levels uint64, mode string, logsPerPa
 	return kvRet
 }
 
-func checkPrefixSummary(key string, filename string, fileOffset uint64) (bool, uint64, uint64) { //returns range of index bytes where key may be
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	file.Seek(int64(fileOffset), io.SeekStart)
-	start := readKey(*file)
-	stop := readKey(*file)
-	if (key < start && !strings.HasPrefix(start, key)) || key > stop {
-		return false, 0, 0
-	}
-	prevoffset := uint64(0)
-	firstIter := true
-	for {
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-		if firstIter {
-			firstIter = false
-			prevoffset = offset
-		}
+// all records of the table whose key starts with the given prefix
+func prefixRecords(key string, fmap map[string]string) []GTypes.KeyVal[string, database_elem.DatabaseElem] {
+	records := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
 
-		if key == filekey {
-			return true, offset, offset
-		}
-		if !strings.HasPrefix(filekey, key) && key > filekey {
-			prevoffset = offset
-		}
-		if (!strings.HasPrefix(filekey, key) && key < filekey) || stop == filekey {
-			return true, prevoffset, offset
-		}
-	}
-}
-
-func checkPrefixIndex(key string, filename string, start uint64, stop uint64) []uint64 {
-	arr := make([]uint64, 0)
-
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-
-	file.Seek(int64(start), io.SeekStart)
-	for {
-		pos, _ := file.Seek(0, io.SeekCurrent)
-		if stop < uint64(pos) {
-			return arr
-		}
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-		if strings.HasPrefix(filekey, key) {
-			arr = append(arr, offset)
-		}
+	it := NewIterator(fmap["data"])
+	defer it.Close()
+	it.Seek(key)
+	for filekey, dbel := it.Next(); dbel != nil && strings.HasPrefix(filekey, key); filekey, dbel = it.Next() {
+		records = append(records, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: filekey, Value: *dbel})
 	}
+	return records
 }
 
 func RangeScan(key1, key2, prefix string, levels uint64, mode string, logsPerPage, pageNumber uint64) map[string]database_elem.DatabaseElem {
@@ -693,23 +432,27 @@ func RangeScan(key1, key2, prefix string, levels uint64, mode string, logsPerPag
 	}
 
 	filespath := prefix
-	arrToc := readOrder(prefix, levels)
-
-	for _, name := range arrToc {
-		fmap := readTOC(name, filespath, mode)
-		summOffset, _ := uint64(0), uint64(0)
-		if mode == "one" {
-			_, summOffset, _ = readFileOffsets(fmap["data"])
+	m := OpenManifest(prefix)
+	version := m.Acquire()
+	defer m.Release(version)
+	cache := getTableCache()
+
+	// tables whose keys or range filter miss [key1, key2] aren't read at all
+	for _, table := range readOrder(version, levels) {
+		if table.MaxKey < key1 || table.MinKey > key2 {
+			continue
 		}
-
-		found, start, stop := checkRangeSummary(key1, key2, fmap["summary"], summOffset)
-		if !found {
+		reader := cache.get(m, table)
+		skip := !reader.mayHaveRange(key1, key2)
+		cache.release(reader)
+		if skip {
 			continue
 		}
-		offsets := checkRangeIndex(key1, key2, fmap["index"], start, stop)
-		for _, start := range offsets {
-			deleted, dbel, key := readDataWithKey(fmap["data"], start)
-			if deleted || isSpecialKey(key) {
+
+		fmap := readTOC(table.Name+"TOC.txt", filespath)
+		for _, record := range rangeRecords(key1, key2, fmap) {
+			key, dbel := record.Key, record.Value
+			if dbel.Tombstone == 1 || isSpecialKey(key) {
 				continue
 			}
 			_, ok := kvMap[key]
@@ -738,64 +481,17 @@ func RangeScan(key1, key2, prefix string, levels uint64, mode string, logsPerPag
 	return kvRet
 }
 
-func checkRangeSummary(key1, key2, filename string, fileOffset uint64) (bool, uint64, uint64) { //returns range of index bytes where key may be
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
-	file.Seek(int64(fileOffset), io.SeekStart)
-	start := readKey(*file)
-	stop := readKey(*file)
-	if start > key2 || stop < key1 {
-		return false, 0, 0
-	}
-	prevoffset := uint64(0)
-	firstIter := true
-	for {
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-		if firstIter {
-			firstIter = false
-			prevoffset = offset
-		}
-		if filekey < key1 {
-			prevoffset = offset
-		}
-		if filekey > key2 || stop == filekey {
-			return true, prevoffset, offset
-		}
-	}
-}
-
-func checkRangeIndex(key1, key2, filename string, start uint64, stop uint64) []uint64 {
-	arr := make([]uint64, 0)
+// all records of the table with key1 <= key <= key2
+func rangeRecords(key1, key2 string, fmap map[string]string) []GTypes.KeyVal[string, database_elem.DatabaseElem] {
+	records := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
 
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
+	it := NewIterator(fmap["data"])
+	defer it.Close()
+	it.Seek(key1)
+	for filekey, dbel := it.Next(); dbel != nil && filekey <= key2; filekey, dbel = it.Next() {
+		records = append(records, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: filekey, Value: *dbel})
 	}
-	defer file.Close()
-
-	file.Seek(int64(start), io.SeekStart)
-	for {
-		pos, _ := file.Seek(0, io.SeekCurrent)
-		if stop < uint64(pos) {
-			return arr
-		}
-		filekey := readKey(*file)
-		offset := readUint64(*file)
-		if isInRange(filekey, key1, key2) {
-			arr = append(arr, offset)
-		}
-	}
-}
-
-func isInRange(key, key1, key2 string) bool {
-	if key1 <= key && key <= key2 {
-		return true
-	}
-	return false
+	return records
 }
 
 // offset:
@@ -865,11 +561,35 @@ func getKeyRangeMany(filename string) (string, string) {
 	return start, stop
 }
 
-// if mode is "one" -> filename is the name of "Data file";
+// filename: filename of the "Data file"
+func getKeyRangeBlock(filename string) (string, string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	table := openBlockTable(filename, nil)
+	return table.minKey(file), table.maxKey()
+}
+
+// if mode is "one" or "block" -> filename is the name of "Data file";
 // if mode is "many" -> filename is the name of "Summary file"
 func GetKeyRange(filename, mode string) (string, string) {
+	if mode == "block" {
+		return getKeyRangeBlock(filename)
+	}
 	if mode == "one" {
 		return getKeyRangeOne(filename)
 	}
 	return getKeyRangeMany(filename)
 }
+
+// key range of a table of any format, dataFile is the name of its "Data file"
+func TableKeyRange(dataFile string) (string, string) {
+	format := TableFormat(dataFile)
+	if format == "many" {
+		return getKeyRangeMany(strings.TrimSuffix(dataFile, "Data.db") + "Summary.db")
+	}
+	return GetKeyRange(dataFile, format)
+}
@@ -1,11 +1,19 @@
 package sstable
 
 import (
+	"container/list"
+	"fmt"
+	blockcache "nosql-engine/packages/utils/block-cache"
+	"nosql-engine/packages/utils/compression"
 	database_elem "nosql-engine/packages/utils/database-elem"
 	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
+	prefixextractor "nosql-engine/packages/utils/prefix-extractor"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -77,3 +85,653 @@ func TestRangeSearch(t *testing.T) {
 	}
 	os.RemoveAll("data/")
 }
+
+func TestBlockSStable(t *testing.T) {
+	prefix := "data/blockTables"
+	blockKeyNum := 2000
+
+	dbelems := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+	keys := make([]string, 0)
+	for i := 0; i < blockKeyNum; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+	sort.Strings(keys)
+
+	for i := 0; i < blockKeyNum; i++ {
+		val := database_elem.DatabaseElem{Tombstone: 0, Value: []byte("nesto" + keys[i]), Timestamp: uint64(time.Now().Unix())}
+		dbelems = append(dbelems, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: keys[i], Value: val})
+	}
+	dbelems[5].Value.Tombstone = 1
+
+	// an older "one" table next to the block table has to stay readable
+	CreateSStable([]GTypes.KeyVal[string, database_elem.DatabaseElem]{{Key: "old", Value: database_elem.DatabaseElem{Value: []byte("old")}}}, 3, prefix, 0, "one")
+	CreateSStable(dbelems, 3, prefix, 0, "block")
+
+	if TableFormat(prefix+"/usertable-L0-2-Data.db") != "block" || TableFormat(prefix+"/usertable-L0-1-Data.db") != "one" {
+		t.Fatalf("table format detection failed")
+	}
+
+	for i := 0; i < blockKeyNum; i++ {
+		found, dbel := Find(keys[i], prefix, 1, "block")
+		if i == 5 {
+			if found {
+				t.Fatalf("find returned deleted key " + keys[i])
+			}
+			continue
+		}
+		if !found || string(dbel.Value) != "nesto"+keys[i] {
+			t.Fatalf("find not working for " + keys[i])
+		}
+	}
+	if found, _ := Find("key", prefix, 1, "block"); found {
+		t.Fatalf("find not working for missing key")
+	}
+	if found, dbel := Find("old", prefix, 1, "block"); !found || string(dbel.Value) != "old" {
+		t.Fatalf("find not working for key in the old table")
+	}
+
+	it := NewIterator(prefix + "/usertable-L0-2-Data.db")
+	for i := 0; ; i++ {
+		key, _ := it.Next()
+		if key == "" {
+			if i != blockKeyNum {
+				t.Fatalf("iterator returned %d records instead of %d", i, blockKeyNum)
+			}
+			break
+		}
+		if key != keys[i] {
+			t.Fatalf("iterator returned " + key + " instead of " + keys[i])
+		}
+	}
+	it.Close()
+
+	min, max := TableKeyRange(prefix + "/usertable-L0-2-Data.db")
+	if min != keys[0] || max != keys[blockKeyNum-1] {
+		t.Fatalf("wrong key range " + min + " " + max)
+	}
+
+	pmap := PrefixScan("key1", prefix, uint64(1), "block", 10000, 0)
+	for _, key := range keys {
+		_, ok := pmap[key]
+		if ok != (strings.HasPrefix(key, "key1") && key != keys[5]) {
+			t.Fatalf("Prefix scan failed for " + key)
+		}
+	}
+
+	rmap := RangeScan("key10", "key20", prefix, uint64(1), "block", 10000, 0)
+	for _, key := range keys {
+		_, ok := rmap[key]
+		if ok != (key >= "key10" && key <= "key20" && key != keys[5]) {
+			t.Fatalf("Range scan failed for " + key)
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestBlockCompression(t *testing.T) {
+	prefix := "data/compressedTables"
+	codecs := []string{"none", "lz", "flate", "zlib"}
+
+	// every table gets a different codec, so the level ends up mixing all of them
+	for i, codec := range codecs {
+		w := newWriter(prefix, 0, "block", 3, "flush", compression.CodecFromName(codec))
+		for j := 0; j < 500; j++ {
+			key := codec + "-key" + fmt.Sprintf("%04d", j)
+			value := `{"id":` + strconv.Itoa(j) + `,"table":` + strconv.Itoa(i) + `,"name":"` + key + `"}`
+			w.Add(key, database_elem.DatabaseElem{Value: []byte(value), Timestamp: uint64(time.Now().Unix())})
+		}
+		OpenManifest(prefix).Apply(manifest.Edit{Add: []manifest.Table{*w.Finish()}})
+	}
+
+	sizes := make([]int64, len(codecs))
+	for i := range codecs {
+		info, err := os.Stat(prefix + "/usertable-L0-" + strconv.Itoa(i+1) + "-Data.db")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sizes[i] = info.Size()
+	}
+	for i := 1; i < len(codecs); i++ {
+		if sizes[i] >= sizes[0] {
+			t.Fatalf("%s table is not smaller than the uncompressed one", codecs[i])
+		}
+	}
+
+	for i, codec := range codecs {
+		for j := 0; j < 500; j++ {
+			key := codec + "-key" + fmt.Sprintf("%04d", j)
+			found, dbel := Find(key, prefix, 1, "block")
+			if !found || !strings.Contains(string(dbel.Value), `"table":`+strconv.Itoa(i)) {
+				t.Fatalf("find not working for " + key)
+			}
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestProperties(t *testing.T) {
+	prefix := "data/propertiesTables"
+	dbelems := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+	for i := 0; i < 50; i++ {
+		elem := database_elem.DatabaseElem{Value: []byte("value" + strconv.Itoa(i)), Timestamp: uint64(1000 + i)}
+		if i%10 == 0 {
+			elem.Tombstone = 1
+		}
+		dbelems = append(dbelems, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: fmt.Sprintf("key%02d", i), Value: elem})
+	}
+
+	formats := []string{"one", "many", "block"}
+	for _, format := range formats {
+		CreateSStable(dbelems, 3, prefix, 0, format)
+	}
+
+	for i, format := range formats {
+		dataFile := prefix + "/usertable-L0-" + strconv.Itoa(i+1) + "-Data.db"
+		props, err := ReadProperties(dataFile)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if props.Version != FOOTER_VERSION || props.Format != format || props.Compaction != "flush" {
+			t.Fatalf("wrong header properties for %s: %+v", format, props)
+		}
+		if props.EntryCount != 50 || props.TombstoneCount != 5 {
+			t.Fatalf("wrong counts for %s: %+v", format, props)
+		}
+		if props.MinKey != "key00" || props.MaxKey != "key49" || props.MinTimestamp != 1000 || props.MaxTimestamp != 1049 {
+			t.Fatalf("wrong ranges for %s: %+v", format, props)
+		}
+		if props.RawSize == 0 || props.DiskSize == 0 {
+			t.Fatalf("sizes missing for %s: %+v", format, props)
+		}
+	}
+
+	// older versions end before the filter fields, a block cut there isn't read as one of them
+	props := newProperties("one", "flush")
+	props.add("key", database_elem.DatabaseElem{Value: []byte("value"), Timestamp: 1})
+	full := props.encode()
+	v1 := full[:len(full)-40] // empty extractor name, prefix filter offset and the range filter fields
+	if old, err := decodeProperties(v1, 1, "one"); err != nil || old.Compaction != "flush" || old.MaxKey != "key" {
+		t.Fatalf("version 1 properties weren't read: %+v, %v", old, err)
+	}
+	v2 := full[:len(full)-24] // without the range filter fields
+	if old, err := decodeProperties(v2, 2, "one"); err != nil || old.RangeFilterSize != 0 {
+		t.Fatalf("version 2 properties weren't read: %+v, %v", old, err)
+	}
+	for _, truncated := range [][]byte{v1, v2} {
+		if _, err := decodeProperties(truncated, FOOTER_VERSION, "one"); err == nil {
+			t.Fatalf("truncated properties were read as an older version")
+		}
+	}
+
+	// a newer version must be rejected instead of being misread
+	dataFile := prefix + "/usertable-L0-1-Data.db"
+	content, _ := os.ReadFile(dataFile)
+	content[len(content)-16]++
+	os.WriteFile(dataFile, content, 0644)
+	if _, err := ReadProperties(dataFile); err == nil || !strings.Contains(err.Error(), "unsupported sstable version") {
+		t.Fatalf("unknown version was accepted: %v", err)
+	}
+
+	os.WriteFile(dataFile, []byte("definitely not a table"), 0644)
+	if _, err := ReadProperties(dataFile); err == nil {
+		t.Fatalf("garbage was accepted as a table")
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestManifestRecovery(t *testing.T) {
+	prefix := "data/manifestTables"
+	CreateSStable(createElements(0, 50), 3, prefix, 0, "one")
+	CreateSStable(createElements(50, 100), 3, prefix, 0, "block")
+
+	// a compaction that crashed before its edit leaves a table the manifest doesn't know
+	w := NewWriter(prefix, 1, "one", 3, "leveled L0->L1")
+	for _, elem := range createElements(100, 150) {
+		w.Add(elem.Key, elem.Value)
+	}
+	orphan := w.Finish()
+
+	OpenManifest(prefix).Close()
+	if len(OpenManifest(prefix).Current().Tables) != 2 {
+		t.Fatalf("orphan table was added on recovery")
+	}
+	if _, err := os.Stat(DataFile(prefix, *orphan)); !os.IsNotExist(err) {
+		t.Fatalf("orphan table was not removed")
+	}
+
+	// tables from before the manifest existed are imported from their TOC files
+	OpenManifest(prefix).Close()
+	os.Remove(prefix + "/" + manifest.FILE_NAME)
+	if len(OpenManifest(prefix).Current().Tables) != 2 {
+		t.Fatalf("existing tables were not imported")
+	}
+
+	for i := 0; i < 150; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if found, _ := Find(key, prefix, 2, "one"); found != (i < 100) {
+			t.Fatalf("find is wrong for " + key)
+		}
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestTableSync(t *testing.T) {
+	prefix := "data/syncedTables"
+	defer os.RemoveAll("data/")
+	m := OpenManifest(prefix)
+	newest := func() manifest.Table {
+		table := m.Current().Tables[0]
+		for _, other := range m.Current().Tables {
+			if other.Number > table.Number {
+				table = other
+			}
+		}
+		return table
+	}
+
+	fsyncFile, fsyncDir := syncFile, syncDir
+	defer func() {
+		syncFile, syncDir = fsyncFile, fsyncDir
+	}()
+
+	// every sync has to come before the edit that makes the table live
+	synced := make(map[string]bool)
+	tables := 0
+	syncFile = func(filename string) {
+		if len(m.Current().Tables) != tables {
+			t.Fatalf("%s was synced after the manifest edit", filename)
+		}
+		synced[filename] = true
+	}
+	syncDir = func(dir string) {
+		syncFile(dir)
+	}
+	expectSynced := func(table manifest.Table) {
+		toc := prefix + "/" + table.Name + "TOC.txt"
+		for _, file := range append(readTOCLines(toc), toc, prefix) {
+			if !synced[file] {
+				t.Fatalf("%s wasn't synced", file)
+			}
+		}
+	}
+
+	for _, format := range []string{"one", "many", "block"} {
+		synced = make(map[string]bool)
+		CreateSStable(createElements(0, 50), 3, prefix, 0, format)
+		tables++
+		expectSynced(newest())
+	}
+
+	// the links of a moved table
+	synced = make(map[string]bool)
+	table := newest()
+	moved := MoveTable(prefix, table, 1, m.NewFileNumber())
+	m.Apply(manifest.Edit{Add: []manifest.Table{moved}, Remove: []uint64{table.Number}})
+	expectSynced(moved)
+}
+
+func TestIteratorSeek(t *testing.T) {
+	prefix := "data/seekTables"
+	for _, mode := range []string{"one", "many", "block"} {
+		CreateSStable(createElements(0, 300), 3, prefix, 0, mode)
+	}
+
+	for _, table := range OpenManifest(prefix).Current().Tables {
+		for _, start := range []int{0, 1, 150, 299} {
+			it := NewIterator(DataFile(prefix, table))
+			it.Seek(fmt.Sprintf("key%03d", start))
+			key, _ := it.Next()
+			if key != fmt.Sprintf("key%03d", start) {
+				t.Fatalf("%s: seek to %d returned %s", table.Name, start, key)
+			}
+			it.Close()
+		}
+
+		// between two keys and past the end
+		it := NewIterator(DataFile(prefix, table))
+		it.Seek("key150a")
+		if key, _ := it.Next(); key != "key151" {
+			t.Fatalf("%s: seek between keys returned %s", table.Name, key)
+		}
+		it.Seek("key9")
+		if _, value := it.Next(); value != nil {
+			t.Fatalf("%s: seek past the end returned a record", table.Name)
+		}
+		it.Close()
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestTableCache(t *testing.T) {
+	prefix := "data/cacheTables"
+	for i, mode := range []string{"one", "many", "block", "one"} {
+		CreateSStable(createElements(i*100, i*100+100), 3, prefix, 0, mode)
+	}
+	m := OpenManifest(prefix)
+
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if found, elem := Find(key, prefix, 1, "one"); !found || string(elem.Value) != "value"+strconv.Itoa(i) {
+			t.Fatalf("find through the table cache failed for " + key)
+		}
+	}
+	if found, _ := Find("key999", prefix, 1, "one"); found {
+		t.Fatalf("find through the table cache found a missing key")
+	}
+
+	cache := getTableCache()
+	table := m.Current().Tables[0]
+	reader := cache.get(m, table)
+	if cache.get(m, table) != reader {
+		t.Fatalf("table was opened twice")
+	}
+	cache.release(reader)
+
+	// deleting the table drops it from the cache, the reader still in use is closed after it
+	RemoveTable(prefix, table)
+	if !reader.evicted {
+		t.Fatalf("removed table is still cached")
+	}
+	cache.release(reader)
+
+	// least recently used tables are closed first
+	small := &tableCache{capacity: 2, lru: list.New(), entries: make(map[tableKey]*list.Element)}
+	readers := make([]*tableReader, 0)
+	for _, table := range m.Current().Tables[1:] {
+		reader := small.get(m, table)
+		small.release(reader)
+		readers = append(readers, reader)
+	}
+	if small.size() != 2 || !readers[0].evicted || readers[1].evicted || readers[2].evicted {
+		t.Fatalf("least recently used table wasn't closed, cache holds %d tables", small.size())
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestBlockCache(t *testing.T) {
+	prefix := "data/blockCacheTables"
+	for i, mode := range []string{"one", "many", "block"} {
+		CreateSStable(createElements(i*100, i*100+100), 3, prefix, 0, mode)
+	}
+	cache := blockcache.Shared()
+
+	find := func() {
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("key%03d", i)
+			if found, elem := Find(key, prefix, 1, "one"); !found || string(elem.Value) != "value"+strconv.Itoa(i) {
+				t.Fatalf("find through the block cache failed for " + key)
+			}
+		}
+	}
+	find()
+	before := cache.Stats()
+	find()
+	after := cache.Stats()
+	if after.Misses != before.Misses || after.Hits == before.Hits {
+		t.Fatalf("second round of lookups went to disk, %d misses", after.Misses-before.Misses)
+	}
+
+	// compaction reads don't fill the cache
+	CreateSStable(createElements(300, 400), 3, prefix, 0, "one")
+	table := OpenManifest(prefix).Current().Tables[0]
+	it := NewIterator(DataFile(prefix, table))
+	it.SetFillCache(false)
+	for _, elem := it.Next(); elem != nil; _, elem = it.Next() {
+	}
+	it.Close()
+	if cache.Stats().Inserts != after.Inserts {
+		t.Fatalf("iterator that doesn't fill the cache put blocks into it")
+	}
+
+	// blocks of deleted tables are dropped, tables are newest first
+	first := OpenManifest(prefix).Current().Tables[3]
+	key := blockcache.Key{Table: mustFileID(DataFile(prefix, first)), Offset: 0}
+	if _, ok := cache.Get(key); !ok {
+		t.Fatalf("first page of the table isn't cached")
+	}
+	RemoveTable(prefix, first)
+	if _, ok := cache.Get(key); ok {
+		t.Fatalf("cache still holds blocks of a deleted table")
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestFilterStats(t *testing.T) {
+	prefix := "data/filterStatsTables"
+	level := 6
+	CreateSStable(createElements(0, 1000), 3, prefix, level, "one")
+
+	before := GetFilterStats()
+	for i := 0; i < 1000; i++ {
+		if found, _ := Find(fmt.Sprintf("key%03d", i), prefix, 10, "one"); !found {
+			t.Fatalf("find failed for key %d", i)
+		}
+	}
+	for i := 0; i < 999; i++ {
+		// inside the key range of the table, so only the filter can rule them out
+		Find(fmt.Sprintf("key%03dx", i), prefix, 10, "one")
+	}
+	after := GetFilterStats()
+
+	stats := after[level]
+	if len(before) > level {
+		stats.Checks -= before[level].Checks
+		stats.Negatives -= before[level].Negatives
+		stats.FalsePositives -= before[level].FalsePositives
+	}
+	if stats.Checks != 1999 || stats.Negatives+stats.FalsePositives != 999 {
+		t.Fatalf("wrong filter stats of level %d: %+v", level, stats)
+	}
+	if stats.FalsePositiveRate() > 0.05 {
+		t.Fatalf("false positive rate %.3f of a 10 bits per key filter", stats.FalsePositiveRate())
+	}
+
+	os.RemoveAll("data/")
+}
+
+func createElements(from, to int) []GTypes.KeyVal[string, database_elem.DatabaseElem] {
+	dbelems := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+	for i := from; i < to; i++ {
+		elem := database_elem.DatabaseElem{Value: []byte("value" + strconv.Itoa(i)), Timestamp: uint64(time.Now().Unix())}
+		dbelems = append(dbelems, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: fmt.Sprintf("key%03d", i), Value: elem})
+	}
+	return dbelems
+}
+
+func TestPrefixFilter(t *testing.T) {
+	prefix := "data/prefixTables"
+	prefixextractor.Register("user:", prefixextractor.Fixed(3))
+	defer prefixextractor.Unregister("user:")
+
+	// every format holds ten prefixes of its own, five keys each
+	for i, mode := range []string{"one", "many", "block"} {
+		elems := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+		for j := 0; j < 10; j++ {
+			for n := 0; n < 5; n++ {
+				key := fmt.Sprintf("user:%c%02d-%d", 'a'+i, j, n)
+				elems = append(elems, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: database_elem.DatabaseElem{Value: []byte(key)}})
+			}
+		}
+		CreateSStable(elems, 3, prefix, 0, mode)
+	}
+
+	prefixStats := func() FilterStats {
+		stats := GetFilterStats()
+		if len(stats) == 0 {
+			return FilterStats{}
+		}
+		return stats[0]
+	}
+
+	before := prefixStats()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 10; j++ {
+			if found := PrefixScan(fmt.Sprintf("user:%c%02d", 'a'+i, j), prefix, 1, "one", 1000, 0); len(found) != 5 {
+				t.Fatalf("prefix scan found %d keys instead of 5", len(found))
+			}
+		}
+	}
+	for j := 0; j < 100; j++ {
+		if found := PrefixScan(fmt.Sprintf("user:z%02d", j), prefix, 1, "one", 1000, 0); len(found) != 0 {
+			t.Fatalf("prefix scan found keys of a prefix nobody wrote")
+		}
+	}
+	stats := prefixStats()
+	checks, negatives := stats.PrefixChecks-before.PrefixChecks, stats.PrefixNegatives-before.PrefixNegatives
+	// a present prefix is in one of the three tables, the other two can only be false positives
+	if checks != 390 || negatives < 330 || negatives > 360 {
+		t.Fatalf("prefix filters ruled out %d of %d tables", negatives, checks)
+	}
+
+	// shorter than the extracted prefix, the filters can't tell
+	before = prefixStats()
+	if found := PrefixScan("user:a", prefix, 1, "one", 1000, 0); len(found) != 50 {
+		t.Fatalf("prefix scan found %d keys instead of 50", len(found))
+	}
+	// filters built by another extractor aren't used
+	prefixextractor.Register("user:", prefixextractor.Fixed(2))
+	if found := PrefixScan("user:b01", prefix, 1, "one", 1000, 0); len(found) != 5 {
+		t.Fatalf("prefix scan found %d keys instead of 5", len(found))
+	}
+	if stats := prefixStats(); stats.PrefixChecks != before.PrefixChecks {
+		t.Fatalf("prefix filters were asked about prefixes they can't rule out")
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestRangeFilter(t *testing.T) {
+	prefix := "data/rangeTables"
+	// the tables take turns, so every one of them spans almost all keys and only the filters can tell them apart
+	modes := []string{"one", "many", "block"}
+	for i, mode := range modes {
+		elems := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+		for j := 0; j < 100; j++ {
+			key := fmt.Sprintf("key%04d", 10*(3*j+i))
+			elems = append(elems, GTypes.KeyVal[string, database_elem.DatabaseElem]{Key: key, Value: database_elem.DatabaseElem{Value: []byte(key)}})
+		}
+		CreateSStable(elems, 3, prefix, 0, mode)
+	}
+
+	m := OpenManifest(prefix)
+	for _, table := range m.Current().Tables {
+		props, err := ReadProperties(DataFile(prefix, table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props.RangeFilterSize == 0 || props.RangeFilterFPR <= 0 || props.RangeFilterFPR > 0.05 {
+			t.Fatalf("range filter of a %s table has size %d and false positive rate %f", props.Format, props.RangeFilterSize, props.RangeFilterFPR)
+		}
+	}
+
+	rangeStats := func() FilterStats {
+		stats := GetFilterStats()
+		if len(stats) == 0 {
+			return FilterStats{}
+		}
+		return stats[0]
+	}
+
+	before := rangeStats()
+	for j := 0; j < 300; j++ {
+		// one key of one table
+		if found := RangeScan(fmt.Sprintf("key%04d", 10*j), fmt.Sprintf("key%04d", 10*j+5), prefix, 1, "one", 1000, 0); len(found) != 1 {
+			t.Fatalf("range scan found %d keys instead of 1", len(found))
+		}
+		// between two keys
+		if found := RangeScan(fmt.Sprintf("key%04d", 10*j+1), fmt.Sprintf("key%04d", 10*j+9), prefix, 1, "one", 1000, 0); len(found) != 0 {
+			t.Fatalf("range scan found keys nobody wrote")
+		}
+	}
+	stats := rangeStats()
+	checks, negatives := stats.RangeChecks-before.RangeChecks, stats.RangeNegatives-before.RangeNegatives
+	// the manifest key ranges rule out a few tables at both ends, the filters have to do the rest
+	if checks < 1700 || negatives < checks-300-checks/10 {
+		t.Fatalf("range filters ruled out %d of %d tables", negatives, checks)
+	}
+
+	if found := RangeScan("key0000", "key9999", prefix, 1, "one", 1000, 0); len(found) != 300 {
+		t.Fatalf("range scan found %d keys instead of 300", len(found))
+	}
+
+	os.RemoveAll("data/")
+}
+
+func TestMmapReads(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("mmap reads are only supported on linux")
+	}
+	previous := getReaderMode()
+	SetReaderMode(READER_MMAP)
+	defer SetReaderMode(previous)
+
+	for _, mode := range []string{"one", "many", "block"} {
+		prefix := "data/mmapTables" + mode
+		CreateSStable(createElements(0, 500), 3, prefix, 0, mode)
+
+		for i := 0; i < 500; i++ {
+			found, elem := Find(fmt.Sprintf("key%03d", i), prefix, 1, mode)
+			if !found || string(elem.Value) != "value"+strconv.Itoa(i) {
+				t.Fatalf("find failed for key %d of a mapped %s table", i, mode)
+			}
+		}
+		if found, _ := Find("key250x", prefix, 1, mode); found {
+			t.Fatalf("found a key nobody wrote in a mapped %s table", mode)
+		}
+		if found := PrefixScan("key1", prefix, 1, mode, 1000, 0); len(found) != 100 {
+			t.Fatalf("prefix scan of a mapped %s table found %d keys instead of 100", mode, len(found))
+		}
+
+		// a retired table stays mapped until the last lookup using it is done
+		m := OpenManifest(prefix)
+		table := m.Current().Tables[0]
+		cache := getTableCache()
+		reader := cache.get(m, table)
+		if reader.dataMap == nil {
+			t.Fatalf("%s table wasn't mapped", mode)
+		}
+		if mode == "block" {
+			// keys are compared where they lie, only the value found is copied out
+			allocs := testing.AllocsPerRun(100, func() {
+				reader.lookup("key123")
+			})
+			if allocs > 3 {
+				t.Fatalf("a lookup in a mapped block table took %.0f allocations", allocs)
+			}
+		}
+		evictTable(prefix, table)
+		if found, _ := reader.find("key123"); !found || reader.dataMap.data == nil {
+			t.Fatalf("%s table was unmapped while a lookup used it", mode)
+		}
+		cache.release(reader)
+		if reader.dataMap.data != nil {
+			t.Fatalf("%s table stayed mapped after it was evicted", mode)
+		}
+	}
+
+	// empty and truncated files are read with pread instead
+	os.MkdirAll("data/", os.ModePerm)
+	os.WriteFile("data/empty", nil, 0644)
+	os.WriteFile("data/short", make([]byte, 10), 0644)
+	empty, _ := os.Open("data/empty")
+	defer empty.Close()
+	short, _ := os.Open("data/short")
+	defer short.Close()
+	if mapIfEnabled(empty, 0) != nil || mapIfEnabled(short, 20) != nil {
+		t.Fatalf("an empty or truncated file was mapped")
+	}
+	if m := mapIfEnabled(short, 10); m == nil || m.size() != 10 {
+		t.Fatalf("a whole file wasn't mapped")
+	} else {
+		m.close()
+	}
+
+	os.RemoveAll("data/")
+}
@@ -0,0 +1,370 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"io"
+	"log"
+	bloomfilter "nosql-engine/packages/utils/bloom-filter"
+	"nosql-engine/packages/utils/config"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
+	rangefilter "nosql-engine/packages/utils/range-filter"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const DEFAULT_TABLE_CACHE_SIZE = 64
+
+// tableReader keeps a table open for lookups: its files, the parsed footer, the summary and the filter
+type tableReader struct {
+	level      int
+	format     string
+	footer     *footer
+	file       *os.File // data file
+	index      *os.File // index file of "many" tables, the data file for the others
+	indexEnd   uint64
+	data       *pagedFile // the two files read through the block cache, "one" and "many" tables only
+	indexPages *pagedFile
+	dataMap    *mappedFile // the data and index files in READER_MMAP mode, nil otherwise. Unmapped by close,
+	indexMap   *mappedFile // which only runs once no lookup uses the reader
+	summary    Summary     // index offsets point into index
+	filter     *bloomfilter.BloomFilter
+	block      *blockTable // "block" tables only
+
+	prefixFilter    *bloomfilter.BloomFilter // nil if the table has none
+	prefixExtractor string                   // extractors the prefix filter was built with
+	rangeFilter     *rangefilter.RangeFilter // nil if the table has none
+
+	refs    int  // lookups using the reader right now
+	evicted bool // closed once the last lookup is done
+}
+
+func openTableReader(prefix string, table manifest.Table) *tableReader {
+	fmap := readTOC(table.Name+"TOC.txt", prefix)
+
+	file, err := os.Open(fmap["data"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &tableReader{level: table.Level, format: fmap["format"], footer: mustReadFooter(fmap["data"]), file: file, index: file}
+	r.dataMap = mapIfEnabled(file, r.footer.fileSize)
+
+	switch r.format {
+	case "block":
+		r.block = openBlockTable(fmap["data"], r.dataMap)
+		r.filter = bloomfilter.NewFromFile(fmap["data"], r.block.filterOffset)
+	case "many":
+		r.index, err = os.Open(fmap["index"])
+		if err != nil {
+			log.Fatal(err)
+		}
+		r.indexEnd = fileSize(fmap["index"])
+		r.filter = bloomfilter.NewFromFile(fmap["filter"], 0)
+		r.summary = readSummary(fmap["summary"], 0, fileSize(fmap["summary"]))
+		r.data, r.indexPages = newPagedFile(r.file, fmap["data"]), newPagedFile(r.index, fmap["index"])
+		if r.dataMap != nil {
+			r.indexMap = mapIfEnabled(r.index, r.indexEnd)
+		}
+	default:
+		r.indexEnd = r.footer.summaryOffset
+		r.filter = bloomfilter.NewFromFile(fmap["data"], r.footer.filterOffset)
+		if r.dataMap != nil {
+			r.summary = parseSummary(r.dataMap.slice(r.footer.summaryOffset, r.footer.filterOffset-r.footer.summaryOffset))
+		} else {
+			r.summary = readSummary(fmap["data"], r.footer.summaryOffset, r.footer.filterOffset)
+		}
+		r.data = newPagedFile(r.file, fmap["data"])
+		r.indexPages = r.data
+		r.indexMap = r.dataMap
+	}
+	r.prefixFilter, r.prefixExtractor = readPrefixFilter(fmap["data"])
+	r.rangeFilter = readRangeFilter(fmap["data"])
+	return r
+}
+
+func (r *tableReader) close() {
+	r.file.Close()
+	if r.index != r.file {
+		r.index.Close()
+	}
+	if r.indexMap != r.dataMap {
+		r.indexMap.close()
+	}
+	r.dataMap.close()
+}
+
+// summary of a "one" or "many" table, it lies in [start, end) of the file
+func readSummary(filename string, start, end uint64) Summary {
+	file, err := os.Open(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	if m := mapIfEnabled(file, end); m != nil {
+		defer m.close()
+		return parseSummary(m.slice(start, end-start))
+	}
+	buffer := make([]byte, end-start)
+	if _, err := file.ReadAt(buffer, int64(start)); err != nil {
+		log.Fatal(err)
+	}
+	return parseSummary(buffer)
+}
+
+// keys are copied, the summary may outlive the buffer
+func parseSummary(buffer []byte) Summary {
+	reader := bytes.NewReader(buffer)
+	summary := Summary{Start: readKeyFrom(reader), Stop: readKeyFrom(reader), Indexes: make([]GTypes.KeyVal[string, uint64], 0)}
+	for {
+		key, err := tryReadKeyFrom(reader)
+		if err != nil {
+			break
+		}
+		summary.Indexes = append(summary.Indexes, GTypes.KeyVal[string, uint64]{Key: key, Value: readUint64From(reader)})
+	}
+	return summary
+}
+
+// found tells if the table has the key, tombstones included. What the filter did is counted for the level
+func (r *tableReader) find(key string) (bool, database_elem.DatabaseElem) {
+	if !r.filter.Find(key) {
+		recordFilter(r.level, false, false)
+		return false, database_elem.DatabaseElem{}
+	}
+	found, elem := r.lookup(key)
+	recordFilter(r.level, true, found)
+	return found, elem
+}
+
+func (r *tableReader) lookup(key string) (bool, database_elem.DatabaseElem) {
+	if r.block != nil {
+		i := r.block.seekBlock(key)
+		if i == len(r.block.index) {
+			return false, database_elem.DatabaseElem{}
+		}
+		handle := r.block.index[i].Value
+		var contents []byte
+		if r.dataMap != nil {
+			contents = readMappedBlock(r.dataMap, handle)
+		} else {
+			contents = r.block.cachedBlock(r.file, handle, true)
+		}
+		it := newBlockIter(contents)
+		// the value is the only thing copied, the caller keeps it after the table may be unmapped
+		if it.seek(key) && string(it.key) == key {
+			return true, decodeBlockValue(it.value)
+		}
+		return false, database_elem.DatabaseElem{}
+	}
+
+	if key < r.summary.Start || key > r.summary.Stop {
+		return false, database_elem.DatabaseElem{}
+	}
+	// the part of the index between the summary entries around the key
+	start, stop := uint64(0), uint64(0)
+	for _, entry := range r.summary.Indexes {
+		if entry.Key == key {
+			start, stop = entry.Value, entry.Value
+			break
+		}
+		if entry.Key > key {
+			stop = entry.Value
+			break
+		}
+		start = entry.Value
+	}
+	if r.indexMap != nil {
+		return r.lookupMapped(key, start, stop)
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(r.indexPages, int64(start), int64(r.indexEnd-start)))
+	for pos := start; pos <= stop; {
+		filekey := readKeyFrom(reader)
+		offset := readUint64From(reader)
+		pos += 16 + uint64(len(filekey))
+		if filekey == key {
+			return true, r.record(offset)
+		}
+		if filekey > key {
+			break
+		}
+	}
+	return false, database_elem.DatabaseElem{}
+}
+
+// record of a "one" or "many" table at the offset of its data file
+func (r *tableReader) record(offset uint64) database_elem.DatabaseElem {
+	_, elem, _ := readRecordFrom(bufio.NewReader(io.NewSectionReader(r.data, int64(offset), int64(r.footer.dataEnd()-offset))))
+	return elem
+}
+
+// reads one record of a "one" or "many" table, size is the number of bytes it took
+func readRecordFrom(reader io.Reader) (string, database_elem.DatabaseElem, uint64) {
+	header := make([]byte, 4+8+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		log.Fatal(err)
+	}
+	crc := binary.LittleEndian.Uint32(header[0:4])
+	timestamp := binary.LittleEndian.Uint64(header[4:12])
+	tombstone := header[12]
+	key := readKeyFrom(reader)
+	value := make([]byte, readUint64From(reader))
+	if _, err := io.ReadFull(reader, value); err != nil {
+		log.Fatal(err)
+	}
+
+	if !checkCRC(crc, timestamp, tombstone, key, value) {
+		log.Fatal("crc not match values")
+	}
+	// crc, timestamp, tombstone and both sizes
+	size := uint64(4 + 8 + 1 + 8 + len(key) + 8 + len(value))
+	return key, database_elem.DatabaseElem{Tombstone: tombstone, Value: value, Timestamp: timestamp}, size
+}
+
+func readKeyFrom(reader io.Reader) string {
+	key, err := tryReadKeyFrom(reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+func tryReadKeyFrom(reader io.Reader) (string, error) {
+	buffer := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return "", err
+	}
+	key := make([]byte, binary.LittleEndian.Uint64(buffer))
+	if _, err := io.ReadFull(reader, key); err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func readUint64From(reader io.Reader) uint64 {
+	buffer := make([]byte, 8)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		log.Fatal(err)
+	}
+	return binary.LittleEndian.Uint64(buffer)
+}
+
+// tables of different manifests never share an entry, even if the directory was wiped and reused
+type tableKey struct {
+	m      *manifest.Manifest
+	number uint64
+}
+
+type tableEntry struct {
+	key    tableKey
+	reader *tableReader
+}
+
+// tableCache is a LRU of open tables, the least recently used one is closed when there are too many
+type tableCache struct {
+	lock     sync.Mutex
+	capacity int
+	lru      *list.List
+	entries  map[tableKey]*list.Element
+}
+
+var (
+	tables     *tableCache
+	tablesOnce sync.Once
+)
+
+func getTableCache() *tableCache {
+	tablesOnce.Do(func() {
+		capacity := int(config.GetConfig().TableCacheSize)
+		if capacity <= 0 {
+			capacity = DEFAULT_TABLE_CACHE_SIZE
+		}
+		tables = &tableCache{capacity: capacity, lru: list.New(), entries: make(map[tableKey]*list.Element)}
+	})
+	return tables
+}
+
+// open reader of the table, it has to be given back with release
+func (c *tableCache) get(m *manifest.Manifest, table manifest.Table) *tableReader {
+	key := tableKey{m: m, number: table.Number}
+
+	c.lock.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		reader := element.Value.(*tableEntry).reader
+		reader.refs++
+		c.lock.Unlock()
+		return reader
+	}
+	c.lock.Unlock()
+
+	// opening reads several files, other lookups shouldn't wait for it
+	reader := openTableReader(m.Dir(), table)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		// someone else opened it meanwhile
+		reader.close()
+		c.lru.MoveToFront(element)
+		reader = element.Value.(*tableEntry).reader
+	} else {
+		c.entries[key] = c.lru.PushFront(&tableEntry{key: key, reader: reader})
+		for c.lru.Len() > c.capacity {
+			c.remove(c.lru.Back())
+		}
+	}
+	reader.refs++
+	return reader
+}
+
+func (c *tableCache) release(reader *tableReader) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	reader.refs--
+	if reader.evicted && reader.refs == 0 {
+		reader.close()
+	}
+}
+
+// drops the table from the cache, called when its files are deleted
+func (c *tableCache) evict(dir string, number uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for key, element := range c.entries {
+		if key.number == number && key.m.Dir() == dir {
+			c.remove(element)
+		}
+	}
+}
+
+// lock has to be held
+func (c *tableCache) remove(element *list.Element) {
+	entry := element.Value.(*tableEntry)
+	c.lru.Remove(element)
+	delete(c.entries, entry.key)
+
+	entry.reader.evicted = true
+	if entry.reader.refs == 0 {
+		entry.reader.close()
+	}
+}
+
+// number of tables open right now
+func (c *tableCache) size() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func evictTable(prefix string, table manifest.Table) {
+	getTableCache().evict(filepath.Clean(prefix), table.Number)
+}
@@ -0,0 +1,194 @@
+package sstable
+
+import (
+	"bufio"
+	"log"
+	"nosql-engine/packages/utils/manifest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifest of the tables under prefix, it decides which tables exist, the directory listing doesn't
+func OpenManifest(prefix string) *manifest.Manifest {
+	return manifest.Open(prefix, func(m *manifest.Manifest, created bool) {
+		if created {
+			importTables(m)
+		} else {
+			removeOrphans(m)
+		}
+	})
+}
+
+// tables written before the manifest existed are found by their TOC files, once
+func importTables(m *manifest.Manifest) {
+	files, err := os.ReadDir(m.Dir())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type legacyTable struct {
+		level int
+		order int
+		name  string
+	}
+	tables := make([]legacyTable, 0)
+	maxOrder := 0
+	for _, file := range files {
+		tokens := strings.Split(file.Name(), "-")
+		if len(tokens) != 4 || tokens[0] != "usertable" || tokens[3] != "TOC.txt" {
+			continue
+		}
+		level, err1 := strconv.Atoi(strings.TrimPrefix(tokens[1], "L"))
+		order, err2 := strconv.Atoi(tokens[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		tables = append(tables, legacyTable{level: level, order: order, name: strings.TrimSuffix(file.Name(), "TOC.txt")})
+		if order > maxOrder {
+			maxOrder = order
+		}
+	}
+	if len(tables) == 0 {
+		return
+	}
+
+	// numbers follow the old per level order, so newer tables stay in front
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].level != tables[j].level {
+			return tables[i].level < tables[j].level
+		}
+		return tables[i].order < tables[j].order
+	})
+
+	// new tables are numbered after the old ones so their names never clash
+	edit := manifest.Edit{}
+	for i, table := range tables {
+		t := describeTable(m.Dir(), table.name, table.level)
+		t.Number = uint64(maxOrder + 1 + i)
+		edit.Add = append(edit.Add, t)
+	}
+	m.Apply(edit)
+}
+
+// files of tables the manifest doesn't know, left behind by a flush or compaction that didn't finish
+func removeOrphans(m *manifest.Manifest) {
+	files, err := os.ReadDir(m.Dir())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	live := make(map[string]bool)
+	for _, table := range m.Current().Tables {
+		live[table.Name] = true
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "usertable-") {
+			continue
+		}
+		if !live[name[:strings.LastIndex(name, "-")+1]] {
+			os.Remove(m.Dir() + "/" + name)
+		}
+	}
+}
+
+// manifest entry of a finished table, name is relative to the directory
+func describeTable(dir string, name string, level int) manifest.Table {
+	dataFile := dir + "/" + name + "Data.db"
+	min, max := TableKeyRange(dataFile)
+
+	size := uint64(0)
+	for _, file := range readTOCLines(dir + "/" + name + "TOC.txt") {
+		size += fileSize(file)
+	}
+	return manifest.Table{Level: level, Name: name, MinKey: min, MaxKey: max, Size: size}
+}
+
+// name of the "Data file" of a table from the manifest
+func DataFile(prefix string, table manifest.Table) string {
+	return prefix + "/" + table.Name + "Data.db"
+}
+
+// removes all files of a table, the table has to be out of the manifest already
+func RemoveTable(prefix string, table manifest.Table) {
+	evictTable(prefix, table)
+	toc := prefix + "/" + table.Name + "TOC.txt"
+	for _, file := range readTOCLines(toc) {
+		evictBlocks(file)
+		os.Remove(file)
+	}
+	os.Remove(toc)
+}
+
+// gives the table a new name on another level by linking its files under that name, nothing is rewritten.
+// The returned entry takes the place of the old one in the manifest, the old files go once they are retired
+func MoveTable(prefix string, table manifest.Table, level int, number uint64) manifest.Table {
+	name := "usertable-L" + strconv.Itoa(level) + "-" + strconv.FormatUint(number, 10) + "-"
+
+	lines := readTOCLines(prefix + "/" + table.Name + "TOC.txt")
+	toc, err := os.Create(prefix + "/" + name + "TOC.txt")
+	if err != nil {
+		panic(err)
+	}
+
+	for _, file := range lines {
+		moved := strings.Replace(file, table.Name, name, 1)
+		if err := os.Link(file, moved); err != nil {
+			panic(err)
+		}
+		toc.WriteString(moved + "\n")
+	}
+	toc.Close()
+	syncTable(prefix, name)
+
+	moved := table
+	moved.Number = number
+	moved.Level = level
+	moved.Name = name
+	return moved
+}
+
+// fsyncs, tests replace them to see that a table is on disk before the manifest knows it
+var (
+	syncFile = func(filename string) {
+		file, err := os.Open(filename)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		if err := file.Sync(); err != nil {
+			panic(err)
+		}
+	}
+	syncDir = manifest.SyncDir
+)
+
+// puts the files of a finished table and their names in the directory on disk. It has to happen before
+// an edit adds the table to the manifest, after that edit compactions delete their inputs and flushes
+// empty the WAL. name is relative to the directory
+func syncTable(prefix string, name string) {
+	toc := prefix + "/" + name + "TOC.txt"
+	for _, file := range readTOCLines(toc) {
+		syncFile(file)
+	}
+	syncFile(toc)
+	syncDir(prefix)
+}
+
+func readTOCLines(filename string) []string {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
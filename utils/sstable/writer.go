@@ -0,0 +1,207 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"nosql-engine/packages/utils/compression"
+	database_elem "nosql-engine/packages/utils/database-elem"
+	GTypes "nosql-engine/packages/utils/generic-types"
+	"nosql-engine/packages/utils/manifest"
+	ratelimiter "nosql-engine/packages/utils/rate-limiter"
+	"os"
+	"strconv"
+)
+
+// Writer builds a new sstable record by record, records have to be added in sorted order.
+// Only the data goes to disk as it comes, index, summary and filter are written by Finish.
+// The table is not part of the manifest until the returned entry is applied to it, Finish syncs it to disk first.
+type Writer struct {
+	prefix       string
+	name         string // table name without the prefix, "/usertable-L<level>-<number>-"
+	level        int
+	number       uint64
+	mode         string
+	summaryCount int
+	file         *os.File
+	offset       uint64
+	index        []GTypes.KeyVal[string, uint64]
+	mtData       [][]byte
+	block        *blockTableWriter
+	props        *Properties
+	limiter      *ratelimiter.Limiter
+	limited      uint64 // bytes already taken from the limiter
+}
+
+// compaction is recorded in the table properties, "flush" for tables coming from the memtable.
+// It also decides which rate limiter the written bytes go through
+func NewWriter(prefix string, level int, mode string, summaryCount int, compaction string) *Writer {
+	var codec byte = compression.NONE
+	if mode == "block" {
+		codec = compressionForLevel(level)
+	}
+	return newWriter(prefix, level, mode, summaryCount, compaction, codec)
+}
+
+// codec is only used by "block" mode tables, the other formats have no blocks to compress
+func newWriter(prefix string, level int, mode string, summaryCount int, compaction string, codec byte) *Writer {
+	number := OpenManifest(prefix).NewFileNumber()
+	name := "/usertable-L" + strconv.Itoa(level) + "-" + strconv.FormatUint(number, 10) + "-"
+
+	file, err := os.Create(prefix + name + "Data.db")
+	if err != nil {
+		panic(err)
+	}
+
+	w := &Writer{
+		prefix:       prefix,
+		name:         name,
+		level:        level,
+		number:       number,
+		mode:         mode,
+		summaryCount: summaryCount,
+		file:         file,
+		offset:       0,
+		index:        make([]GTypes.KeyVal[string, uint64], 0),
+		mtData:       make([][]byte, 0),
+		block:        nil,
+		props:        newProperties(mode, compaction),
+		limiter:      ratelimiter.Get(ratelimiter.COMPACTION),
+		limited:      0,
+	}
+	if compaction == "flush" {
+		w.limiter = ratelimiter.Get(ratelimiter.FLUSH)
+	}
+	if mode == "block" {
+		w.block = newBlockTableWriter(file, codec, bitsPerKeyForLevel(level), w.props)
+	}
+
+	return w
+}
+
+func (w *Writer) Add(key string, elem database_elem.DatabaseElem) {
+	w.props.add(key, elem)
+	if w.block != nil {
+		w.block.add(key, elem)
+		w.throttle(w.block.offset)
+		return
+	}
+
+	record := encodeRecord(key, elem)
+	w.index = append(w.index, GTypes.KeyVal[string, uint64]{Key: key, Value: w.offset})
+	w.mtData = append(w.mtData, record)
+	w.file.Write(record)
+	w.offset += uint64(len(record))
+	w.throttle(w.offset)
+}
+
+// takes what was written since the last call from the limiter, written counts from the start of the table
+func (w *Writer) throttle(written uint64) {
+	if written > w.limited {
+		w.limiter.Request(written - w.limited)
+		w.limited = written
+	}
+}
+
+// number of records added so far
+func (w *Writer) Count() int {
+	if w.block != nil {
+		return len(w.block.keys)
+	}
+	return len(w.index)
+}
+
+// bytes of keys and values added so far, before any encoding or compression
+func (w *Writer) RawSize() uint64 {
+	return w.props.RawSize
+}
+
+// name of the data file of the table, with the prefix
+func (w *Writer) DataFile() string {
+	return w.prefix + w.name + "Data.db"
+}
+
+// returns the manifest entry of the table, nil if nothing was added and no table was made
+func (w *Writer) Finish() *manifest.Table {
+	if w.Count() == 0 {
+		w.file.Close()
+		os.Remove(w.DataFile())
+		return nil
+	}
+
+	if w.block != nil {
+		w.block.finish(w.prefix, w.name)
+		w.throttle(w.props.DiskSize)
+		syncTable(w.prefix, w.name[1:])
+		return w.table()
+	}
+
+	w.file.Close()
+	CreateMerkleFile(w.prefix+w.name, w.mtData)
+
+	bf := newTableFilter(len(w.index), w.level)
+	for _, elem := range w.index {
+		bf.Add(elem.Key)
+	}
+
+	sumIndexes := make([]GTypes.KeyVal[string, uint64], 0)
+	count := w.summaryCount
+	if len(w.index) <= count {
+		count = 1
+	} else {
+		count = (len(w.index) / count)
+	}
+	for i := 0; i < len(w.index); i++ {
+		if i == 0 || i == len(w.index)-1 || (i+1)%count == 0 {
+			sumIndexes = append(sumIndexes, GTypes.KeyVal[string, uint64]{Key: w.index[i].Key, Value: uint64(i)})
+		}
+	}
+	summary := Summary{Start: w.index[0].Key, Stop: w.index[len(w.index)-1].Key, Indexes: sumIndexes}
+
+	keys := make([]string, len(w.index))
+	for i, elem := range w.index {
+		keys[i] = elem.Key
+	}
+	prefixBf := newPrefixFilter(keys, bitsPerKeyForLevel(w.level), w.props)
+	rf := newRangeFilter(keys, bitsPerKeyForLevel(w.level))
+
+	values := make([]GTypes.KeyVal[string, database_elem.DatabaseElem], 0)
+	writeFiles(SSTable{Data: values, Index: w.index, Summary: summary, Bf: *bf, TOC: ""}, prefixBf, rf, w.prefix, w.name, w.mode, w.props)
+	// index, summary and filter
+	w.throttle(w.props.DiskSize)
+	syncTable(w.prefix, w.name[1:])
+	return w.table()
+}
+
+func (w *Writer) table() *manifest.Table {
+	return &manifest.Table{
+		Number: w.number,
+		Level:  w.level,
+		Name:   w.name[1:],
+		MinKey: w.props.MinKey,
+		MaxKey: w.props.MaxKey,
+		Size:   w.props.DiskSize,
+	}
+}
+
+// record as it is written in "one" and "many" data files, CRC first
+func encodeRecord(key string, elem database_elem.DatabaseElem) []byte {
+	byteslice := make([]byte, 0)
+	tmpbs := make([]byte, 8)
+
+	binary.LittleEndian.PutUint64(tmpbs, uint64(elem.Timestamp))
+	byteslice = append(byteslice, tmpbs...)
+
+	byteslice = append(byteslice, elem.Tombstone)
+
+	binary.LittleEndian.PutUint64(tmpbs, uint64(len(key)))
+	byteslice = append(byteslice, tmpbs...)
+	byteslice = append(byteslice, []byte(key)...)
+
+	binary.LittleEndian.PutUint64(tmpbs, uint64(len(elem.Value)))
+	byteslice = append(byteslice, tmpbs...)
+	byteslice = append(byteslice, elem.Value...)
+
+	crcslice := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crcslice, CRC32(byteslice))
+
+	return append(crcslice, byteslice...)
+}